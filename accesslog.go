@@ -0,0 +1,232 @@
+package nxhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type AccessRecord struct {
+	Time      time.Time
+	Method    string
+	URI       string
+	Proto     string
+	Route     string
+	Status    int
+	Bytes     int64
+	Latency   time.Duration
+	ClientIP  string
+	RequestID string
+	User      string
+	Referer   string
+	UserAgent string
+}
+
+// renders a record as one log line, without trailing newline
+type AccessLogFormat func(*AccessRecord) []byte
+
+func JsonLogFormat(rec *AccessRecord) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"time":       rec.Time.Format(time.RFC3339Nano),
+		"method":     rec.Method,
+		"uri":        rec.URI,
+		"proto":      rec.Proto,
+		"route":      rec.Route,
+		"status":     rec.Status,
+		"bytes":      rec.Bytes,
+		"latency_ms": float64(rec.Latency.Microseconds()) / 1000,
+		"client_ip":  rec.ClientIP,
+		"request_id": rec.RequestID,
+		"user":       rec.User,
+		"referer":    rec.Referer,
+		"user_agent": rec.UserAgent,
+	})
+	return b
+}
+
+// apache combined log format
+func CombinedLogFormat(rec *AccessRecord) []byte {
+	dash := func(s string) string {
+		if len(s) == 0 {
+			return "-"
+		}
+		return s
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %q %q",
+		dash(rec.ClientIP),
+		dash(rec.User),
+		rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		rec.Method, rec.URI, rec.Proto,
+		rec.Status,
+		rec.Bytes,
+		dash(rec.Referer),
+		dash(rec.UserAgent),
+	))
+}
+
+/*
+ * access log processor
+ */
+type AccessLogProcessor struct {
+	DefaultProcessor
+	out    io.Writer
+	format AccessLogFormat
+	lock   sync.Mutex
+}
+
+func (self *AccessLogProcessor) Process(ctx *NxContext) {
+	start := time.Now()
+	defer func() {
+		self.write(ctx, start)
+	}()
+	ctx.RunNext()
+}
+
+func (self *AccessLogProcessor) write(ctx *NxContext, start time.Time) {
+	r := ctx.Req()
+	rec := &AccessRecord{
+		Time:      start,
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Status:    ctx.ResponseStatus(),
+		Bytes:     ctx.ResponseSize(),
+		Latency:   time.Since(start),
+		ClientIP:  ctx.ClientIP(),
+		RequestID: ctx.RequestID(),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if len(rec.RequestID) == 0 {
+		rec.RequestID = r.Header.Get(RequestIdHeader)
+	}
+	if len(rec.URI) == 0 {
+		rec.URI = r.URL.RequestURI()
+	}
+	if rec.Status == 0 {
+		rec.Status = 200
+	}
+	if ctx.entry != nil {
+		rec.Route = ctx.entry.Name()
+	}
+	if u, _, ok := r.BasicAuth(); ok {
+		rec.User = u
+	}
+
+	line := append(self.format(rec), '\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, err := self.out.Write(line); err != nil {
+		log.Print("access log: ", err)
+	}
+}
+
+// out defaults to stdout, format to CombinedLogFormat
+func NewAccessLogProcessor(out io.Writer, format AccessLogFormat) *AccessLogProcessor {
+	if out == nil {
+		out = os.Stdout
+	}
+	if format == nil {
+		format = CombinedLogFormat
+	}
+	return &AccessLogProcessor{
+		DefaultProcessor: DefaultProcessor{name: "accesslog"},
+		out:              out,
+		format:           format,
+	}
+}
+
+/*
+ * log file rotated by size
+ */
+type RotatingFile struct {
+	path    string
+	maxsize int64
+	backups int
+	file    *os.File
+	size    int64
+	lock    sync.Mutex
+}
+
+func (self *RotatingFile) Write(b []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.file == nil {
+		if err := self.open(); err != nil {
+			return 0, err
+		}
+	}
+	if self.maxsize > 0 && self.size > 0 && self.size+int64(len(b)) > self.maxsize {
+		if err := self.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := self.file.Write(b)
+	self.size += int64(n)
+	return n, err
+}
+
+func (self *RotatingFile) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.file != nil {
+		err := self.file.Close()
+		self.file = nil
+		return err
+	}
+	return nil
+}
+
+func (self *RotatingFile) open() error {
+	f, err := os.OpenFile(self.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	self.file = f
+	self.size = fi.Size()
+	return nil
+}
+
+// path -> path.1 -> path.2 ... dropping the oldest
+func (self *RotatingFile) rotate() error {
+	self.file.Close()
+	self.file = nil
+
+	if self.backups > 0 {
+		for i := self.backups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", self.path, i), fmt.Sprintf("%s.%d", self.path, i+1))
+		}
+		if err := os.Rename(self.path, self.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(self.path, 0); err != nil {
+		return err
+	}
+	return self.open()
+}
+
+// maxsize in bytes, 0 never rotates. backups is the number of rotated files kept
+func NewRotatingFile(path string, maxsize int64, backups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:    path,
+		maxsize: maxsize,
+		backups: backups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
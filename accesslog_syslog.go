@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+
+package nxhttp
+
+import (
+	"log/syslog"
+)
+
+// access log sink writing to the local syslog daemon
+func NewSyslogWriter(tag string) (*syslog.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,78 @@
+package nxhttp
+
+import (
+	"context"
+	"net/http"
+)
+
+/*
+ * adapters between net/http and processors, to use stdlib compatible
+ * middleware (gorilla handlers, chi middleware...) in chains and
+ * processors in front of plain handlers. NxContextFrom gives the
+ * context of the request inside the wrapped handlers
+ */
+
+/* processor serving a http.Handler */
+type handlerProc struct {
+	DefaultProcessor
+	handler http.Handler
+}
+
+func (self *handlerProc) Process(ctx *NxContext) {
+	r := ctx.req.WithContext(context.WithValue(ctx.req.Context(), nxCtxKey{}, ctx))
+	self.handler.ServeHTTP(ctx.res, r)
+}
+
+// h ends the chain
+func WrapHandler(h http.Handler) NxProcessor {
+	return &handlerProc{
+		DefaultProcessor: DefaultProcessor{name: "handler"},
+		handler:          h,
+	}
+}
+
+// next handler of middlewares, running the rest of the chain
+func middlewareNext(w http.ResponseWriter, r *http.Request) {
+	ctx := NxContextFrom(r.Context())
+	if ctx == nil {
+		http.Error(w, "middleware next called outside of a request", http.StatusInternalServerError)
+		return
+	}
+	res, req := ctx.res, ctx.req
+	ctx.res, ctx.req = newResponseWriter(w), r
+	defer func() {
+		ctx.res, ctx.req = res, req
+	}()
+	ctx.RunNext()
+}
+
+// the rest of the chain is the next handler of mw, with the response
+// writer and request it passes on. the chain stops if mw does not call
+// next, e.g. for auth failures. mw is called once
+func WrapMiddleware(mw func(http.Handler) http.Handler) NxProcessor {
+	return &handlerProc{
+		DefaultProcessor: DefaultProcessor{name: "middleware"},
+		handler:          mw(http.HandlerFunc(middlewareNext)),
+	}
+}
+
+// request context key of the next handler of AsMiddleware
+type middlewareNextKey struct{}
+
+// run the chain of p in front of the wrapped handler. the chain is
+// extended by the call of the handler, so p must not be used elsewhere
+func AsMiddleware(p NxProcessor) func(http.Handler) http.Handler {
+	en := &BaseEntry{
+		name: "middleware",
+		data: make(map[string]interface{}),
+	}
+	en.Use(p, MakeProcessor(func(ctx *NxContext) {
+		next, _ := ctx.req.Context().Value(middlewareNextKey{}).(http.Handler)
+		next.ServeHTTP(ctx.res, ctx.req)
+	}))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			en.Exec(w, r.WithContext(context.WithValue(r.Context(), middlewareNextKey{}, next)), nil)
+		})
+	}
+}
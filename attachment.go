@@ -0,0 +1,83 @@
+package nxhttp
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// send r for download as filename. content type is guessed from the
+// extension if empty. seekable readers get range request support
+func (self *NxContext) SendAttachment(r io.Reader, filename, contentType string) error {
+	return self.sendFile("attachment", r, filename, contentType)
+}
+
+// like SendAttachment, but for display in the browser
+func (self *NxContext) SendInlineFile(r io.Reader, filename, contentType string) error {
+	return self.sendFile("inline", r, filename, contentType)
+}
+
+func (self *NxContext) sendFile(disposition string, r io.Reader, filename, contentType string) error {
+	if len(contentType) == 0 {
+		contentType = mime.TypeByExtension(filepath.Ext(filename))
+	}
+	if len(contentType) == 0 {
+		contentType = "application/octet-stream"
+	}
+	h := self.res.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", contentDisposition(disposition, filename))
+	h.Set("X-Content-Type-Options", "nosniff")
+
+	if rs, ok := r.(io.ReadSeeker); ok && self.status == 0 {
+		http.ServeContent(self.res, self.req, "", time.Time{}, rs)
+		return nil
+	}
+	self.writeStatus()
+	_, err := io.Copy(self.res, r)
+	return err
+}
+
+// RFC 6266 header value, an ascii fallback plus the RFC 5987 utf-8 name
+func contentDisposition(disposition, filename string) string {
+	filename = filepath.Base(filename)
+
+	var fallback, ext strings.Builder
+	ascii := true
+	for _, c := range filename {
+		switch {
+		case c == '"' || c == '\\' || c < 0x20 || c == 0x7f:
+			fallback.WriteByte('_')
+		case c > 0x7e:
+			fallback.WriteByte('_')
+			ascii = false
+		default:
+			fallback.WriteRune(c)
+		}
+	}
+	if ascii {
+		return fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback.String())
+	}
+
+	for _, b := range []byte(filename) {
+		if isAttrChar(b) {
+			ext.WriteByte(b)
+		} else {
+			fmt.Fprintf(&ext, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback.String(), ext.String())
+}
+
+// attr-char of RFC 5987
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
@@ -0,0 +1,152 @@
+package nxhttp
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+/*
+ * circuit breaker
+ * opens after threshold consecutive failures and rejects calls for the
+ * cooldown period, then lets a single trial call through (half-open)
+ * which closes or re-opens it. share one breaker between processors to
+ * guard an upstream used by several routes
+ */
+type CircuitBreaker struct {
+	lock      sync.Mutex
+	state     int
+	failures  int
+	threshold int
+	cooldown  time.Duration
+	opened    time.Time
+	trial     bool // half-open trial call in flight
+}
+
+// returns false if the call must be rejected
+func (self *CircuitBreaker) Allow() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	switch self.state {
+	case BreakerOpen:
+		if time.Since(self.opened) < self.cooldown {
+			return false
+		}
+		self.state = BreakerHalfOpen
+		self.trial = true
+		return true
+	case BreakerHalfOpen:
+		if self.trial {
+			return false
+		}
+		self.trial = true
+		return true
+	}
+	return true
+}
+
+func (self *CircuitBreaker) Success() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.failures = 0
+	self.trial = false
+	self.state = BreakerClosed
+}
+
+func (self *CircuitBreaker) Failure() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.failures++
+	self.trial = false
+	if self.state == BreakerHalfOpen || self.failures >= self.threshold {
+		self.state = BreakerOpen
+		self.opened = time.Now()
+	}
+}
+
+func (self *CircuitBreaker) State() int {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.state
+}
+
+// time left before an open breaker lets a trial call through
+func (self *CircuitBreaker) RetryAfter() time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.state != BreakerOpen {
+		return 0
+	}
+	if d := self.cooldown - time.Since(self.opened); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+/*
+ * circuit breaker processor
+ * 5xx responses and panics of downstream processors count as failures
+ */
+type CircuitBreakerProcessor struct {
+	DefaultProcessor
+	breaker *CircuitBreaker
+}
+
+func (self *CircuitBreakerProcessor) Process(ctx *NxContext) {
+	if !self.breaker.Allow() {
+		secs := int(self.breaker.RetryAfter().Seconds()) + 1
+		ctx.res.Header().Set("Retry-After", strconv.Itoa(secs))
+		ctx.End(http.StatusServiceUnavailable)
+		ctx.res.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+
+	ok := false
+	defer func() {
+		if ok {
+			self.breaker.Success()
+		} else {
+			self.breaker.Failure()
+		}
+	}()
+
+	ctx.RunNext()
+	ok = ctx.ResponseStatus() < 500
+}
+
+func (self *CircuitBreakerProcessor) Breaker() *CircuitBreaker {
+	return self.breaker
+}
+
+// b may be shared with other processors, nil creates a breaker for this
+// processor only, opening after 5 failures for 30 seconds
+func NewCircuitBreakerProcessor(b *CircuitBreaker) *CircuitBreakerProcessor {
+	if b == nil {
+		b = NewCircuitBreaker(5, 30*time.Second)
+	}
+	return &CircuitBreakerProcessor{
+		DefaultProcessor: DefaultProcessor{name: "circuitbreaker"},
+		breaker:          b,
+	}
+}
@@ -0,0 +1,411 @@
+package nxhttp
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * buffered response, collects everything downstream processors write
+ * unless switched to pass through by ctx.Streaming
+ */
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+
+	lock      sync.Mutex
+	out       http.ResponseWriter // buffering for
+	direct    bool                // writing through to out
+	abandoned bool
+	detached  http.Header // handed out once abandoned
+}
+
+var errAbandoned = errors.New("response abandoned")
+
+func (self *bufferedResponse) Header() http.Header {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.abandoned {
+		// out and header belong to whoever abandoned it
+		if self.detached == nil {
+			self.detached = make(http.Header)
+		}
+		return self.detached
+	}
+	if self.direct {
+		return self.out.Header()
+	}
+	return self.header
+}
+
+func (self *bufferedResponse) WriteHeader(status int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.status == 0 {
+		self.status = status
+		if self.direct && !self.abandoned {
+			self.out.WriteHeader(status)
+		}
+	}
+}
+
+func (self *bufferedResponse) Write(b []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.abandoned {
+		return 0, errAbandoned
+	}
+	if self.status == 0 {
+		self.status = http.StatusOK
+		if self.direct {
+			self.out.WriteHeader(self.status)
+		}
+	}
+	if self.direct {
+		return self.out.Write(b)
+	}
+	return self.body.Write(b)
+}
+
+func (self *bufferedResponse) FlushError() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.direct && !self.abandoned {
+		return flushResponse(self.out)
+	}
+	return nil
+}
+
+// for http.ResponseController, e.g. read deadlines of the request
+func (self *bufferedResponse) Unwrap() http.ResponseWriter {
+	return self.out
+}
+
+// hijacking passes through first, nothing buffered is lost
+func (self *bufferedResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	self.passThrough()
+	return http.NewResponseController(self.out).Hijack()
+}
+
+// send what was buffered and write through from now on, outer buffers
+// are switched as well
+func (self *bufferedResponse) passThrough() {
+	if b, ok := self.out.(*bufferedResponse); ok {
+		b.passThrough()
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.direct || self.abandoned {
+		return
+	}
+	self.direct = true
+	h := self.out.Header()
+	for k, vs := range self.header {
+		h[k] = vs
+	}
+	if self.status != 0 {
+		self.out.WriteHeader(self.status)
+		self.out.Write(self.body.Bytes())
+		self.body.Reset()
+	}
+}
+
+// writes fail from now on, returns false if already passing through
+func (self *bufferedResponse) abandon() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.abandoned = true
+	return !self.direct
+}
+
+func (self *bufferedResponse) streamed() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.direct
+}
+
+func (self *bufferedResponse) Status() int {
+	if self.status == 0 {
+		return http.StatusOK
+	}
+	return self.status
+}
+
+// send collected response to w
+func (self *bufferedResponse) SendTo(w http.ResponseWriter) {
+	if self.streamed() {
+		return
+	}
+	h := w.Header()
+	for k, vs := range self.header {
+		h[k] = vs
+	}
+	w.WriteHeader(self.Status())
+	w.Write(self.body.Bytes())
+}
+
+func newBufferedResponse(out http.ResponseWriter) *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), out: out}
+}
+
+/*
+ * in-memory response cache
+ */
+type cachedResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time // zero for never
+}
+
+func newCachedResponse(r *bufferedResponse) *cachedResponse {
+	return &cachedResponse{
+		status: r.Status(),
+		header: r.header.Clone(),
+		body:   append([]byte(nil), r.body.Bytes()...),
+		stored: time.Now(),
+	}
+}
+
+func (self *cachedResponse) Age() time.Duration {
+	return time.Since(self.stored)
+}
+
+// write cached response to w, extra headers are set before WriteHeader
+func (self *cachedResponse) SendTo(w http.ResponseWriter, extra http.Header) {
+	h := w.Header()
+	for k, vs := range self.header {
+		h[k] = append([]string(nil), vs...)
+	}
+	for k, vs := range extra {
+		h[k] = vs
+	}
+	w.WriteHeader(self.status)
+	w.Write(self.body)
+}
+
+// expired if past its expiry, if it has one
+func (self *cachedResponse) expired(now time.Time) bool {
+	return !self.expires.IsZero() && !now.Before(self.expires)
+}
+
+/*
+ * lru cache of responses by key. expired responses are dropped when
+ * looked up, and swept on put at most once per responseCacheSweep
+ */
+type responseCache struct {
+	lock  sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // front is the most recently used
+	limit int
+	swept time.Time
+}
+
+type responseCacheItem struct {
+	key string
+	res *cachedResponse
+}
+
+const (
+	defaultCacheLimit  = 1024 // kept responses if no limit is given
+	responseCacheSweep = time.Minute
+)
+
+// unexpired response of key, nil if none
+func (self *responseCache) Get(key string) *cachedResponse {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	e, ok := self.items[key]
+	if !ok {
+		return nil
+	}
+	c := e.Value.(*responseCacheItem).res
+	if c.expired(time.Now()) {
+		self.remove(e)
+		return nil
+	}
+	self.lru.MoveToFront(e)
+	return c
+}
+
+func (self *responseCache) put(key string, c *cachedResponse) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if e, ok := self.items[key]; ok {
+		e.Value.(*responseCacheItem).res = c
+		self.lru.MoveToFront(e)
+		return
+	}
+	if now := time.Now(); now.Sub(self.swept) >= responseCacheSweep {
+		self.swept = now
+		for e := self.lru.Front(); e != nil; {
+			next := e.Next()
+			if e.Value.(*responseCacheItem).res.expired(now) {
+				self.remove(e)
+			}
+			e = next
+		}
+	}
+	if self.lru.Len() >= self.limit {
+		self.remove(self.lru.Back())
+	}
+	self.items[key] = self.lru.PushFront(&responseCacheItem{key: key, res: c})
+}
+
+func (self *responseCache) remove(e *list.Element) {
+	self.lru.Remove(e)
+	delete(self.items, e.Value.(*responseCacheItem).key)
+}
+
+// remove cached responses whose request uri, the key without the method,
+// has the given prefix, all if empty
+func (self *responseCache) PurgeURI(prefix string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for k, e := range self.items {
+		if _, uri, _ := strings.Cut(k, " "); strings.HasPrefix(uri, prefix) {
+			self.remove(e)
+		}
+	}
+}
+
+// limit is the maximum number of kept responses, defaultCacheLimit if <= 0
+func newResponseCache(limit int) *responseCache {
+	if limit <= 0 {
+		limit = defaultCacheLimit
+	}
+	return &responseCache{
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+		limit: limit,
+	}
+}
+
+func cacheKey(r *http.Request) string {
+	return r.Method + " " + r.URL.RequestURI()
+}
+
+// only successful responses are kept, 206 neither as the key ignores
+// Range. responses setting cookies are never kept, those to requests with
+// credentials only if public
+func isCacheable(r *http.Request, res *bufferedResponse) bool {
+	switch res.Status() {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent:
+	default:
+		return false
+	}
+	if len(res.header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if len(res.header.Get("Vary")) > 0 {
+		// kept by url only, other variants would get this one
+		return false
+	}
+	public := false
+	for _, d := range strings.Split(strings.ToLower(res.header.Get("Cache-Control")), ",") {
+		k, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch k {
+		case "no-store", "private":
+			return false
+		case "public":
+			public = true
+		}
+	}
+	if (len(r.Header.Get("Authorization")) > 0 || len(r.Header.Get("Cookie")) > 0) && !public {
+		return false
+	}
+	return true
+}
+
+/*
+ * stale-if-error processor
+ * keeps the last 200, 203 or 204 response per url and serves it, with a
+ * Warning header, when downstream processors fail with 5xx or panic.
+ * responses with Vary, Set-Cookie, no-store or private are not kept,
+ * neither are those to requests with Authorization or Cookie unless public
+ */
+type StaleIfErrorProcessor struct {
+	DefaultProcessor
+	maxStale time.Duration
+	cache    *responseCache
+}
+
+func (self *StaleIfErrorProcessor) Process(ctx *NxContext) {
+	r := ctx.Req()
+	if r.Method != "GET" && r.Method != "HEAD" {
+		ctx.RunNext()
+		return
+	}
+
+	key := cacheKey(r)
+	w := ctx.res
+	buf := newBufferedResponse(w)
+
+	ctx.res = buf
+	func() {
+		defer func() {
+			if cv := recover(); cv != nil {
+				if cv == http.ErrAbortHandler || buf.streamed() || self.stale(key) == nil {
+					ctx.res = w
+					panic(cv)
+				}
+				buf.status = http.StatusInternalServerError
+			}
+		}()
+		ctx.RunNext()
+	}()
+	ctx.res = w
+
+	if buf.streamed() {
+		return
+	}
+	if buf.Status() >= 500 {
+		if c := self.stale(key); c != nil {
+			c.SendTo(w, http.Header{
+				"Warning": []string{`111 - "Revalidation Failed"`},
+			})
+			return
+		}
+	} else if isCacheable(r, buf) {
+		c := newCachedResponse(buf)
+		if self.maxStale > 0 {
+			// too old to be served, swept from the cache
+			c.expires = c.stored.Add(self.maxStale)
+		}
+		self.cache.put(key, c)
+	}
+	buf.SendTo(w)
+}
+
+func (self *StaleIfErrorProcessor) stale(key string) *cachedResponse {
+	if c := self.cache.Get(key); c != nil && (self.maxStale <= 0 || c.Age() <= self.maxStale) {
+		return c
+	}
+	return nil
+}
+
+// drop kept responses whose "/path?query" has prefix, all of them if it
+// is empty
+func (self *StaleIfErrorProcessor) Purge(prefix string) {
+	self.cache.PurgeURI(prefix)
+}
+
+// maxStale limits how old a served stale response may be, 0 means no limit.
+// limit is the maximum number of kept responses, 1024 if <= 0
+func NewStaleIfErrorProcessor(maxStale time.Duration, limit int) *StaleIfErrorProcessor {
+	return &StaleIfErrorProcessor{
+		DefaultProcessor: DefaultProcessor{name: "staleiferror"},
+		maxStale:         maxStale,
+		cache:            newResponseCache(limit),
+	}
+}
@@ -1,218 +1,856 @@
 package nxhttp
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
 	"os/exec"
-	"reflect"
-	"regexp"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type CgiProcessor struct {
 	DefaultProcessor
-	bin  string
-	opts []string
-	envs []string
+	bin    string
+	opts   []string
+	envs   []string
+	interp map[string][]string // by extension, with the leading dot
+
+	slots   chan struct{} // running scripts, nil for no limit
+	queue   int32         // requests allowed to wait for a slot
+	waiting int32
+
+	clientRedirect bool          // local Location answered with 302 too
+	mode           CgiOutputMode // see SetOutputMode
+	nph            bool          // see SetNph
+
+	stderrOut  io.Writer // see SetStderr
+	stderrLock *sync.Mutex
+	stderrFunc CgiStderrFunc
+
+	cache   *cgiCache // see SetCache
+	sandbox cgiSandbox
 }
 
-func (self *CgiProcessor) Process(ctx *NxContext) {
+// gets the stderr of a script line by line
+type CgiStderrFunc func(ctx *NxContext, script string, line string)
+
+// stderr lines of a failed script shown in debug mode 500 responses
+var CgiStderrLines = 10
+
+// SERVER_SOFTWARE of cgi requests
+var CgiServerSoftware = "nxhttp"
+
+/*
+ * rfc 3875 meta-variables of a request for cgi, fastcgi and scgi, after
+ * base. script is SCRIPT_NAME, info the PATH_INFO after it. headers are
+ * passed as HTTP_*, but for those with variables of their own and Proxy.
+ * a map[string]string in the "cgi:env" data of ctx, e.g. REMOTE_USER
+ * set by auth middleware, goes last and replaces what is there
+ */
+func cgiEnv(ctx *NxContext, base []string, script, info string) []string {
 	r := ctx.Req()
-	w := ctx.Res()
+	env := append([]string(nil), base...)
+	env = append(env,
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE="+CgiServerSoftware,
+		"SERVER_PROTOCOL="+r.Proto,
+		"REQUEST_METHOD="+r.Method,
+		"REQUEST_URI="+r.URL.RequestURI(),
+		"QUERY_STRING="+r.URL.RawQuery,
+		"SCRIPT_NAME="+script,
+		"PATH_INFO="+info,
+	)
+	if id := ctx.RequestID(); len(id) > 0 {
+		env = append(env, "REQUEST_ID="+id)
+	}
 
-	// make env
-	env := self.envs[:]
-	env = append(env, "SERVER_PROTOCOL=HTTP/1.1")
-	env = append(env, "GATEWAY_INTERFACE=CGI/1.1")
-	env = append(env, fmt.Sprintf("PATH_INFO=%s", r.URL.Path))
-	env = append(env, fmt.Sprintf("REQUEST_METHOD=%s", r.Method))
-	env = append(env, fmt.Sprintf("QUERY_STRING=%s", r.URL.RawQuery))
-	env = append(env, fmt.Sprintf("CONTENT_LENGTH=%d", r.ContentLength))
-
-	hp := strings.Split(r.Host, ":")
-	env = append(env, fmt.Sprintf("SERVER_NAME=%s", hp[0]))
-	if len(hp) > 1 {
-		env = append(env, fmt.Sprintf("SERVER_PORT=%s", hp[1]))
-	} else {
-		env = append(env, fmt.Sprintf("SERVER_PORT=80"))
+	if r.ContentLength > 0 {
+		env = append(env, fmt.Sprintf("CONTENT_LENGTH=%d", r.ContentLength))
+	}
+	if ct := r.Header.Get("Content-Type"); len(ct) > 0 {
+		env = append(env, "CONTENT_TYPE="+ct)
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+		scheme, _, _ := strings.Cut(auth, " ")
+		env = append(env, "AUTH_TYPE="+scheme)
+	}
+
+	// the port is known for the peer only, not for a forwarded client
+	ip := ctx.ClientIP()
+	env = append(env, "REMOTE_ADDR="+ip)
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil && host == ip {
+		env = append(env, "REMOTE_PORT="+port)
+	}
+
+	// the port is the one the request came in on, not the one of Host
+	name, port := r.Host, ""
+	if h, p, err := net.SplitHostPort(r.Host); err == nil {
+		name, port = h, p
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, p, err := net.SplitHostPort(addr.String()); err == nil {
+			port = p
+		}
+	}
+	if len(port) == 0 {
+		port = "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	env = append(env, "SERVER_NAME="+name, "SERVER_PORT="+port)
+	if r.TLS != nil {
+		env = append(env, "HTTPS=on")
 	}
 
 	for k, vs := range r.Header {
-		for _, s := range vs {
-			name := strings.Replace(strings.ToUpper(k), "-", "_", -1)
-			env = append(env, fmt.Sprintf("%s=%s", name, s))
-			env = append(env, fmt.Sprintf("HTTP_%s=%s", name, s))
+		switch k {
+		case "Content-Type", "Content-Length", "Authorization", "Proxy":
+			continue
+		}
+		sep := ", "
+		if k == "Cookie" {
+			sep = "; "
 		}
+		name := strings.Replace(strings.ToUpper(k), "-", "_", -1)
+		env = append(env, "HTTP_"+name+"="+strings.Join(vs, sep))
 	}
 
-	// make cmd options
-	args := self.opts[:]
-	if oo := ctx.GetData("cgi:options"); oo != nil {
-		if ss, ok := reflect.ValueOf(oo).Interface().([]string); ok {
-			args = append(args, ss...)
+	if m, ok := ctx.GetData("cgi:env").(map[string]string); ok {
+		env = slices.DeleteFunc(env, func(kv string) bool {
+			k, _, _ := strings.Cut(kv, "=")
+			_, ok := m[k]
+			return ok
+		})
+		for k, v := range m {
+			env = append(env, k+"="+v)
 		}
 	}
+	return env
+}
+
+func (self *CgiProcessor) Process(ctx *NxContext) {
+	env := cgiEnv(ctx, self.envs, "", ctx.Req().URL.Path)
+
+	// make cmd options
+	args := append([]string(nil), self.opts...)
+	if ss, ok := GetDataAs[[]string](ctx, "cgi:options"); ok {
+		args = append(args, ss...)
+	}
 	for _, v := range ctx.UrlParams() {
 		args = append(args, v)
 	}
 
+	bin := self.bin
+	nph := self.nph || isNphScript(bin)
+	if cmd := self.interpreter(ctx, bin); cmd != nil {
+		if abs, err := filepath.Abs(bin); err == nil {
+			env = append(env, "SCRIPT_FILENAME="+abs)
+		}
+		args = append(append(append([]string(nil), cmd[1:]...), bin), args...)
+		bin = cmd[0]
+	}
+	self.serve(ctx, bin, args, env, nph)
+}
+
+// run scripts with ext, e.g. ".py", by cmd, e.g. "python3". the script
+// path follows the arguments of cmd. an empty cmd removes it
+func (self *CgiProcessor) SetInterpreter(ext string, cmd string) *CgiProcessor {
+	setInterpreter(&self.interp, ext, cmd)
+	return self
+}
+
+// interpreters for all cgi processors of the handler, those set on a
+// processor take precedence
+func (self *NxHandler) SetCgiInterpreter(ext string, cmd string) *NxHandler {
+	setInterpreter(&self.cgiInterp, ext, cmd)
+	return self
+}
+
+func setInterpreter(m *map[string][]string, ext string, cmd string) {
+	if *m == nil {
+		*m = make(map[string][]string)
+	}
+	if fields := strings.Fields(cmd); len(fields) > 0 {
+		(*m)[strings.ToLower(ext)] = fields
+	} else {
+		delete(*m, strings.ToLower(ext))
+	}
+}
+
+// the interpreter command of script, nil if it runs by itself
+func (self *CgiProcessor) interpreter(ctx *NxContext, script string) []string {
+	ext := strings.ToLower(filepath.Ext(script))
+	if len(ext) == 0 {
+		return nil
+	}
+	if cmd, ok := self.interp[ext]; ok {
+		return cmd
+	}
+	if h := ctx.handler(); h != nil {
+		return h.cgiInterp[ext]
+	}
+	return nil
+}
+
+// execute bin and send its output as the response, true if the chain
+// is to go on
+func (self *CgiProcessor) run(ctx *NxContext, bin string, args, env []string, nph bool) bool {
+	r := ctx.Req()
+
+	if !self.acquire(ctx) {
+		ctx.SetHeader("Retry-After", "1")
+		ctx.End(http.StatusServiceUnavailable)
+		return false
+	}
+	// released before local redirects are served, they may run scripts
+	// of this processor too
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			self.release()
+		}
+	}
+	defer release()
+
 	if ctx.IsDebug() {
-		fmt.Println("[CGI] ", self.bin, args)
+		fmt.Println("[CGI] ", bin, args)
+	}
+
+	var metrics *cgiMetrics
+	if h := ctx.handler(); h != nil && ctx.entry != nil {
+		metrics = h.metrics.cgi(ctx.entry.Name())
 	}
+	metrics.started()
+	start := time.Now()
 
-	var cmd *exec.Cmd
+	_, span := ctx.StartSpan("cgi "+bin, attribute.String("cgi.bin", bin))
+	defer span.End()
+
+	// the script and whatever it started die on timeout or when the
+	// client goes away
+	var cctx context.Context
+	var cancel context.CancelFunc
 	if self.GetTimeout() > 0 {
-		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(self.GetTimeout())*time.Millisecond)
-		defer cancel()
-		cmd = exec.CommandContext(ctx, self.bin, args...)
+		cctx, cancel = context.WithTimeout(r.Context(), time.Duration(self.GetTimeout())*time.Millisecond)
 	} else {
-		cmd = exec.Command(self.bin, args...)
+		cctx, cancel = context.WithCancel(r.Context())
+	}
+	defer cancel()
+	sbin, sargs := self.sandbox.command(bin, args)
+	cmd := exec.CommandContext(cctx, sbin, sargs...)
+	cmd.Env = self.sandbox.filter(env)
+	self.sandbox.apply(cmd)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
 	}
-	cmd.Env = env
+	cmd.WaitDelay = time.Second
 
 	stdin, erri := cmd.StdinPipe()
 	if erri != nil {
-		log.Print(erri)
+		ctx.Logger().Error("cgi stdin", "error", erri)
 		ctx.End(http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	stdout, erro := cmd.StdoutPipe()
 	if erro != nil {
-		log.Print(erro)
+		ctx.Logger().Error("cgi stdout", "error", erro)
 		ctx.End(http.StatusInternalServerError)
-		return
+		return false
 	}
 
-	stderr, erre := cmd.StderrPipe()
-	if erre != nil {
-		log.Print(erre)
-		ctx.End(http.StatusInternalServerError)
-		return
-	}
+	errs := &cgiStderr{proc: self, ctx: ctx, script: bin}
+	cmd.Stderr = errs
 
-	// stdin feeding routine
+	// the body goes to stdin as the script reads it. for Expect:
+	// 100-continue it is not asked for if the script answers first
+	answered := make(chan struct{})
+	aborted := make(chan error, 1)
+	fed := make(chan struct{})
+	quit := make(chan struct{})
 	go func() {
-		defer stdin.Close()
+		defer close(fed)
+		if r.Body == nil || r.Body == http.NoBody {
+			stdin.Close()
+			return
+		}
+		if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+			t := time.NewTimer(CgiContinueWait)
+			defer t.Stop()
+			select {
+			case <-answered:
+				stdin.Close()
+				return
+			case <-quit:
+				stdin.Close()
+				return
+			case <-t.C:
+			}
+		}
 
-		buf := make([]byte, 512)
-		for {
-			if n, e := r.Body.Read(buf); e != nil || buf == nil {
-				if n > 0 && buf != nil {
-					stdin.Write(buf[:n])
-				}
-				break
-			} else {
-				stdin.Write(buf[:n])
+		body := &readErr{r: r.Body}
+		if _, err := copyPooled(struct{ io.Writer }{stdin}, body); body.err != nil {
+			select {
+			case <-quit:
+				// unblocked by unfeed, the script is done
+			default:
+				// the client failed the upload. stdin is left open, the
+				// script must not take the partial body for all of it
+				aborted <- body.err
+				cancel()
 			}
+			return
+		} else if err != nil {
+			// the script quit reading, its answer tells the rest
+			ctx.Logger().Debug("cgi stdin", "bin", bin, "error", err)
 		}
+		stdin.Close()
 	}()
 
-	// stdout piping routine
-	go func(wr http.ResponseWriter) {
-		defer stdout.Close()
+	// the body must not be read once run returns, a feeder blocked on it
+	// is unblocked by a read deadline and waited for
+	rc := http.NewResponseController(ctx.Res())
+	unfeed := func() {
+		close(quit)
+		select {
+		case <-fed:
+			return
+		default:
+		}
+		rc.SetReadDeadline(time.Now())
+		r.Body.Close()
+		<-fed
+	}
 
-		buf := make([]byte, 512)
-		eoh, _ := regexp.Compile(`\r?\n\r?\n`)
+	if err := cmd.Start(); err != nil {
+		unfeed()
+		metrics.finished("error", time.Since(start), 0, false)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		ctx.Logger().Error("cgi exec", "bin", bin, "error", err)
+		ctx.End(http.StatusInternalServerError)
+		return false
+	}
 
-		isheader := true
-		status := 200
-		hdr := make([]byte, 0)
-		status_re := regexp.MustCompile(`^HTTP/.+(\d\d\d)`)
+	// the response is read to the end before the script is waited for
+	var out io.Reader = stdout
+	if self.sandbox.output > 0 {
+		out = &outputLimit{r: stdout, n: self.sandbox.output}
+	}
+	out = &firstRead{r: out, done: answered}
+	var werr error
+	if nph {
+		werr = writeNphResponse(ctx, out, fed)
+	} else {
+		werr = writeCgiResponse(ctx, out, !self.clientRedirect, self.mode)
+	}
+	var redirect *cgiRedirect
+	if errors.As(werr, &redirect) {
+		werr = nil
+	}
+	// a broken response is the error unless the timeout or the client
+	// came first
+	broken := werr != nil && cctx.Err() == nil
+	if werr != nil {
+		cancel()
+	}
+	err := cmd.Wait()
+	errs.flush()
+	unfeed()
 
-		for stop := false; !stop; {
-			n, e := stdout.Read(buf)
-			if e != nil {
-				stop = true
-			}
+	exit, took := "signal", time.Since(start)
+	if code := cmd.ProcessState.ExitCode(); code >= 0 {
+		exit = strconv.Itoa(code)
+	}
+	metrics.finished(exit, took, errs.size, errors.Is(cctx.Err(), context.DeadlineExceeded))
+	ctx.Logger().Info("cgi", "bin", bin, "exit", exit, "duration", took, "stderr", errs.size)
+	if broken && (err == nil || !errors.Is(werr, io.EOF) && !errors.Is(werr, io.ErrUnexpectedEOF)) {
+		// for a script dying before its headers, e.g. by a limit, the
+		// exit status says more than the missing output
+		err = werr
+	}
+	var bodyErr error
+	select {
+	case bodyErr = <-aborted:
+		err = bodyErr
+	default:
+	}
+	if err == nil && redirect != nil {
+		release()
+		err = cgiLocalRedirect(ctx, redirect.loc)
+	}
 
-			if n > 0 && !ctx.IsStopped() {
-				if isheader {
-					if idx := eoh.FindIndex(buf); idx != nil {
-						//parse header
-						hdr = append(hdr, buf[:idx[0]]...)
-						isheader = false
-
-						for _, s := range strings.Split(string(hdr), "\n") {
-							if s[len(s)-1] == '\r' {
-								s = s[:len(s)-1]
-							}
-
-							p := strings.SplitN(s, ":", 2)
-							if len(p) > 1 {
-								name := strings.Trim(p[0], " ")
-								val := strings.Trim(p[1], " ")
-								if strings.ToLower(name) == "status" {
-									if x, err := strconv.Atoi(val); err == nil {
-										status = x
-									}
-								} else {
-									wr.Header().Set(name, val)
-								}
-							} else {
-								// check http status, e.g.: HTTP/1.1 200 OK
-								if t := status_re.FindAllStringSubmatch(s, -1); len(t) > 0 {
-									x, _ := strconv.ParseInt(t[0][1], 10, 16)
-									status = int(x)
-								}
-							}
-						}
-
-						// send header and body
-						wr.WriteHeader(status)
-						if idx[1] < n-1 {
-							if _, e := wr.Write(buf[idx[1]:n]); e != nil {
-								log.Println(e)
-								stop = true
-							}
-						}
-					} else {
-						hdr = append(hdr, buf[:n]...)
-					}
-				} else {
-					// send body to client
-					if _, e := wr.Write(buf[:n]); e != nil {
-						log.Println(e)
-						stop = true
-					}
-				}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		status := http.StatusInternalServerError
+		var tooBig *http.MaxBytesError
+		switch {
+		case r.Context().Err() != nil:
+			ctx.Logger().Debug("cgi canceled", "bin", bin, "error", r.Context().Err())
+			status = 0
+		case bodyErr != nil:
+			ctx.Logger().Warn("cgi request body", "bin", bin, "error", bodyErr)
+			status = http.StatusBadRequest
+			if errors.As(bodyErr, &tooBig) {
+				status = http.StatusRequestEntityTooLarge
 			}
+		case errors.Is(cctx.Err(), context.DeadlineExceeded):
+			ctx.Logger().Error("cgi timeout", "bin", bin, "timeout", self.GetTimeout())
+			status = http.StatusGatewayTimeout
+		default:
+			ctx.Logger().Error("cgi exec", "bin", bin, "error", err)
+		}
+		if ctx.ResponseStatus() != 0 {
+			// too late to tell
+			status = 0
 		}
-	}(w)
+		if status == http.StatusInternalServerError && ctx.IsDebug() && len(errs.first) > 0 {
+			ctx.SetHeader("Content-Type", "text/plain; charset=utf-8")
+			ctx.SetStatus(status)
+			ctx.SendString(fmt.Sprintf("%s: %v\n\n%s\n", bin, err, strings.Join(errs.first, "\n")))
+			status = 0
+		}
+		ctx.End(status)
+		return false
+	}
+	return true
+}
 
-	// stderr piping routine
-	go func() {
-		defer stderr.Close()
-
-		buf := make([]byte, 512)
-		msg := ""
-		for {
-			n, e := stderr.Read(buf)
-			if e != nil {
-				if n > 0 {
-					msg += string(buf[:n])
-				}
-				break
-			} else {
-				msg += string(buf[:n])
-			}
+// splits the stderr of a script into lines for the processor, keeping
+// the first ones for debug responses
+type cgiStderr struct {
+	proc   *CgiProcessor
+	ctx    *NxContext
+	script string
+	buf    []byte
+	first  []string
+	size   int64
+}
+
+// longer lines are cut
+const cgiStderrMaxLine = 4096
+
+func (self *cgiStderr) Write(p []byte) (int, error) {
+	self.size += int64(len(p))
+	self.buf = append(self.buf, p...)
+	for {
+		i := bytes.IndexByte(self.buf, '\n')
+		if i < 0 && len(self.buf) < cgiStderrMaxLine {
+			break
+		}
+		if i < 0 || i > cgiStderrMaxLine {
+			i = cgiStderrMaxLine
+			self.line(self.buf[:i])
+			self.buf = self.buf[i:]
+			continue
 		}
+		self.line(self.buf[:i])
+		self.buf = self.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (self *cgiStderr) flush() {
+	if len(self.buf) > 0 {
+		self.line(self.buf)
+		self.buf = nil
+	}
+}
+
+func (self *cgiStderr) line(b []byte) {
+	line := strings.TrimSuffix(string(b), "\r")
+	if len(self.first) < CgiStderrLines {
+		self.first = append(self.first, line)
+	}
 
-		if len(msg) > 0 {
-			log.Println(msg)
+	p := self.proc
+	switch {
+	case p.stderrFunc != nil:
+		p.stderrFunc(self.ctx, self.script, line)
+	case p.stderrOut != nil:
+		prefix := self.script + ": "
+		if id := self.ctx.RequestID(); len(id) > 0 {
+			prefix = "[" + id + "] " + prefix
 		}
-	}()
+		p.stderrLock.Lock()
+		io.WriteString(p.stderrOut, prefix+line+"\n")
+		p.stderrLock.Unlock()
+	default:
+		self.ctx.Logger().Warn("cgi stderr", "bin", self.script, "line", line)
+	}
+}
 
-	if err := cmd.Run(); err != nil {
-		log.Print("cgi exec error: ", err)
-		ctx.End(http.StatusInternalServerError)
+// how long a script may take to answer a request with Expect:
+// 100-continue before its body is asked for
+var CgiContinueWait = 200 * time.Millisecond
+
+// reader keeping the error of r, to tell it from write errors of a copy
+type readErr struct {
+	r   io.Reader
+	err error
+}
+
+func (self *readErr) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	if err != nil && err != io.EOF {
+		self.err = err
+	}
+	return n, err
+}
+
+// reader closing done once the first read of r returns
+type firstRead struct {
+	r    io.Reader
+	done chan struct{}
+	once sync.Once
+}
+
+func (self *firstRead) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	self.once.Do(func() {
+		close(self.done)
+	})
+	return n, err
+}
+
+// run at most max scripts at once, with up to queue requests waiting
+// for one to finish. others get 503. max <= 0 removes the limit. to be
+// called before serving
+func (self *CgiProcessor) SetMaxConcurrency(max int, queue int) *CgiProcessor {
+	if max <= 0 {
+		self.slots = nil
 	} else {
-		ctx.RunNext()
+		self.slots = make(chan struct{}, max)
 	}
+	self.queue = int32(queue)
+	return self
+}
+
+// take a slot, false if the queue is full or the client gave up
+func (self *CgiProcessor) acquire(ctx *NxContext) bool {
+	if self.slots == nil {
+		return true
+	}
+	select {
+	case self.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	defer atomic.AddInt32(&self.waiting, -1)
+	if atomic.AddInt32(&self.waiting, 1) > self.queue {
+		return false
+	}
+	select {
+	case self.slots <- struct{}{}:
+		return true
+	case <-ctx.Req().Context().Done():
+		return false
+	}
+}
+
+func (self *CgiProcessor) release() {
+	if self.slots != nil {
+		<-self.slots
+	}
+}
+
+/*
+ * send a cgi response read from r, headers first, then the body. the
+ * status is taken from a Status header or a leading HTTP/1.x status
+ * line, it is 302 for a Location without it and 200 otherwise. headers
+ * may span reads and repeat, e.g. Set-Cookie. with local set, a local
+ * path in Location without status and body is returned as *cgiRedirect
+ * for the caller to serve once the script is done. mode
+ * tells how the body is sent, see CgiOutputMode
+ */
+func writeCgiResponse(ctx *NxContext, r io.Reader, local bool, mode CgiOutputMode) error {
+	br := getBufReader(r)
+	defer putBufReader(br)
+	tp := textproto.NewReader(br)
+
+	status := 0
+	if b, _ := br.Peek(5); string(b) == "HTTP/" {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return err
+		}
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			return fmt.Errorf("cgi status line %q", line)
+		}
+		if status, err = strconv.Atoi(f[1]); err != nil {
+			return fmt.Errorf("cgi status line %q", line)
+		}
+	}
+
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return err
+	}
+	if loc := hdr.Get("Location"); local && status == 0 && len(hdr.Get("Status")) == 0 &&
+		strings.HasPrefix(loc, "/") && !strings.HasPrefix(loc, "//") {
+		if _, err := br.Peek(1); err == io.EOF {
+			return &cgiRedirect{loc}
+		}
+	}
+
+	switch s := hdr.Get("Status"); {
+	case len(s) > 0:
+		code, _, _ := strings.Cut(s, " ")
+		if status, err = strconv.Atoi(code); err != nil {
+			return fmt.Errorf("cgi status %q", s)
+		}
+		hdr.Del("Status")
+	case status != 0:
+	case len(hdr.Get("Location")) > 0:
+		status = http.StatusFound
+	default:
+		status = http.StatusOK
+	}
+	if status < 100 || status > 999 {
+		// WriteHeader panics on them
+		return fmt.Errorf("cgi status %d", status)
+	}
+
+	var body []byte
+	switch mode {
+	case CgiOutputBuffered:
+		if body, err = io.ReadAll(br); err != nil {
+			return err
+		}
+		hdr.Set("Content-Length", strconv.Itoa(len(body)))
+	case CgiOutputStreaming:
+		ctx.Streaming()
+		if _, ok := hdr["Cache-Control"]; ok {
+			// the one of the script stands
+			ctx.Res().Header().Del("Cache-Control")
+		}
+		hdr.Del("Content-Length")
+	}
+
+	h := ctx.Res().Header()
+	for k, vs := range hdr {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+	ctx.Res().WriteHeader(status)
+
+	switch mode {
+	case CgiOutputBuffered:
+		_, err = ctx.Res().Write(body)
+	case CgiOutputStreaming:
+		err = streamCgiBody(ctx, br)
+	default:
+		_, err = copyPooled(ctx.Res(), br)
+	}
+	return err
+}
+
+// how the body of cgi responses is sent
+type CgiOutputMode int
+
+const (
+	// copied as read, chunked unless the script sets Content-Length
+	CgiOutputAuto CgiOutputMode = iota
+	// read to the end first to send it with Content-Length
+	CgiOutputBuffered
+	// chunked, flushed to the client whenever the script pauses
+	CgiOutputStreaming
+)
+
+// copy the body, flushing when no more output is at hand
+func streamCgiBody(ctx *NxContext, br *bufio.Reader) error {
+	w := ctx.Res()
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	for {
+		n, err := br.Read(*buf)
+		if n > 0 {
+			if _, werr := w.Write((*buf)[:n]); werr != nil {
+				return werr
+			}
+			if br.Buffered() == 0 {
+				if ferr := flushResponse(w); ferr != nil {
+					return ferr
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func isNphScript(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), "nph-")
+}
+
+/*
+ * pass the output of a nph script from r to the client over the hijacked
+ * connection, once the script took the request body. it has to start with
+ * a status line. where connections can not be hijacked, e.g. for http/2,
+ * the output is parsed as usual
+ */
+func writeNphResponse(ctx *NxContext, r io.Reader, fed <-chan struct{}) error {
+	br := getBufReader(r)
+	defer putBufReader(br)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	f := strings.Fields(line)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/") {
+		return fmt.Errorf("nph status line %q", line)
+	}
+	status, err := strconv.Atoi(f[1])
+	if err != nil {
+		return fmt.Errorf("nph status line %q", line)
+	}
+
+	select {
+	case <-fed:
+	case <-ctx.Done():
+		return ctx.req.Context().Err()
+	}
+	conn, _, err := ctx.Hijack()
+	if err != nil {
+		return writeCgiResponse(ctx, io.MultiReader(strings.NewReader(line), br), false, CgiOutputAuto)
+	}
+	defer conn.Close()
+	if w, ok := ctx.res.(*responseWriter); ok {
+		// for the access log and metrics
+		w.status = status
+	}
+
+	n, err := copyPooled(conn, io.MultiReader(strings.NewReader(line), br))
+	if w, ok := ctx.res.(*responseWriter); ok {
+		w.size += n
+	}
+	return err
+}
+
+// local redirects served one after another at most
+const CgiMaxLocalRedirects = 10
+
+type cgiRedirectKey struct{}
+
+// local redirect of a script, served by run once the script is done
+type cgiRedirect struct {
+	loc string
+}
+
+func (self *cgiRedirect) Error() string {
+	return "cgi local redirect to " + self.loc
+}
+
+// serve loc for a GET of the same client, as rfc 3875 wants for local
+// redirects
+func cgiLocalRedirect(ctx *NxContext, loc string) error {
+	r := ctx.Req()
+	depth, _ := r.Context().Value(cgiRedirectKey{}).(int)
+	if depth >= CgiMaxLocalRedirects {
+		return fmt.Errorf("cgi local redirect loop at %q", loc)
+	}
+	h := ctx.handler()
+	if h == nil {
+		return fmt.Errorf("cgi local redirect to %q outside of a handler", loc)
+	}
+	u, err := url.Parse(loc)
+	if err != nil {
+		return err
+	}
+
+	r2 := r.Clone(context.WithValue(r.Context(), cgiRedirectKey{}, depth+1))
+	r2.Method = "GET"
+	r2.URL.Path = u.Path
+	r2.URL.RawPath = u.RawPath
+	r2.URL.RawQuery = u.RawQuery
+	r2.RequestURI = loc
+	r2.Body = http.NoBody
+	r2.ContentLength = 0
+	r2.Header.Del("Content-Length")
+	r2.Header.Del("Content-Type")
+	h.ServeHTTP(ctx.Res(), r2)
+	return nil
+}
+
+// write the stderr of scripts to w, lines prefixed with the request id
+// and the script. by default they go to the request logger
+func (self *CgiProcessor) SetStderr(w io.Writer) *CgiProcessor {
+	self.stderrOut = w
+	self.stderrLock = &sync.Mutex{}
+	return self
+}
+
+// hand the stderr of scripts to f, before SetStderr
+func (self *CgiProcessor) SetStderrFunc(f CgiStderrFunc) *CgiProcessor {
+	self.stderrFunc = f
+	return self
+}
+
+// send the output of scripts as it comes, the default, buffered with
+// Content-Length or streamed with flushes
+func (self *CgiProcessor) SetOutputMode(mode CgiOutputMode) *CgiProcessor {
+	self.mode = mode
+	return self
+}
+
+// send the output of scripts to the client as it is, status line and
+// headers included. scripts named nph-* are always run so, as rfc 3875
+// wants
+func (self *CgiProcessor) SetNph(nph bool) *CgiProcessor {
+	self.nph = nph
+	return self
+}
+
+// serve local Location responses internally, the default, or answer
+// them with 302 like absolute ones
+func (self *CgiProcessor) SetLocalRedirect(internal bool) *CgiProcessor {
+	self.clientRedirect = !internal
+	return self
+}
+
+// interpreters set on the handler are not known here, their scripts
+// have to be executable to pass
+func (self *CgiProcessor) Validate() error {
+	if err := self.sandbox.validate(); err != nil {
+		return err
+	}
+	if cmd, ok := self.interp[strings.ToLower(filepath.Ext(self.bin))]; ok {
+		if _, err := exec.LookPath(cmd[0]); err != nil {
+			return err
+		}
+		_, err := os.Stat(self.bin)
+		return err
+	}
+	_, err := exec.LookPath(self.bin)
+	return err
 }
 
 func NewCgiProcessor(bin string, opts []string, envmap map[string]string) *CgiProcessor {
@@ -234,55 +872,130 @@ func NewCgiProcessor(bin string, opts []string, envmap map[string]string) *CgiPr
 	return p
 }
 
-func addcgi(dict map[string]Entry, pattern, bin string, args ...interface{}) Entry {
-	if _, ok := dict[pattern]; ok {
+// options of cgi routes, see NxHandler.Cgi
+type CgiOption func(*cgiRoute)
+
+type cgiRoute struct {
+	args   []string
+	env    map[string]string
+	before []NxProcessor
+}
+
+// arguments of bin, before those from cgi:options and the url
+func WithArgs(args ...string) CgiOption {
+	return func(r *cgiRoute) {
+		r.args = append(r.args, args...)
+	}
+}
+
+// variables added to the environment of bin
+func WithEnv(env map[string]string) CgiOption {
+	return func(r *cgiRoute) {
+		for k, v := range env {
+			r.env[k] = v
+		}
+	}
+}
+
+// processors run ahead of the cgi one, e.g. auth
+func WithBefore(ps ...NxProcessor) CgiOption {
+	return func(r *cgiRoute) {
+		r.before = append(r.before, ps...)
+	}
+}
+
+// run bin for method requests on pattern
+//
+//	h.Cgi("POST", "^/upload$", "./upload.cgi", WithArgs("-v"), WithBefore(auth))
+func (self *NxHandler) Cgi(method, pattern, bin string, opts ...CgiOption) Entry {
+	method = strings.ToUpper(method)
+	if !isRouteMethod(method) {
+		log.Panic(fmt.Sprintf("unsupported method %q", method))
+	}
+	if _, ok := self.table().entries[method][pattern]; ok {
 		log.Panic(fmt.Sprintf("pattern %q already exists", pattern))
 	}
+	return self.addEntry(method, self.newCgiEntry(pattern, bin, opts))
+}
+
+// run bin for requests on pattern whatever their method
+func (self *NxHandler) CgiAny(pattern, bin string, opts ...CgiOption) Entry {
+	t := self.table()
+	for _, m := range methods {
+		if _, ok := t.entries[m][pattern]; ok {
+			log.Panic(fmt.Sprintf("pattern %q already exists", pattern))
+		}
+	}
+	en := self.newCgiEntry(pattern, bin, opts)
+	for _, m := range methods {
+		self.addEntry(m, en)
+	}
+	return en
+}
+
+func (self *NxHandler) newCgiEntry(pattern, bin string, opts []CgiOption) Entry {
+	r := &cgiRoute{env: make(map[string]string)}
+	for _, o := range opts {
+		o(r)
+	}
+	return self.newEntry(pattern, append(r.before, NewCgiProcessor(bin, r.args, r.env))...)
+}
 
-	opts := make([]string, 0)
-	envs := make(map[string]string)
-	procs := make([]NxProcessor, 0)
+// the untyped form of DoCgiGet and co: []string for args, map[string]string
+// for env and then the processors, CgiOptions may be mixed in
+func cgiOptions(args []interface{}) []CgiOption {
+	opts := make([]CgiOption, 0, len(args))
 	wantproc := false
 
 	for _, i := range args {
-		switch i.(type) {
+		switch v := i.(type) {
 		case []string:
 			if wantproc {
-				log.Panicf("invalid cgi-processor argument %q. NxProcessor expexted", i)
+				log.Panic(fmt.Sprintf("invalid cgi-processor argument %q. NxProcessor expected", v))
 			}
-			opts = append(opts, i.([]string)...)
+			opts = append(opts, WithArgs(v...))
 		case map[string]string:
 			if wantproc {
-				log.Panicf("invalid cgi-processor argument %q. NxProcessor expexted", i)
-			}
-			for k, v := range i.(map[string]string) {
-				envs[k] = v
+				log.Panic(fmt.Sprintf("invalid cgi-processor argument %q. NxProcessor expected", v))
 			}
+			opts = append(opts, WithEnv(v))
 		case NxProcessor:
 			wantproc = true
-			procs = append(procs, i.(NxProcessor))
+			opts = append(opts, WithBefore(v))
+		case CgiOption:
+			opts = append(opts, v)
 		default:
-			log.Panicf("invalid argument ", i)
+			log.Panic(fmt.Sprintf("invalid cgi argument %v", i))
 		}
 	}
+	return opts
+}
 
-	a := NewRegexpEntry(pattern, append(procs, NewCgiProcessor(bin, opts, envs))...)
-	dict[pattern] = a
-	return a
+func (self *NxHandler) addcgi(method, pattern, bin string, args ...interface{}) Entry {
+	return self.Cgi(method, pattern, bin, cgiOptions(args)...)
 }
 
 func (self *NxHandler) DoCgiGet(pattern, bin string, args ...interface{}) Entry {
-	return addcgi(self.getmap, pattern, bin, args...)
+	return self.addcgi("GET", pattern, bin, args...)
 }
 
 func (self *NxHandler) DoCgiPost(pattern, bin string, args ...interface{}) Entry {
-	return addcgi(self.postmap, pattern, bin, args...)
+	return self.addcgi("POST", pattern, bin, args...)
 }
 
 func (self *NxHandler) DoCgiDelete(pattern, bin string, args ...interface{}) Entry {
-	return addcgi(self.delmap, pattern, bin, args...)
+	return self.addcgi("DELETE", pattern, bin, args...)
 }
 
 func (self *NxHandler) DoCgiPut(pattern, bin string, args ...interface{}) Entry {
-	return addcgi(self.putmap, pattern, bin, args...)
+	return self.addcgi("PUT", pattern, bin, args...)
+}
+
+func (self *NxHandler) DoCgiPatch(pattern, bin string, args ...interface{}) Entry {
+	return self.addcgi("PATCH", pattern, bin, args...)
+}
+
+// one entry for all the methods, the script tells them by REQUEST_METHOD
+func (self *NxHandler) DoCgiAny(pattern, bin string, args ...interface{}) Entry {
+	return self.CgiAny(pattern, bin, cgiOptions(args)...)
 }
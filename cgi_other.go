@@ -0,0 +1,23 @@
+//go:build windows || plan9
+
+package nxhttp
+
+import (
+	"os/exec"
+)
+
+// no process groups here, children of the script may outlive it
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// not supported, SetCredential panics
+func setCredential(cmd *exec.Cmd, uid, gid uint32) {}
+
+func limitCommand(bin string, args []string, cpu int, memory int64) (string, []string) {
+	return bin, args
+}
+
+const cgiSandboxSupported = false
@@ -0,0 +1,44 @@
+//go:build !windows && !plan9
+
+package nxhttp
+
+import (
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// run cmd in a process group of its own, so its children can be killed
+// with it
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func setCredential(cmd *exec.Cmd, uid, gid uint32) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+}
+
+// bin with args run by sh after setting the limits, cpu in seconds and
+// memory in bytes
+func limitCommand(bin string, args []string, cpu int, memory int64) (string, []string) {
+	script := ""
+	if cpu > 0 {
+		script += "ulimit -t " + strconv.Itoa(cpu) + " && "
+	}
+	if memory > 0 {
+		script += "ulimit -v " + strconv.FormatInt((memory+1023)/1024, 10) + " && "
+	}
+	return "/bin/sh", append([]string{"-c", script + `exec "$0" "$@"`, bin}, args...)
+}
+
+const cgiSandboxSupported = true
@@ -0,0 +1,120 @@
+package nxhttp
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * output cache of cgi scripts. GET and HEAD responses are kept by method,
+ * path and query for the ttl, or the max-age of their Cache-Control.
+ * no-store, no-cache and private responses are not kept, neither are
+ * those with Vary or Set-Cookie, or to requests with Authorization or
+ * Cookie unless public. a request with no-cache runs the script again
+ * and refreshes the entry
+ */
+type cgiCache struct {
+	ttl   time.Duration
+	cache *responseCache
+}
+
+func (self *cgiCache) lookup(r *http.Request) *cachedResponse {
+	if cc := strings.ToLower(r.Header.Get("Cache-Control")); strings.Contains(cc, "no-cache") || strings.Contains(cc, "max-age=0") {
+		return nil
+	}
+	return self.cache.Get(cacheKey(r))
+}
+
+// how long the response to r may be kept, 0 if not at all
+func (self *cgiCache) lifetime(r *http.Request, res *bufferedResponse) time.Duration {
+	if res.Status() < 200 || res.Status() >= 500 || len(res.header.Get("Vary")) > 0 {
+		return 0
+	}
+	if len(res.header.Values("Set-Cookie")) > 0 {
+		// the cookie of one client would be sent to all
+		return 0
+	}
+	ttl, public := self.ttl, false
+	for _, d := range strings.Split(strings.ToLower(res.header.Get("Cache-Control")), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch k {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "public":
+			public = true
+		case "max-age", "s-maxage":
+			if n, err := strconv.Atoi(strings.Trim(v, `"`)); err == nil {
+				ttl = time.Duration(n) * time.Second
+			}
+		}
+	}
+	if (len(r.Header.Get("Authorization")) > 0 || len(r.Header.Get("Cookie")) > 0) && !public {
+		return 0
+	}
+	return ttl
+}
+
+// run the script unless there is a fresh output of it
+func (self *CgiProcessor) serve(ctx *NxContext, bin string, args, env []string, nph bool) {
+	r := ctx.Req()
+	if self.cache == nil || nph || (r.Method != "GET" && r.Method != "HEAD") {
+		if self.run(ctx, bin, args, env, nph) {
+			ctx.RunNext()
+		}
+		return
+	}
+
+	if c := self.cache.lookup(r); c != nil {
+		ctx.Logger().Debug("cgi cached", "bin", bin)
+		c.SendTo(ctx.Res(), http.Header{
+			"Age": []string{strconv.Itoa(int(c.Age().Seconds()))},
+		})
+		ctx.RunNext()
+		return
+	}
+
+	// only the output of the script is kept, the chain goes on after it
+	// is sent
+	w := ctx.res
+	buf := newBufferedResponse(w)
+	ctx.res = buf
+	ok := func() bool {
+		defer func() {
+			ctx.res = w
+		}()
+		return self.run(ctx, bin, args, env, false)
+	}()
+
+	if !buf.streamed() {
+		if ttl := self.cache.lifetime(r, buf); ok && ttl > 0 {
+			c := newCachedResponse(buf)
+			c.expires = c.stored.Add(ttl)
+			self.cache.cache.put(cacheKey(r), c)
+		}
+		buf.SendTo(w)
+	}
+	if ok {
+		ctx.RunNext()
+	}
+}
+
+// keep the output of scripts for ttl, limit is the maximum number of kept
+// responses, 1024 if <= 0. a ttl of 0 turns caching off
+func (self *CgiProcessor) SetCache(ttl time.Duration, limit int) *CgiProcessor {
+	if ttl <= 0 {
+		self.cache = nil
+		return self
+	}
+	self.cache = &cgiCache{ttl: ttl, cache: newResponseCache(limit)}
+	return self
+}
+
+// drop kept outputs whose "/path?query" has prefix, all of them if it
+// is empty
+func (self *CgiProcessor) Purge(prefix string) {
+	if self.cache != nil {
+		self.cache.cache.PurgeURI(prefix)
+	}
+}
@@ -0,0 +1,205 @@
+package nxhttp
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+ * scripts under a document root, /prefix/a/b.cgi/more runs root/a/b.cgi
+ * with SCRIPT_NAME /prefix/a/b.cgi and PATH_INFO /more. files are run
+ * by the interpreter of their extension if there is one, else they must
+ * be executable
+ */
+type CgiDirProcessor struct {
+	CgiProcessor
+	prefix string // with the trailing slash
+	root   string
+}
+
+// the script for the request path p and the path info after it. fails
+// with os.ErrNotExist for paths outside of root
+func (self *CgiDirProcessor) lookup(p string) (script, name, info string, fi os.FileInfo, err error) {
+	return lookupScript(self.root, self.prefix, p)
+}
+
+// the first regular file on the path p under prefix, as a file under root,
+// the url path of it and the path info after it
+func lookupScript(docroot, prefix, p string) (script, name, info string, fi os.FileInfo, err error) {
+	rel := path.Clean("/" + strings.TrimPrefix(p, prefix))
+	segs := strings.Split(rel[1:], "/")
+
+	root, err := filepath.EvalSymlinks(docroot)
+	if err != nil {
+		return
+	}
+	script = root
+	for i, s := range segs {
+		if len(s) == 0 {
+			break
+		}
+		script = filepath.Join(script, s)
+		if fi, err = os.Stat(script); err != nil {
+			return
+		}
+		if fi.IsDir() {
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			break
+		}
+
+		// symlinks may point anywhere
+		real, e := filepath.EvalSymlinks(script)
+		if e != nil || !strings.HasPrefix(real, root+string(filepath.Separator)) {
+			break
+		}
+		name = prefix + strings.Join(segs[:i+1], "/")
+		if i+1 < len(segs) {
+			info = "/" + strings.Join(segs[i+1:], "/")
+		}
+		return
+	}
+	return "", "", "", nil, os.ErrNotExist
+}
+
+func (self *CgiDirProcessor) Process(ctx *NxContext) {
+	script, name, info, fi, err := self.lookup(ctx.Req().URL.Path)
+	if err != nil {
+		ctx.End(http.StatusNotFound)
+		return
+	}
+
+	bin, args := script, []string{}
+	if cmd := self.interpreter(ctx, script); cmd != nil {
+		bin = cmd[0]
+		args = append(append(args, cmd[1:]...), script)
+	} else if fi.Mode()&0111 == 0 {
+		ctx.End(http.StatusForbidden)
+		return
+	}
+
+	env := cgiEnv(ctx, self.envs, name, info)
+	env = append(env,
+		"SCRIPT_FILENAME="+script,
+		"DOCUMENT_ROOT="+self.root,
+	)
+	if len(info) > 0 {
+		env = append(env, "PATH_TRANSLATED="+filepath.Join(self.root, filepath.FromSlash(info)))
+	}
+	self.serve(ctx, bin, args, env, self.nph || isNphScript(script))
+}
+
+// see CgiProcessor.SetInterpreter, the handler's interpreters apply too
+func (self *CgiDirProcessor) SetInterpreter(ext string, cmd string) *CgiDirProcessor {
+	self.CgiProcessor.SetInterpreter(ext, cmd)
+	return self
+}
+
+// see CgiProcessor.SetMaxConcurrency, the limit is for all scripts
+func (self *CgiDirProcessor) SetMaxConcurrency(max int, queue int) *CgiDirProcessor {
+	self.CgiProcessor.SetMaxConcurrency(max, queue)
+	return self
+}
+
+// see CgiProcessor.SetStderr
+func (self *CgiDirProcessor) SetStderr(w io.Writer) *CgiDirProcessor {
+	self.CgiProcessor.SetStderr(w)
+	return self
+}
+
+// see CgiProcessor.SetStderrFunc
+func (self *CgiDirProcessor) SetStderrFunc(f CgiStderrFunc) *CgiDirProcessor {
+	self.CgiProcessor.SetStderrFunc(f)
+	return self
+}
+
+// see CgiProcessor.SetCache, the outputs of all scripts share limit
+func (self *CgiDirProcessor) SetCache(ttl time.Duration, limit int) *CgiDirProcessor {
+	self.CgiProcessor.SetCache(ttl, limit)
+	return self
+}
+
+// see CgiProcessor.SetDir
+func (self *CgiDirProcessor) SetDir(dir string) *CgiDirProcessor {
+	self.CgiProcessor.SetDir(dir)
+	return self
+}
+
+// see CgiProcessor.SetCredential
+func (self *CgiDirProcessor) SetCredential(uid, gid uint32) *CgiDirProcessor {
+	self.CgiProcessor.SetCredential(uid, gid)
+	return self
+}
+
+// see CgiProcessor.SetLimits
+func (self *CgiDirProcessor) SetLimits(cpu int, memory int64) *CgiDirProcessor {
+	self.CgiProcessor.SetLimits(cpu, memory)
+	return self
+}
+
+// see CgiProcessor.SetMaxOutput
+func (self *CgiDirProcessor) SetMaxOutput(n int64) *CgiDirProcessor {
+	self.CgiProcessor.SetMaxOutput(n)
+	return self
+}
+
+// see CgiProcessor.SetEnvAllow
+func (self *CgiDirProcessor) SetEnvAllow(names ...string) *CgiDirProcessor {
+	self.CgiProcessor.SetEnvAllow(names...)
+	return self
+}
+
+// see CgiProcessor.SetNph
+func (self *CgiDirProcessor) SetNph(nph bool) *CgiDirProcessor {
+	self.CgiProcessor.SetNph(nph)
+	return self
+}
+
+// see CgiProcessor.SetOutputMode
+func (self *CgiDirProcessor) SetOutputMode(mode CgiOutputMode) *CgiDirProcessor {
+	self.CgiProcessor.SetOutputMode(mode)
+	return self
+}
+
+func (self *CgiDirProcessor) Validate() error {
+	if err := self.sandbox.validate(); err != nil {
+		return err
+	}
+	fi, err := os.Stat(self.root)
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("%s is not a directory", self.root)
+	}
+	return err
+}
+
+func NewCgiDirProcessor(prefix, docroot string, envmap map[string]string) *CgiDirProcessor {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	p := &CgiDirProcessor{
+		CgiProcessor: *NewCgiProcessor("", nil, envmap),
+		prefix:       prefix,
+		root:         docroot,
+	}
+	p.name = "cgi-dir"
+	return p
+}
+
+// serve the scripts under docroot at prefix for any method, behind ps
+func (self *NxHandler) CgiDir(prefix, docroot string, ps ...NxProcessor) *CgiDirProcessor {
+	p := NewCgiDirProcessor(mountPath(prefix), docroot, nil)
+	en := &BaseEntry{
+		name: p.prefix,
+		data: make(map[string]interface{}),
+	}
+	en.Use(append(ps, p)...)
+	self.setMount(&mount{path: p.prefix, entry: en})
+	return p
+}
@@ -0,0 +1,124 @@
+package nxhttp
+
+import (
+	"errors"
+	"net/http"
+)
+
+// one of the scripts of a CgiNegotiator
+type CgiVariant struct {
+	Name string // value of the query parameter picking it, e.g. "json"
+	Type string // media type it answers with, e.g. "application/json"
+	Proc *CgiProcessor
+}
+
+// picks the index of the variant to run, -1 if none is acceptable
+type CgiSelector func(ctx *NxContext, variants []CgiVariant) int
+
+/*
+ * several cgi scripts on one pattern, the one to run is picked by the
+ * query parameter, "format" by default, else by Accept. the first one
+ * runs for requests without a preference, 406 is sent when none fits
+ *
+ *	h.DoGet("^/report$", auth, NewCgiNegotiator().
+ *		Add("html", "text/html", NewCgiProcessor("./report.cgi", nil, nil)).
+ *		Add("json", "application/json", NewCgiProcessor("./report-json.cgi", nil, nil)))
+ */
+type CgiNegotiator struct {
+	DefaultProcessor
+	variants []CgiVariant
+	param    string
+	selector CgiSelector
+}
+
+func (self *CgiNegotiator) Process(ctx *NxContext) {
+	if len(self.variants) == 0 {
+		ctx.End(http.StatusNotFound)
+		return
+	}
+	sel := self.selector
+	if sel == nil {
+		sel = self.selectDefault
+	}
+	i := sel(ctx, self.variants)
+	if i < 0 || i >= len(self.variants) {
+		ctx.End(http.StatusNotAcceptable)
+		return
+	}
+	ctx.Res().Header().Add("Vary", "Accept")
+	// runs the processors after this one when done
+	self.variants[i].Proc.Process(ctx)
+}
+
+func (self *CgiNegotiator) selectDefault(ctx *NxContext, variants []CgiVariant) int {
+	if name := ctx.Req().URL.Query().Get(self.param); len(self.param) > 0 && len(name) > 0 {
+		for i, v := range variants {
+			if v.Name == name {
+				return i
+			}
+		}
+		return -1
+	}
+
+	types := make([]string, len(variants))
+	for i, v := range variants {
+		types[i] = v.Type
+	}
+	if t := ctx.Accepts(types...); len(t) > 0 {
+		for i, v := range variants {
+			if v.Type == t {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// offer p as name for the query parameter and as mediaType for Accept
+func (self *CgiNegotiator) Add(name, mediaType string, p *CgiProcessor) *CgiNegotiator {
+	self.variants = append(self.variants, CgiVariant{Name: name, Type: mediaType, Proc: p})
+	return self
+}
+
+// the query parameter naming the variant, empty to go by Accept only
+func (self *CgiNegotiator) SetParam(name string) *CgiNegotiator {
+	self.param = name
+	return self
+}
+
+// replace the selection by parameter and Accept
+func (self *CgiNegotiator) SetSelector(f CgiSelector) *CgiNegotiator {
+	self.selector = f
+	return self
+}
+
+// the timeout applies to the scripts
+func (self *CgiNegotiator) SetTimeout(i int) NxProcessor {
+	for _, v := range self.variants {
+		v.Proc.SetTimeout(i)
+	}
+	self.DefaultProcessor.SetTimeout(i)
+	return self
+}
+
+func (self *CgiNegotiator) Validate() error {
+	var errs []error
+	for _, v := range self.variants {
+		errs = append(errs, v.Proc.Validate())
+	}
+	return errors.Join(errs...)
+}
+
+func (self *CgiNegotiator) Close() {
+	for _, v := range self.variants {
+		v.Proc.Close()
+	}
+	self.DefaultProcessor.Close()
+}
+
+func NewCgiNegotiator() *CgiNegotiator {
+	return &CgiNegotiator{
+		DefaultProcessor: DefaultProcessor{name: "cgi-negotiate"},
+		param:            "format",
+	}
+}
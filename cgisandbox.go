@@ -0,0 +1,156 @@
+package nxhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// the output of a script went over its limit, see SetMaxOutput
+var ErrCgiOutputTooLarge = errors.New("cgi output too large")
+
+/*
+ * restrictions of cgi children, for scripts that are not trusted. limits
+ * of cpu and memory are set with ulimit of /bin/sh before the script is
+ * exec'd, they and the credential are not supported on windows and plan9
+ */
+type cgiSandbox struct {
+	dir      string
+	cred     bool
+	uid, gid uint32
+	cpu      int   // seconds
+	memory   int64 // bytes of address space
+	output   int64 // bytes of stdout
+	allow    []string
+}
+
+// meta-variables of rfc 3875 and those set by the cgi processors, they
+// pass the allowlist
+var cgiMetaVariables = map[string]bool{
+	"AUTH_TYPE": true, "CONTENT_LENGTH": true, "CONTENT_TYPE": true,
+	"GATEWAY_INTERFACE": true, "PATH_INFO": true, "PATH_TRANSLATED": true,
+	"QUERY_STRING": true, "REMOTE_ADDR": true, "REMOTE_HOST": true,
+	"REMOTE_IDENT": true, "REMOTE_USER": true, "REQUEST_METHOD": true,
+	"SCRIPT_NAME": true, "SERVER_NAME": true, "SERVER_PORT": true,
+	"SERVER_PROTOCOL": true, "SERVER_SOFTWARE": true,
+	"REMOTE_PORT": true, "REQUEST_URI": true, "REQUEST_ID": true,
+	"HTTPS": true, "SCRIPT_FILENAME": true, "DOCUMENT_ROOT": true,
+}
+
+// env without the variables not allowed, none are dropped without an
+// allowlist
+func (self *cgiSandbox) filter(env []string) []string {
+	if self.allow == nil {
+		return env
+	}
+	out := env[:0:0]
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if cgiMetaVariables[k] || self.allowed(k) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+func (self *cgiSandbox) allowed(name string) bool {
+	for _, a := range self.allow {
+		if a == name || (strings.HasSuffix(a, "*") && strings.HasPrefix(name, a[:len(a)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// the command running bin with args under the limits
+func (self *cgiSandbox) command(bin string, args []string) (string, []string) {
+	if self.cpu <= 0 && self.memory <= 0 {
+		return bin, args
+	}
+	return limitCommand(bin, args, self.cpu, self.memory)
+}
+
+func (self *cgiSandbox) apply(cmd *exec.Cmd) {
+	cmd.Dir = self.dir
+	if self.cred {
+		setCredential(cmd, self.uid, self.gid)
+	}
+}
+
+func (self *cgiSandbox) validate() error {
+	if !cgiSandboxSupported && (self.cred || self.cpu > 0 || self.memory > 0) {
+		return errors.New("cgi credential and limits are not supported on this platform")
+	}
+	if len(self.dir) > 0 {
+		if fi, err := os.Stat(self.dir); err != nil {
+			return err
+		} else if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", self.dir)
+		}
+	}
+	return nil
+}
+
+// stdout of a script failing past n bytes
+type outputLimit struct {
+	r io.Reader
+	n int64
+}
+
+func (self *outputLimit) Read(p []byte) (int, error) {
+	if self.n <= 0 {
+		return 0, ErrCgiOutputTooLarge
+	}
+	if int64(len(p)) > self.n {
+		p = p[:self.n]
+	}
+	n, err := self.r.Read(p)
+	self.n -= int64(n)
+	return n, err
+}
+
+// run scripts in dir, the working directory of the server if empty
+func (self *CgiProcessor) SetDir(dir string) *CgiProcessor {
+	self.sandbox.dir = dir
+	return self
+}
+
+// run scripts as uid and gid, the server has to be allowed to switch.
+// panics where not supported, windows and plan9
+func (self *CgiProcessor) SetCredential(uid, gid uint32) *CgiProcessor {
+	if !cgiSandboxSupported {
+		log.Panic("cgi credential is not supported on this platform")
+	}
+	self.sandbox.cred = true
+	self.sandbox.uid = uid
+	self.sandbox.gid = gid
+	return self
+}
+
+// kill scripts using more than cpu seconds of cpu time or memory bytes of
+// address space, 0 for no limit. panics on limits where not supported
+func (self *CgiProcessor) SetLimits(cpu int, memory int64) *CgiProcessor {
+	if !cgiSandboxSupported && (cpu > 0 || memory > 0) {
+		log.Panic("cgi limits are not supported on this platform")
+	}
+	self.sandbox.cpu = cpu
+	self.sandbox.memory = memory
+	return self
+}
+
+// kill scripts writing more than n bytes of output, 0 for no limit
+func (self *CgiProcessor) SetMaxOutput(n int64) *CgiProcessor {
+	self.sandbox.output = n
+	return self
+}
+
+// pass scripts only the environment variables named, a trailing * matches
+// any suffix, e.g. "HTTP_*". the meta-variables of cgi always pass
+func (self *CgiProcessor) SetEnvAllow(names ...string) *CgiProcessor {
+	self.sandbox.allow = append([]string{}, names...)
+	return self
+}
@@ -0,0 +1,129 @@
+package nxhttp
+
+import (
+	"net"
+	"strings"
+)
+
+// forwarding headers are honored only when the immediate peer is in one of
+// the given networks, plain addresses are accepted as single hosts
+func (self *NxHandler) SetTrustedProxies(cidrs ...string) error {
+	nets, err := parseNetworks(cidrs)
+	if err != nil {
+		return err
+	}
+	self.update(func(t *routeTable) {
+		t.proxies = nets
+	})
+	return nil
+}
+
+// cidrs or plain addresses as single hosts
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil {
+				if ip.To4() != nil {
+					c += "/32"
+				} else {
+					c += "/128"
+				}
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (self *NxHandler) isTrustedProxy(ip net.IP) bool {
+	if self == nil || ip == nil {
+		return false
+	}
+	for _, n := range self.table().proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// address of the caller. Forwarded, X-Forwarded-For and X-Real-IP are
+// consulted, in that order, only if the peer is a trusted proxy
+func (self *NxContext) ClientIP() string {
+	peer := self.req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+
+	h := self.handler()
+	if !h.isTrustedProxy(net.ParseIP(peer)) {
+		return peer
+	}
+
+	if hops := forwardedFor(self.req.Header.Values("Forwarded")); len(hops) > 0 {
+		return h.pickClient(hops)
+	}
+	if hops := splitList(self.req.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		return h.pickClient(hops)
+	}
+	if ip := strings.TrimSpace(self.req.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return peer
+}
+
+// walk hops from the nearest one, the first untrusted address is the client
+func (self *NxHandler) pickClient(hops []string) string {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// unknown or obfuscated identifier, can't go further
+			return hops[i]
+		}
+		if !self.isTrustedProxy(ip) {
+			return hops[i]
+		}
+	}
+	return hops[0]
+}
+
+func splitList(values []string) []string {
+	r := make([]string, 0)
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				r = append(r, s)
+			}
+		}
+	}
+	return r
+}
+
+// for= addresses of RFC 7239 Forwarded headers
+func forwardedFor(values []string) []string {
+	r := make([]string, 0)
+	for _, elem := range splitList(values) {
+		for _, pair := range strings.Split(elem, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 || strings.ToLower(kv[0]) != "for" {
+				continue
+			}
+			v := strings.Trim(kv[1], `"`)
+			if strings.HasPrefix(v, "[") {
+				// [v6]:port
+				if i := strings.Index(v, "]"); i > 0 {
+					v = v[1:i]
+				}
+			} else if host, _, err := net.SplitHostPort(v); err == nil {
+				v = host
+			}
+			r = append(r, v)
+		}
+	}
+	return r
+}
@@ -0,0 +1,155 @@
+package nxhttp
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// body codec for a content type
+type Codec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	codecs     = make(map[string]Codec)
+	codecsLock sync.RWMutex
+)
+
+// register c for media type, e.g. "application/msgpack"
+func RegisterCodec(mediaType string, c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if _, ok := codecs[mediaType]; ok {
+		log.Panic(fmt.Sprintf("codec %q already exists", mediaType))
+	}
+	codecs[mediaType] = c
+}
+
+// codec for a content type header value, nil if none
+func CodecFor(contentType string) Codec {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	return codecs[mt]
+}
+
+/* codec funcs */
+type codecFuncs struct {
+	enc func(w io.Writer, v interface{}) error
+	dec func(r io.Reader, v interface{}) error
+}
+
+func (self codecFuncs) Encode(w io.Writer, v interface{}) error {
+	return self.enc(w, v)
+}
+
+func (self codecFuncs) Decode(r io.Reader, v interface{}) error {
+	return self.dec(r, v)
+}
+
+var (
+	msgpackCodec = codecFuncs{
+		enc: func(w io.Writer, v interface{}) error {
+			enc := msgpack.NewEncoder(w)
+			enc.SetCustomStructTag("json")
+			return enc.Encode(v)
+		},
+		dec: func(r io.Reader, v interface{}) error {
+			dec := msgpack.NewDecoder(r)
+			dec.SetCustomStructTag("json")
+			return dec.Decode(v)
+		},
+	}
+	cborCodec = codecFuncs{
+		enc: func(w io.Writer, v interface{}) error {
+			return cbor.NewEncoder(w).Encode(v)
+		},
+		dec: func(r io.Reader, v interface{}) error {
+			return cbor.NewDecoder(r).Decode(v)
+		},
+	}
+)
+
+/* json through the handler's json codec and options */
+type ctxJsonCodec struct {
+	ctx *NxContext
+}
+
+func (self ctxJsonCodec) Encode(w io.Writer, v interface{}) error {
+	codec, opts := self.ctx.jsonCodec()
+	return codec.Encode(w, v, &opts)
+}
+
+func (self ctxJsonCodec) Decode(r io.Reader, v interface{}) error {
+	codec, _ := self.ctx.jsonCodec()
+	return codec.Decode(r, v)
+}
+
+func (self *NxContext) codecFor(contentType string) Codec {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	if mt == "application/json" {
+		return ctxJsonCodec{self}
+	}
+	return CodecFor(contentType)
+}
+
+// send v encoded for contentType
+func (self *NxContext) SendAs(contentType string, v interface{}) *NxContext {
+	c := self.codecFor(contentType)
+	if c == nil {
+		panic(fmt.Errorf("no codec for %q", contentType))
+	}
+	self.res.Header().Set("Content-Type", contentType)
+	self.writeStatus()
+	if err := c.Encode(self.res, v); err != nil {
+		panic(err)
+	}
+	return self
+}
+
+// decode request body into v by its Content-Type, json if not given.
+// a body over the size limit is answered with 413, see BindJson
+func (self *NxContext) Bind(v interface{}) error {
+	ct := self.req.Header.Get("Content-Type")
+	if len(ct) == 0 {
+		ct = "application/json"
+	}
+	c := self.codecFor(ct)
+	if c == nil {
+		return fmt.Errorf("unsupported content type %q", ct)
+	}
+	return self.bodyError(c.Decode(self.req.Body, v))
+}
+
+func (self *NxContext) SendAsMsgpack(v interface{}) *NxContext {
+	return self.SendAs("application/msgpack", v)
+}
+
+func (self *NxContext) BindMsgpack(v interface{}) error {
+	return self.bodyError(msgpackCodec.Decode(self.req.Body, v))
+}
+
+func (self *NxContext) SendAsCbor(v interface{}) *NxContext {
+	return self.SendAs("application/cbor", v)
+}
+
+func (self *NxContext) BindCbor(v interface{}) error {
+	return self.bodyError(cborCodec.Decode(self.req.Body, v))
+}
+
+func init() {
+	RegisterCodec("application/msgpack", msgpackCodec)
+	RegisterCodec("application/x-msgpack", msgpackCodec)
+	RegisterCodec("application/vnd.msgpack", msgpackCodec)
+	RegisterCodec("application/cbor", cborCodec)
+}
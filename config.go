@@ -0,0 +1,456 @@
+package nxhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+ * declarative route configuration
+ */
+type RouteConfig struct {
+	Timeout        int         `json:"timeout" yaml:"timeout"` // ms, for routes without their own
+	MaxBodySize    int64       `json:"max_body_size" yaml:"max_body_size"`
+	TrustedProxies []string    `json:"trusted_proxies" yaml:"trusted_proxies"`
+	Slash          string      `json:"slash" yaml:"slash"` // strict, redirect, redirect308 or rewrite
+	StrictMatch    bool        `json:"strict_match" yaml:"strict_match"`
+	Routes         []RouteSpec `json:"routes" yaml:"routes"`
+	Mounts         []MountSpec `json:"mounts" yaml:"mounts"`
+}
+
+type RouteSpec struct {
+	Method      string          `json:"method" yaml:"method"`
+	Pattern     string          `json:"pattern" yaml:"pattern"`
+	Processors  []ProcessorSpec `json:"processors" yaml:"processors"`
+	Cgi         *CgiSpec        `json:"cgi" yaml:"cgi"`
+	Timeout     int             `json:"timeout" yaml:"timeout"`
+	MaxBodySize int64           `json:"max_body_size" yaml:"max_body_size"`
+	Debug       bool            `json:"debug" yaml:"debug"`
+}
+
+type CgiSpec struct {
+	Bin  string            `json:"bin" yaml:"bin"`
+	Args []string          `json:"args" yaml:"args"`
+	Env  map[string]string `json:"env" yaml:"env"`
+}
+
+// mounted file server directory or proxied upstream
+type MountSpec struct {
+	Path      string `json:"path" yaml:"path"`
+	Dir       string `json:"dir" yaml:"dir"`
+	AutoIndex bool   `json:"autoindex" yaml:"autoindex"` // list dirs without index.html
+	Proxy     string `json:"proxy" yaml:"proxy"`
+}
+
+// a processor by registered name, either "name" or {name:, options:}
+type ProcessorSpec struct {
+	Name    string                 `json:"name" yaml:"name"`
+	Options map[string]interface{} `json:"options" yaml:"options"`
+}
+
+func (self *ProcessorSpec) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &self.Name); err == nil {
+		return nil
+	}
+	type plain ProcessorSpec
+	return json.Unmarshal(b, (*plain)(self))
+}
+
+func (self *ProcessorSpec) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&self.Name)
+	}
+	type plain ProcessorSpec
+	return node.Decode((*plain)(self))
+}
+
+func ParseRouteConfig(data []byte, format string) (*RouteConfig, error) {
+	conf := &RouteConfig{}
+	switch strings.ToLower(format) {
+	case "json":
+		if err := json.Unmarshal(data, conf); err != nil {
+			return nil, err
+		}
+	case "yaml", "yml":
+		if err := yaml.Unmarshal(data, conf); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+	return conf, nil
+}
+
+// format is taken from the file extension
+func LoadRouteConfig(path string) (*RouteConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRouteConfig(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// like LoadRouteConfig, reading path from fsys, e.g. an embed.FS
+func LoadRouteConfigFS(fsys fs.FS, path string) (*RouteConfig, error) {
+	data, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRouteConfig(data, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+func NewNxHandlerFromConfig(path string) (*NxHandler, error) {
+	conf, err := LoadRouteConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	h := NewNxHandler()
+	if err := h.ApplyConfig(conf); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// the config and the dirs of its mounts are read from fsys
+func NewNxHandlerFromConfigFS(fsys fs.FS, path string) (*NxHandler, error) {
+	conf, err := LoadRouteConfigFS(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	h := NewNxHandler()
+	if err := h.ApplyConfigFS(conf, fsys); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// register configured routes and mounts. nothing is registered if any
+// route is invalid or already exists
+func (self *NxHandler) ApplyConfig(conf *RouteConfig) error {
+	return self.applyConfig(conf, nil)
+}
+
+// like ApplyConfig, the dirs of mounts are served from fsys
+func (self *NxHandler) ApplyConfigFS(conf *RouteConfig, fsys fs.FS) error {
+	return self.applyConfig(conf, fsys)
+}
+
+func (self *NxHandler) applyConfig(conf *RouteConfig, fsys fs.FS) (err error) {
+	type route struct {
+		method string
+		spec   *RouteSpec
+		ps     []NxProcessor
+	}
+
+	tables := self.methodmaps()
+	routes := make([]route, 0, len(conf.Routes))
+	var ps []NxProcessor
+	defer func() {
+		// processors of rejected routes may hold files
+		if err != nil {
+			for _, r := range routes {
+				closeProcs(r.ps)
+			}
+			closeProcs(ps)
+		}
+	}()
+
+	strict := self.table().strict || conf.StrictMatch
+	seen := make(map[string]bool)
+	for i := range conf.Routes {
+		spec := &conf.Routes[i]
+		method := strings.ToUpper(spec.Method)
+		if !isRouteMethod(method) {
+			return fmt.Errorf("route %q: unsupported method %q", spec.Pattern, spec.Method)
+		}
+		if _, ok := tables[method][spec.Pattern]; ok || seen[method+" "+spec.Pattern] {
+			return fmt.Errorf("route %q: pattern already exists", spec.Pattern)
+		}
+		seen[method+" "+spec.Pattern] = true
+		if _, err := regexp.Compile(spec.Pattern); err != nil {
+			return fmt.Errorf("route %q: %v", spec.Pattern, err)
+		}
+		if strict {
+			if _, err := regexp.Compile("^(?:" + spec.Pattern + ")$"); err != nil {
+				return fmt.Errorf("route %q: %v", spec.Pattern, err)
+			}
+		}
+
+		ps = make([]NxProcessor, 0)
+		for _, p := range spec.Processors {
+			proc, err := MakeProcessorByName(p.Name, p.Options)
+			if err != nil {
+				return fmt.Errorf("route %q: %v", spec.Pattern, err)
+			}
+			ps = append(ps, proc)
+		}
+		if spec.Cgi != nil {
+			ps = append(ps, NewCgiProcessor(spec.Cgi.Bin, spec.Cgi.Args, spec.Cgi.Env))
+		}
+		if len(ps) == 0 {
+			return fmt.Errorf("route %q: no processor", spec.Pattern)
+		}
+		routes = append(routes, route{method, spec, ps})
+		ps = nil
+	}
+
+	dirs := make(map[string]fs.FS)
+	for _, m := range conf.Mounts {
+		if len(m.Path) == 0 || m.Path == "/" {
+			return fmt.Errorf("invalid mount path %q", m.Path)
+		}
+		if len(m.Dir) == 0 && len(m.Proxy) == 0 {
+			return fmt.Errorf("mount %q: dir or proxy expected", m.Path)
+		}
+		if len(m.Dir) == 0 {
+			if u, err := url.Parse(m.Proxy); err != nil {
+				return fmt.Errorf("mount %q: %v", m.Path, err)
+			} else if len(u.Scheme) == 0 || len(u.Host) == 0 {
+				return fmt.Errorf("mount %q: invalid proxy %q", m.Path, m.Proxy)
+			}
+		}
+		if len(m.Dir) > 0 && fsys != nil {
+			sub, err := fs.Sub(fsys, m.Dir)
+			if err != nil {
+				return fmt.Errorf("mount %q: %v", m.Path, err)
+			}
+			dirs[m.Path] = sub
+		}
+	}
+
+	slash, ok := slashPolicies[conf.Slash]
+	if !ok {
+		return fmt.Errorf("unknown slash policy %q", conf.Slash)
+	}
+
+	if len(conf.TrustedProxies) > 0 {
+		if err := self.SetTrustedProxies(conf.TrustedProxies...); err != nil {
+			return err
+		}
+	}
+	if conf.StrictMatch {
+		self.SetStrictMatch(true)
+	}
+	if len(conf.Slash) > 0 {
+		self.SetSlashPolicy(slash)
+	}
+	if conf.MaxBodySize != 0 {
+		self.SetMaxBodySize(conf.MaxBodySize)
+	}
+
+	for _, r := range routes {
+		en := self.addproc(r.method, r.spec.Pattern, r.ps)
+		if r.spec.Timeout > 0 {
+			en.SetTimeout(r.spec.Timeout)
+		} else {
+			// top level timeout is the default of routes
+			en.SetTimeout(conf.Timeout)
+		}
+		en.SetMaxBodySize(r.spec.MaxBodySize)
+		en.SetDebug(r.spec.Debug)
+	}
+	for _, m := range conf.Mounts {
+		if len(m.Dir) > 0 && m.AutoIndex {
+			sub, ok := dirs[m.Path]
+			if !ok {
+				sub = os.DirFS(m.Dir)
+			}
+			self.Mount(m.Path, NewFileServer(sub).SetAutoIndex(true))
+		} else if sub, ok := dirs[m.Path]; ok {
+			self.MountFS(m.Path, sub)
+		} else if len(m.Dir) > 0 {
+			self.Mount(m.Path, http.FileServer(http.Dir(m.Dir)))
+		} else {
+			self.Mount(m.Path, NewProxyProcessor(m.Proxy, nil))
+		}
+	}
+	return nil
+}
+
+var slashPolicies = map[string]int{
+	"":            SlashStrict,
+	"strict":      SlashStrict,
+	"redirect":    SlashRedirect301,
+	"redirect308": SlashRedirect308,
+	"rewrite":     SlashRewrite,
+}
+
+func closeProcs(ps []NxProcessor) {
+	for _, p := range ps {
+		p.Close()
+	}
+}
+
+func isRouteMethod(method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * processor factory registry
+ */
+type ProcessorFactory func(opts map[string]interface{}) (NxProcessor, error)
+
+var (
+	factories     = make(map[string]ProcessorFactory)
+	factoriesLock sync.RWMutex
+)
+
+func RegisterProcessorFactory(name string, f ProcessorFactory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if _, ok := factories[name]; ok {
+		log.Panic(fmt.Sprintf("processor factory %q already exists", name))
+	}
+	factories[name] = f
+}
+
+func MakeProcessorByName(name string, opts map[string]interface{}) (NxProcessor, error) {
+	factoriesLock.RLock()
+	f, ok := factories[name]
+	factoriesLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown processor %q", name)
+	}
+	if opts == nil {
+		opts = make(map[string]interface{})
+	}
+	return f(opts)
+}
+
+func optString(opts map[string]interface{}, key, def string) string {
+	if s, ok := opts[key].(string); ok {
+		return s
+	}
+	return def
+}
+
+func optInt(opts map[string]interface{}, key string, def int) int {
+	switch v := opts[key].(type) {
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return def
+}
+
+// list option, a single string is taken as one element list
+func optStrings(opts map[string]interface{}, key string, def []string) []string {
+	switch v := opts[key].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		ss := make([]string, 0, len(v))
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	}
+	return def
+}
+
+func optBool(opts map[string]interface{}, key string, def bool) bool {
+	if b, ok := opts[key].(bool); ok {
+		return b
+	}
+	return def
+}
+
+func init() {
+	RegisterProcessorFactory("logging", func(opts map[string]interface{}) (NxProcessor, error) {
+		return NewLoggingProc(), nil
+	})
+	RegisterProcessorFactory("nocache", func(opts map[string]interface{}) (NxProcessor, error) {
+		return NoCacheProc(), nil
+	})
+	RegisterProcessorFactory("accesslog", func(opts map[string]interface{}) (NxProcessor, error) {
+		format := CombinedLogFormat
+		if optString(opts, "format", "combined") == "json" {
+			format = JsonLogFormat
+		}
+		if path := optString(opts, "file", ""); len(path) > 0 {
+			f, err := NewRotatingFile(path, int64(optInt(opts, "max_size", 0)), optInt(opts, "backups", 0))
+			if err != nil {
+				return nil, err
+			}
+			return NewAccessLogProcessor(f, format), nil
+		}
+		return NewAccessLogProcessor(nil, format), nil
+	})
+	RegisterProcessorFactory("requestid", func(opts map[string]interface{}) (NxProcessor, error) {
+		return NewRequestIdProcessor(optString(opts, "header", "")), nil
+	})
+	RegisterProcessorFactory("secureheaders", func(opts map[string]interface{}) (NxProcessor, error) {
+		conf := DefaultSecureHeadersConfig()
+		conf.HSTSMaxAge = optInt(opts, "hsts_max_age", conf.HSTSMaxAge)
+		conf.HSTSIncludeSubdomains = optBool(opts, "hsts_include_subdomains", conf.HSTSIncludeSubdomains)
+		conf.HSTSPreload = optBool(opts, "hsts_preload", conf.HSTSPreload)
+		conf.NoSniff = optBool(opts, "nosniff", conf.NoSniff)
+		conf.FrameOptions = optString(opts, "frame_options", conf.FrameOptions)
+		conf.ReferrerPolicy = optString(opts, "referrer_policy", conf.ReferrerPolicy)
+		conf.ContentSecurityPolicy = optString(opts, "csp", conf.ContentSecurityPolicy)
+		return NewSecureHeadersProcessor(conf), nil
+	})
+	RegisterProcessorFactory("cors", func(opts map[string]interface{}) (NxProcessor, error) {
+		conf := DefaultCorsConfig()
+		conf.AllowOrigins = optStrings(opts, "origins", conf.AllowOrigins)
+		conf.AllowMethods = optStrings(opts, "methods", conf.AllowMethods)
+		conf.AllowHeaders = optStrings(opts, "headers", conf.AllowHeaders)
+		conf.ExposeHeaders = optStrings(opts, "expose_headers", conf.ExposeHeaders)
+		conf.AllowCredentials = optBool(opts, "credentials", conf.AllowCredentials)
+		conf.MaxAge = optInt(opts, "max_age", conf.MaxAge)
+		if err := conf.validate(); err != nil {
+			return nil, err
+		}
+		return NewCorsProcessor(conf), nil
+	})
+	RegisterProcessorFactory("slowrequest", func(opts map[string]interface{}) (NxProcessor, error) {
+		threshold := time.Duration(optInt(opts, "threshold_ms", 1000)) * time.Millisecond
+		return NewSlowRequestProcessor(threshold, nil), nil
+	})
+	RegisterProcessorFactory("timeout", func(opts map[string]interface{}) (NxProcessor, error) {
+		return NewTimeoutProcessor(optInt(opts, "ms", 0), optInt(opts, "status", 0)), nil
+	})
+	RegisterProcessorFactory("staleiferror", func(opts map[string]interface{}) (NxProcessor, error) {
+		maxStale := time.Duration(optInt(opts, "max_stale_ms", 0)) * time.Millisecond
+		return NewStaleIfErrorProcessor(maxStale, optInt(opts, "limit", defaultCacheLimit)), nil
+	})
+	RegisterProcessorFactory("circuitbreaker", func(opts map[string]interface{}) (NxProcessor, error) {
+		cooldown := time.Duration(optInt(opts, "cooldown_ms", 30000)) * time.Millisecond
+		return NewCircuitBreakerProcessor(NewCircuitBreaker(optInt(opts, "threshold", 5), cooldown)), nil
+	})
+	RegisterProcessorFactory("proxy", func(opts map[string]interface{}) (NxProcessor, error) {
+		target := optString(opts, "target", "")
+		if len(target) == 0 {
+			return nil, fmt.Errorf("proxy: target expected")
+		}
+		return NewProxyProcessor(target, &ProxyOptions{
+			StripPrefix:  optString(opts, "strip_prefix", ""),
+			PreserveHost: optBool(opts, "preserve_host", false),
+			Retries:      optInt(opts, "retries", 0),
+		}), nil
+	})
+}
@@ -2,22 +2,45 @@ package nxhttp
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type NxContext struct {
 	req      *http.Request
 	res      http.ResponseWriter
 	params   []string
+	pnames   []string
 	datakeys []string
+	entry    Entry       // matched entry
 	cproc    NxProcessor // current proc
 	stopped  bool        // if stopped proc chainning
+	status   int         // pending status, see Status
+	timings  []ProcessorTiming
+	tstart   time.Time
 	debug    bool
 }
 
+// context for running processors outside of a handler, e.g. in tests
+func NewContext(w http.ResponseWriter, r *http.Request, params ...string) *NxContext {
+	return &NxContext{
+		res:      newResponseWriter(w),
+		req:      r,
+		params:   params,
+		datakeys: make([]string, 0),
+	}
+}
+
+// run p and the processors chained to it
+func (self *NxContext) Run(p NxProcessor) {
+	self.cproc = p
+	self.run(p)
+}
+
 func (self *NxContext) Req() *http.Request {
 	return self.req
 }
@@ -26,6 +49,12 @@ func (self *NxContext) Res() http.ResponseWriter {
 	return self.res
 }
 
+// handler serving current request, nil if executed outside of a handler
+func (self *NxContext) handler() *NxHandler {
+	h, _ := self.req.Context().Value(handlerCtxKey{}).(*NxHandler)
+	return h
+}
+
 func (self *NxContext) Header(key string) string {
 	return self.req.Header.Get(key)
 }
@@ -114,28 +143,53 @@ func (self *NxContext) IsAjax() bool {
 	return strings.ToLower(self.req.Header.Get("X-Requested-With")) == "xmlhttprequest"
 }
 
+// status to send with the next Send*, headers may still be set until then
+func (self *NxContext) Status(status int) *NxContext {
+	self.status = status
+	return self
+}
+
+func (self *NxContext) SetHeader(key, value string) *NxContext {
+	self.res.Header().Set(key, value)
+	return self
+}
+
+// write the pending status if any
+func (self *NxContext) writeStatus() {
+	if self.status > 0 {
+		self.res.WriteHeader(self.status)
+		self.status = 0
+	}
+}
+
+// send status with its text as body
+func (self *NxContext) SendStatus(status int) *NxContext {
+	if len(self.res.Header().Get("Content-Type")) == 0 {
+		self.res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	self.status = status
+	return self.SendString(http.StatusText(status))
+}
+
 func (self *NxContext) SendBytes(b []byte) *NxContext {
+	self.writeStatus()
 	self.res.Write(b)
 	return self
 }
 
 func (self *NxContext) SendString(text string) *NxContext {
+	self.writeStatus()
 	self.res.Write([]byte(text))
 	return self
 }
 
 func (self *NxContext) SendAsJson(o interface{}) *NxContext {
-	self.res.Header().Set("Content-Type", "application/json; charset=utf-8")
-	enc := json.NewEncoder(self.res)
-	enc.SetEscapeHTML(true)
-	if err := enc.Encode(o); err != nil {
-		panic(err)
-	} else {
-		return self
-	}
+	codec, opts := self.jsonCodec()
+	return self.sendJson(o, &opts, codec)
 }
 
 func (self *NxContext) SetStatus(status int) *NxContext {
+	self.status = 0
 	self.res.WriteHeader(status)
 	return self
 }
@@ -144,7 +198,7 @@ func (self *NxContext) RunNext() {
 	if self.cproc != nil && !self.stopped {
 		if p := self.cproc.getnext(); p != nil {
 			self.cproc = p
-			p.Process(self)
+			self.run(p)
 		}
 	}
 }
@@ -153,6 +207,7 @@ func (self *NxContext) End(status int) {
 	if !self.stopped {
 		self.stopped = true
 		if status > 0 {
+			self.status = 0
 			self.res.WriteHeader(status)
 		}
 	}
@@ -162,11 +217,34 @@ func (self *NxContext) IsStopped() bool {
 	return self.stopped
 }
 
-func (self *NxContext) Redirect(url string) {
+// redirect to url with status, 302 Found if not given. use 303 after
+// a POST, 307/308 to keep the method and body
+func (self *NxContext) Redirect(url string, status ...int) {
 	if !self.stopped {
 		self.stopped = true
+		code := http.StatusFound
+		if len(status) > 0 {
+			code = status[0]
+		}
+		if code < 300 || code > 399 {
+			log.Panic(fmt.Sprintf("invalid redirect status %d", code))
+		}
 		self.Res().Header().Set("cache-control", "no-cache")
 		self.Res().Header().Set("expires", "Thu, 01 Jan 1970 00:00:00 GMT")
-		http.Redirect(self.Res(), self.Req(), "/ui/signin", http.StatusMovedPermanently)
+		http.Redirect(self.Res(), self.Req(), url, code)
+	}
+}
+
+// redirect with 302 to the url of the named route
+func (self *NxContext) RedirectToRoute(name string, params ...interface{}) error {
+	h := self.handler()
+	if h == nil {
+		return fmt.Errorf("no handler")
+	}
+	url, err := h.URLFor(name, params...)
+	if err != nil {
+		return err
 	}
+	self.Redirect(url)
+	return nil
 }
@@ -0,0 +1,154 @@
+package nxhttp
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type CorsConfig struct {
+	// allowed origins, "*" allows any, "https://*.example.com" matches
+	// subdomains
+	AllowOrigins []string
+
+	// preflight allowed methods, empty for the methods routed for the path
+	AllowMethods []string
+
+	// preflight allowed headers, empty to allow the requested ones
+	AllowHeaders []string
+
+	// response headers readable by scripts
+	ExposeHeaders []string
+
+	// not allowed with the "*" origin, which would grant credentials to
+	// any site
+	AllowCredentials bool
+
+	// seconds preflights are cached, 0 omits the header
+	MaxAge int
+}
+
+// any origin, 180 seconds preflight cache
+func DefaultCorsConfig() *CorsConfig {
+	return &CorsConfig{
+		AllowOrigins: []string{"*"},
+		MaxAge:       180,
+	}
+}
+
+func (self *CorsConfig) allowOrigin(origin string) bool {
+	for _, p := range self.AllowOrigins {
+		if p == "*" {
+			return true
+		}
+		if i := strings.Index(p, "*"); i >= 0 {
+			o := strings.ToLower(origin)
+			if len(o) >= len(p)-1 &&
+				strings.HasPrefix(o, strings.ToLower(p[:i])) && strings.HasSuffix(o, strings.ToLower(p[i+1:])) {
+				return true
+			}
+		} else if strings.EqualFold(p, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *CorsConfig) validate() error {
+	if !self.AllowCredentials {
+		return nil
+	}
+	for _, p := range self.AllowOrigins {
+		if p == "*" {
+			return fmt.Errorf("cors: credentials with any origin")
+		}
+	}
+	return nil
+}
+
+func (self *CorsConfig) setOrigin(h http.Header, origin string) {
+	// origin is echoed rather than "*" so credentials work too
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	if self.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// answer a preflight, routed are the methods having an entry for the path
+func (self *CorsConfig) preflight(w http.ResponseWriter, r *http.Request, routed []string) {
+	origin := r.Header.Get("Origin")
+	if !self.allowOrigin(origin) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	h := w.Header()
+	self.setOrigin(h, origin)
+	methods := self.AllowMethods
+	if len(methods) == 0 {
+		methods = routed
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ","))
+	if len(self.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(self.AllowHeaders, ","))
+	} else if rh := r.Header.Get("Access-Control-Request-Headers"); len(rh) > 0 {
+		h.Set("Access-Control-Allow-Headers", rh)
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if self.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(self.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// headers of an actual cross origin response
+func (self *CorsConfig) actual(h http.Header, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 || !self.allowOrigin(origin) {
+		return
+	}
+	self.setOrigin(h, origin)
+	if len(self.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(self.ExposeHeaders, ","))
+	}
+}
+
+// cors settings of an entry, nil if it has no cors processor
+func entryCors(en Entry) *CorsConfig {
+	for p := en.Processor(); p != nil; p = p.getnext() {
+		if c, ok := p.(*CorsProcessor); ok {
+			return c.conf
+		}
+	}
+	return nil
+}
+
+/*
+ * per entry cors, overrides the handler settings for preflights and
+ * responses of the entry
+ */
+type CorsProcessor struct {
+	DefaultProcessor
+	conf *CorsConfig
+}
+
+func (self *CorsProcessor) Process(ctx *NxContext) {
+	self.conf.actual(ctx.res.Header(), ctx.req)
+	ctx.RunNext()
+}
+
+func NewCorsProcessor(conf *CorsConfig) *CorsProcessor {
+	if conf == nil {
+		conf = DefaultCorsConfig()
+	}
+	if err := conf.validate(); err != nil {
+		log.Panic(err.Error())
+	}
+	return &CorsProcessor{
+		DefaultProcessor: DefaultProcessor{name: "cors"},
+		conf:             conf,
+	}
+}
@@ -0,0 +1,59 @@
+package nxhttp
+
+import (
+	"context"
+	"fmt"
+)
+
+// data under key if it is a T
+func GetDataAs[T any](ctx *NxContext, key string) (T, bool) {
+	v, ok := ctx.GetData(key).(T)
+	return v, ok
+}
+
+// data under key, panics if missing or not a T
+func MustGetData[T any](ctx *NxContext, key string) T {
+	v, ok := GetDataAs[T](ctx, key)
+	if !ok {
+		panic(fmt.Sprintf("context data %q is %T, not %T", key, ctx.GetData(key), v))
+	}
+	return v
+}
+
+/*
+ * typed data key. keys are compared by identity, so middlewares can not
+ * collide even when they pick the same name
+ *
+ *	var userKey = nxhttp.NewKey[*User]("user")
+ *	userKey.Put(ctx, u)
+ *	u, ok := userKey.Get(ctx)
+ */
+type Key[T any] struct {
+	name string
+}
+
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+func (self *Key[T]) Name() string {
+	return self.name
+}
+
+func (self *Key[T]) Put(ctx *NxContext, v T) {
+	ctx.req = ctx.req.WithContext(context.WithValue(ctx.req.Context(), self, v))
+}
+
+func (self *Key[T]) Get(ctx *NxContext) (T, bool) {
+	v, ok := ctx.req.Context().Value(self).(T)
+	return v, ok
+}
+
+// panics if not set
+func (self *Key[T]) Must(ctx *NxContext) T {
+	v, ok := self.Get(ctx)
+	if !ok {
+		panic(fmt.Sprintf("context data %q is not set", self.name))
+	}
+	return v
+}
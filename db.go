@@ -0,0 +1,203 @@
+package nxhttp
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+/*
+ * database connection processor, for handlers not wanting a transaction
+ * but one connection for the request, e.g. for session settings. with a
+ * timeout (Entry.SetTimeout sets it too) the rest of the chain runs with
+ * a deadline in ctx.Req().Context(), to be passed to the statements. the
+ * connection goes back to the pool when the chain is done
+ */
+type DbConn struct {
+	DefaultProcessor
+	db   *sql.DB
+	name string
+	init []string
+	qlog *QueryLog
+}
+
+func (self *DbConn) Process(ctx *NxContext) {
+	r := ctx.req
+	sc, span := ctx.StartSpan("db connection")
+	defer span.End()
+
+	c := r.Context()
+	if self.qlog != nil {
+		c = withQueryLog(sc, ctx, self.qlog)
+	}
+	if t := self.GetTimeout(); t > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, time.Duration(t)*time.Millisecond)
+		defer cancel()
+	}
+	if c != r.Context() {
+		ctx.req = r.WithContext(c)
+		defer func() {
+			ctx.req = r
+		}()
+	}
+
+	conn, e := self.db.Conn(c)
+	if e == nil && self.qlog != nil {
+		// statements run without the request context still belong to it
+		conn.Raw(func(dc interface{}) error {
+			if tc, ok := dc.(*tracedConn); ok {
+				tc.ctx = c
+			}
+			return nil
+		})
+	}
+	if e == nil {
+		for _, q := range self.init {
+			if _, e = conn.ExecContext(c, q); e != nil {
+				conn.Close()
+				break
+			}
+		}
+	}
+	if e != nil {
+		span.RecordError(e)
+		span.SetStatus(codes.Error, e.Error())
+		ctx.Logger().Error("db conn", "error", e)
+		ctx.End(http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	ctx.PutData(dbConnKey(self.name), conn).RunNext()
+}
+
+// statements run on each connection before the chain, e.g.
+// "SET statement_timeout = 5000" for postgres
+func (self *DbConn) SetInit(stmts ...string) *DbConn {
+	self.init = stmts
+	return self
+}
+
+// logs and traces the statements of the connection and of the request
+// context, the database must be opened by OpenTracedDB
+func (self *DbConn) SetQueryLog(q *QueryLog) *DbConn {
+	self.qlog = q
+	return self
+}
+
+// name is optional, for ctx.DbConnNamed
+func NewDbConn(db *sql.DB, name ...string) *DbConn {
+	p := &DbConn{
+		DefaultProcessor: DefaultProcessor{name: "dbconn"},
+		db:               db,
+	}
+	if len(name) > 0 {
+		p.name = name[0]
+	}
+	return p
+}
+
+func dbConnKey(name string) string {
+	if len(name) == 0 {
+		return "_dbconn"
+	}
+	return "_dbconn:" + name
+}
+
+// the connection of the unnamed DbConn, nil outside of one
+func (self *NxContext) DbConn() *sql.Conn {
+	return self.DbConnNamed("")
+}
+
+// the connection of the DbConn named name, nil outside of one
+func (self *NxContext) DbConnNamed(name string) *sql.Conn {
+	conn, _ := GetDataAs[*sql.Conn](self, dbConnKey(name))
+	return conn
+}
+
+/*
+ * read/write splitting processor, handlers get the replica pool for safe
+ * methods (GET, HEAD, OPTIONS) and the primary for the others by ctx.DB,
+ * or by ctx.DBNamed for a named one. ctx.UsePrimary, before or after the
+ * processor, sends the reads of the request to the primary too, e.g. to
+ * read the own writes right after a POST
+ */
+type DbSplit struct {
+	DefaultProcessor
+	primary *sql.DB
+	replica *sql.DB
+	name    string
+}
+
+func (self *DbSplit) Process(ctx *NxContext) {
+	db := self.primary
+	switch ctx.req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		if self.replica != nil && !ctx.usesPrimary(self.name) {
+			db = self.replica
+		}
+	}
+	ctx.PutData(dbSplitKey(self.name), &dbSplit{split: self, db: db}).RunNext()
+}
+
+// replica may be nil, e.g. in development, then everything goes to the
+// primary. name is optional, for ctx.DBNamed
+func NewDbSplit(primary, replica *sql.DB, name ...string) *DbSplit {
+	p := &DbSplit{
+		DefaultProcessor: DefaultProcessor{name: "dbsplit"},
+		primary:          primary,
+		replica:          replica,
+	}
+	if len(name) > 0 {
+		p.name = name[0]
+	}
+	return p
+}
+
+// pool picked for a request
+type dbSplit struct {
+	split *DbSplit
+	db    *sql.DB
+}
+
+func dbSplitKey(name string) string {
+	if len(name) == 0 {
+		return "_db"
+	}
+	return "_db:" + name
+}
+
+func (self *NxContext) usesPrimary(name string) bool {
+	primary, _ := GetDataAs[bool](self, dbSplitKey(name)+":primary")
+	return primary
+}
+
+// the pool of the unnamed DbSplit, nil outside of one
+func (self *NxContext) DB() *sql.DB {
+	return self.DBNamed("")
+}
+
+// the pool of the DbSplit named name, nil outside of one
+func (self *NxContext) DBNamed(name string) *sql.DB {
+	s, ok := GetDataAs[*dbSplit](self, dbSplitKey(name))
+	if !ok {
+		return nil
+	}
+	if self.usesPrimary(name) {
+		return s.split.primary
+	}
+	return s.db
+}
+
+// sends the rest of the request to the primary of the DbSplit named name,
+// the unnamed one without name
+func (self *NxContext) UsePrimary(name ...string) *NxContext {
+	n := ""
+	if len(name) > 0 {
+		n = name[0]
+	}
+	return self.PutData(dbSplitKey(n)+":primary", true)
+}
@@ -0,0 +1,335 @@
+package nxhttp
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * query logging of DbTx and DbConn (SetQueryLog). the database must be
+ * opened by OpenTracedDB, or by sql.OpenDB(TracedConnector(c)), so the
+ * statements pass the instrumented driver layer. statements run with the
+ * request context, or on the transaction/connection of the processor, get
+ * a log record with the request attributes and a span in the request trace
+ */
+type QueryLog struct {
+	Level  slog.Level                // level of the records, Info by default
+	Slow   time.Duration             // slower statements are logged as warnings, 0 for none
+	Args   bool                      // log the arguments too, they may carry secrets
+	Redact func(query string) string // nil replaces the literals by ?
+}
+
+var queryLiterals = regexp.MustCompile(`'(?:[^']|'')*'|\b\d+(?:\.\d+)?\b`)
+
+func (self *QueryLog) redact(q string) string {
+	if self.Redact != nil {
+		return self.Redact(q)
+	}
+	return queryLiterals.ReplaceAllString(q, "?")
+}
+
+// query log of a request, carried by its context
+type queryLogState struct {
+	log    *QueryLog
+	logger *slog.Logger
+}
+
+type queryLogKey struct{}
+
+func withQueryLog(c context.Context, ctx *NxContext, q *QueryLog) context.Context {
+	return context.WithValue(c, queryLogKey{}, &queryLogState{log: q, logger: ctx.Logger()})
+}
+
+func queryLogOf(c context.Context) *queryLogState {
+	if c == nil {
+		return nil
+	}
+	s, _ := c.Value(queryLogKey{}).(*queryLogState)
+	return s
+}
+
+// opens the database by driverName like sql.Open, with the instrumented
+// driver layer for SetQueryLog
+func OpenTracedDB(driverName, dsn string) (*sql.DB, error) {
+	db, e := sql.Open(driverName, dsn)
+	if e != nil {
+		return nil, e
+	}
+	d := db.Driver()
+	db.Close()
+
+	if dc, ok := d.(driver.DriverContext); ok {
+		c, e := dc.OpenConnector(dsn)
+		if e != nil {
+			return nil, e
+		}
+		return sql.OpenDB(TracedConnector(c)), nil
+	}
+	return sql.OpenDB(TracedConnector(&dsnConnector{d: d, dsn: dsn})), nil
+}
+
+// wraps c with the instrumented driver layer, for sql.OpenDB
+func TracedConnector(c driver.Connector) driver.Connector {
+	return &tracedConnector{c}
+}
+
+// connector of drivers not implementing driver.DriverContext
+type dsnConnector struct {
+	d   driver.Driver
+	dsn string
+}
+
+func (self *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return self.d.Open(self.dsn)
+}
+
+func (self *dsnConnector) Driver() driver.Driver {
+	return self.d
+}
+
+type tracedConnector struct {
+	driver.Connector
+}
+
+func (self *tracedConnector) Connect(c context.Context) (driver.Conn, error) {
+	conn, e := self.Connector.Connect(c)
+	if e != nil {
+		return nil, e
+	}
+	return &tracedConn{Conn: conn}, nil
+}
+
+/*
+ * instrumented connection. ctx is the context of the transaction begun on
+ * it, or set by DbConn, so statements run without a context, e.g. tx.Exec,
+ * still belong to the request
+ */
+type tracedConn struct {
+	driver.Conn
+	ctx context.Context
+}
+
+func (self *tracedConn) observe(c context.Context, query string, args []driver.NamedValue, f func() error) error {
+	s := queryLogOf(c)
+	if s == nil {
+		c = self.ctx
+		if s = queryLogOf(c); s == nil {
+			return f()
+		}
+	}
+
+	q := s.log.redact(query)
+	tracer := trace.SpanFromContext(c).TracerProvider().Tracer(tracerName)
+	_, span := tracer.Start(c, "db query", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.statement", q)))
+	defer span.End()
+
+	start := time.Now()
+	e := f()
+	d := time.Since(start)
+
+	attrs := []interface{}{"query", q, "duration", d}
+	if s.log.Args && len(args) > 0 {
+		values := make([]interface{}, len(args))
+		for i, a := range args {
+			values[i] = a.Value
+		}
+		attrs = append(attrs, "args", values)
+	}
+
+	level := s.log.Level
+	switch {
+	case e != nil && !errors.Is(e, driver.ErrSkip):
+		span.RecordError(e)
+		span.SetStatus(codes.Error, e.Error())
+		attrs = append(attrs, "error", e)
+		level = slog.LevelError
+	case e != nil:
+		// retried by database/sql with a prepared statement
+		span.SetAttributes(attribute.Bool("db.skipped", true))
+		return e
+	case s.log.Slow > 0 && d >= s.log.Slow:
+		level = slog.LevelWarn
+	}
+	s.logger.Log(c, level, "db query", attrs...)
+	return e
+}
+
+func (self *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return self.PrepareContext(context.Background(), query)
+}
+
+func (self *tracedConn) PrepareContext(c context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var e error
+	if p, ok := self.Conn.(driver.ConnPrepareContext); ok {
+		stmt, e = p.PrepareContext(c, query)
+	} else {
+		stmt, e = self.Conn.Prepare(query)
+	}
+	if e != nil {
+		return nil, e
+	}
+	return &tracedStmt{Stmt: stmt, conn: self, query: query}, nil
+}
+
+func (self *tracedConn) Begin() (driver.Tx, error) {
+	return self.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (self *tracedConn) BeginTx(c context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	var tx driver.Tx
+	var e error
+	if b, ok := self.Conn.(driver.ConnBeginTx); ok {
+		tx, e = b.BeginTx(c, opts)
+	} else if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) || opts.ReadOnly {
+		return nil, errors.New("nxhttp: driver does not support transaction options")
+	} else {
+		tx, e = self.Conn.Begin()
+	}
+	if e != nil {
+		return nil, e
+	}
+	if queryLogOf(c) != nil {
+		self.ctx = c
+	}
+	return &tracedTx{Tx: tx, conn: self}, nil
+}
+
+func (self *tracedConn) ExecContext(c context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	x, ok := self.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	var res driver.Result
+	e := self.observe(c, query, args, func() (e error) {
+		res, e = x.ExecContext(c, query, args)
+		return
+	})
+	return res, e
+}
+
+func (self *tracedConn) QueryContext(c context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	x, ok := self.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	var rows driver.Rows
+	e := self.observe(c, query, args, func() (e error) {
+		rows, e = x.QueryContext(c, query, args)
+		return
+	})
+	return rows, e
+}
+
+func (self *tracedConn) Ping(c context.Context) error {
+	if p, ok := self.Conn.(driver.Pinger); ok {
+		return p.Ping(c)
+	}
+	return nil
+}
+
+// called before the connection is reused, the request is done then
+func (self *tracedConn) ResetSession(c context.Context) error {
+	self.ctx = nil
+	if r, ok := self.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(c)
+	}
+	return nil
+}
+
+func (self *tracedConn) IsValid() bool {
+	if v, ok := self.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (self *tracedConn) CheckNamedValue(v *driver.NamedValue) error {
+	if c, ok := self.Conn.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+type tracedTx struct {
+	driver.Tx
+	conn *tracedConn
+}
+
+func (self *tracedTx) Commit() error {
+	self.conn.ctx = nil
+	return self.Tx.Commit()
+}
+
+func (self *tracedTx) Rollback() error {
+	self.conn.ctx = nil
+	return self.Tx.Rollback()
+}
+
+type tracedStmt struct {
+	driver.Stmt
+	conn  *tracedConn
+	query string
+}
+
+func (self *tracedStmt) ExecContext(c context.Context, args []driver.NamedValue) (driver.Result, error) {
+	var res driver.Result
+	e := self.conn.observe(c, self.query, args, func() (e error) {
+		if x, ok := self.Stmt.(driver.StmtExecContext); ok {
+			res, e = x.ExecContext(c, args)
+			return
+		}
+		values, e := namedValues(args)
+		if e != nil {
+			return e
+		}
+		res, e = self.Stmt.Exec(values)
+		return
+	})
+	return res, e
+}
+
+func (self *tracedStmt) QueryContext(c context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	var rows driver.Rows
+	e := self.conn.observe(c, self.query, args, func() (e error) {
+		if x, ok := self.Stmt.(driver.StmtQueryContext); ok {
+			rows, e = x.QueryContext(c, args)
+			return
+		}
+		values, e := namedValues(args)
+		if e != nil {
+			return e
+		}
+		rows, e = self.Stmt.Query(values)
+		return
+	})
+	return rows, e
+}
+
+func (self *tracedStmt) CheckNamedValue(v *driver.NamedValue) error {
+	if c, ok := self.Stmt.(driver.NamedValueChecker); ok {
+		return c.CheckNamedValue(v)
+	}
+	return self.conn.CheckNamedValue(v)
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		if len(a.Name) > 0 {
+			return nil, errors.New("nxhttp: driver does not support named parameters")
+		}
+		values[i] = a.Value
+	}
+	return values, nil
+}
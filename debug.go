@@ -0,0 +1,44 @@
+package nxhttp
+
+import (
+	"expvar"
+	"net/http/pprof"
+	"regexp"
+	"strings"
+)
+
+// serve net/http/pprof under prefix/pprof/ and expvar under prefix/vars,
+// e.g. prefix "/debug". auth runs in front of them, it may be nil to leave
+// the endpoints unprotected (not recommended in production)
+func (self *NxHandler) EnableDebugEndpoints(prefix string, auth NxProcessor) Entry {
+	prefix = strings.TrimSuffix(prefix, "/")
+	pattern := "^" + regexp.QuoteMeta(prefix) + `/(?:pprof/([^/]*)|(vars))$`
+
+	ps := make([]NxProcessor, 0)
+	if auth != nil {
+		ps = append(ps, auth)
+	}
+	ps = append(ps, MakeProcessor(func(ctx *NxContext) {
+		w, r := ctx.Res(), ctx.Req()
+		if ctx.UrlParam(1) == "vars" {
+			expvar.Handler().ServeHTTP(w, r)
+			return
+		}
+
+		switch name := ctx.UrlParam(0); name {
+		case "":
+			pprof.Index(w, r)
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Handler(name).ServeHTTP(w, r)
+		}
+	}))
+	return self.DoGet(pattern, ps...)
+}
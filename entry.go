@@ -3,6 +3,7 @@ package nxhttp
 import (
 	"net/http"
 	"regexp"
+	"regexp/syntax"
 )
 
 type Entry interface {
@@ -24,6 +25,15 @@ type Entry interface {
 	// set timeout for all procs
 	SetTimeout(int) Entry
 
+	// max request body size in bytes, overrides handler setting.
+	// 0 inherits from handler, < 0 means unlimited
+	SetMaxBodySize(int64) Entry
+	MaxBodySize() int64
+
+	// route documentation for OpenAPI spec
+	SetDoc(*RouteDoc) Entry
+	Doc() *RouteDoc
+
 	// debug switch
 	SetDebug(bool) Entry
 	IsDebug() bool
@@ -36,10 +46,14 @@ type Entry interface {
 }
 
 type BaseEntry struct {
-	name  string
-	proc  NxProcessor
-	data  map[string]interface{}
-	debug bool
+	name    string
+	proc    NxProcessor
+	data    map[string]interface{}
+	debug   bool
+	maxbody int64
+	doc     *RouteDoc
+	pnames  []string // param names, "" for unnamed
+	outer   Entry    // embedding self, the entry of contexts, self if nil
 }
 
 func (self *BaseEntry) Name() string {
@@ -103,6 +117,24 @@ func (self *BaseEntry) SetTimeout(i int) Entry {
 	return self
 }
 
+func (self *BaseEntry) SetMaxBodySize(n int64) Entry {
+	self.maxbody = n
+	return self
+}
+
+func (self *BaseEntry) MaxBodySize() int64 {
+	return self.maxbody
+}
+
+func (self *BaseEntry) SetDoc(d *RouteDoc) Entry {
+	self.doc = d
+	return self
+}
+
+func (self *BaseEntry) Doc() *RouteDoc {
+	return self.doc
+}
+
 func (self *BaseEntry) SetDebug(b bool) Entry {
 	self.debug = b
 	return self
@@ -117,13 +149,41 @@ func (self *BaseEntry) PutData(key string, val interface{}) Entry {
 	return self
 }
 
+// copy of the entry data
+func (self *BaseEntry) Data() map[string]interface{} {
+	data := make(map[string]interface{}, len(self.data))
+	for k, v := range self.data {
+		data[k] = v
+	}
+	return data
+}
+
+// en embeds self, contexts get en as their entry so ctx.Route().Entry
+// can be asserted to the registered type
+func (self *BaseEntry) bind(en Entry) {
+	self.outer = en
+}
+
+// bind en to its embedded BaseEntry, if any
+func bindEntry(en Entry) {
+	if b, ok := en.(interface{ bind(Entry) }); ok {
+		b.bind(en)
+	}
+}
+
 func (self *BaseEntry) Exec(w http.ResponseWriter, r *http.Request, params []string) {
 	if self.proc != nil {
+		var en Entry = self
+		if self.outer != nil {
+			en = self.outer
+		}
 		ctx := &NxContext{
-			res:      w,
+			res:      newResponseWriter(w),
 			req:      r,
 			params:   params,
 			datakeys: make([]string, 0),
+			entry:    en,
+			pnames:   self.pnames,
 			cproc:    self.proc,
 			debug:    self.IsDebug(),
 		}
@@ -133,40 +193,104 @@ func (self *BaseEntry) Exec(w http.ResponseWriter, r *http.Request, params []str
 			ctx.PutData(k, v)
 		}
 
-		self.proc.Process(ctx)
+		// recover here so the panic handler gets the entry context
+		defer func() {
+			if cv := recover(); cv != nil {
+				if h := ctx.handler(); h != nil {
+					h.recovered(ctx, cv)
+				} else {
+					panic(cv)
+				}
+			}
+		}()
+
+		if ctx.debug {
+			// sent as trailer, the body is usually written by then
+			ctx.res.Header().Add("Trailer", "Server-Timing")
+			defer ctx.emitTimings()
+		}
+		ctx.run(self.proc)
 	}
 }
 
 /* regexp entry */
 type RegexpEntry struct {
 	BaseEntry
-	re *regexp.Regexp
+	re   *regexp.Regexp
+	once bool // matches at most once, params are those of the match
+}
+
+// the regexp actually matched, may differ from the entry name
+func (self *RegexpEntry) source() string {
+	return self.re.String()
+}
+
+// pattern of en for analysis, see RegexpEntry.source
+func entrySource(en Entry) string {
+	if s, ok := en.(interface{ source() string }); ok {
+		return s.source()
+	}
+	return en.Name()
 }
 
 func (self *RegexpEntry) Match(path string) []string {
+	if self.re.NumSubexp() == 0 {
+		// nothing to extract, no allocation
+		if self.re.MatchString(path) {
+			return noParams
+		}
+		return nil
+	}
+	if self.once {
+		if s := self.re.FindStringSubmatch(path); s != nil {
+			return s[1:]
+		}
+		return nil
+	}
 	ss := self.re.FindAllStringSubmatch(path, -1)
 	if len(ss) > 0 {
-		params := make([]string, 0)
+		params := make([]string, 0, len(ss)*self.re.NumSubexp())
 		for _, s := range ss {
-			if len(s) > 1 {
-				params = append(params, s[1:]...)
-			}
+			params = append(params, s[1:]...)
 		}
 		return params
 	}
 	return nil
 }
 
+// use re, patterns anchored at the start match at most once
+func (self *RegexpEntry) setRegexp(re *regexp.Regexp) {
+	self.re = re
+	self.once = false
+	if p, err := syntax.Parse(re.String(), syntax.Perl); err == nil {
+		p = p.Simplify()
+		if p.Op == syntax.OpConcat && len(p.Sub) > 0 {
+			p = p.Sub[0]
+		}
+		self.once = p.Op == syntax.OpBeginText
+	}
+}
+
 func NewRegexpEntry(pattern string, ps ...NxProcessor) *RegexpEntry {
 	r := &RegexpEntry{
-		BaseEntry{
+		BaseEntry: BaseEntry{
 			name: pattern,
 			data: make(map[string]interface{}),
 		},
-		regexp.MustCompile(pattern),
 	}
+	r.setRegexp(regexp.MustCompile(pattern))
+	r.pnames = r.re.SubexpNames()[1:]
+	r.bind(r)
 	if len(ps) > 0 {
 		r.Use(ps...)
 	}
 	return r
 }
+
+// entry matching the whole path only, pattern /users does not match
+// /admin/users/export
+func NewAnchoredEntry(pattern string, ps ...NxProcessor) *RegexpEntry {
+	r := NewRegexpEntry(pattern, ps...)
+	r.setRegexp(regexp.MustCompile("^(?:" + pattern + ")$"))
+	return r
+}
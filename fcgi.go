@@ -0,0 +1,542 @@
+package nxhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// fastcgi record types and roles
+const (
+	fcgiBeginRequest = 1
+	fcgiAbortRequest = 2
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder = 1
+	fcgiKeepConn  = 1
+
+	fcgiMaxContent = 65535
+)
+
+// zeros padding records to 8 bytes
+var fcgiPadding [7]byte
+
+// buffers reading records, content and padding
+var fcgiBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, fcgiMaxContent+255)
+		return &b
+	},
+}
+
+// idle connections kept per FastCgiProcessor by default
+const FastCgiMaxIdle = 8
+
+var errFcgiEnd = errors.New("fastcgi connection closed before end of request")
+
+type fcgiConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	used   bool // served a request before, it may have gone stale
+	broken bool // not to be reused
+}
+
+func (self *fcgiConn) record(typ uint8, content []byte) error {
+	for {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		pad := -n & 7
+		h := [8]byte{1, typ, 0, 1, byte(n >> 8), byte(n), byte(pad), 0}
+		self.w.Write(h[:])
+		self.w.Write(content[:n])
+		self.w.Write(fcgiPadding[:pad])
+		content = content[n:]
+		if len(content) == 0 {
+			return nil
+		}
+	}
+}
+
+// one record, content is valid until the next read
+func (self *fcgiConn) read(buf []byte) (uint8, []byte, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(self.r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(h[4:6])) + int(h[6])
+	if _, err := io.ReadFull(self.r, buf[:n]); err != nil {
+		return 0, nil, err
+	}
+	return h[1], buf[:n-int(h[6])], nil
+}
+
+// fastcgi name-value pairs of env
+func fcgiParamsOf(env []string) []byte {
+	var b []byte
+	size := func(n int) {
+		if n < 128 {
+			b = append(b, byte(n))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, uint32(n)|1<<31)
+		}
+	}
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		size(len(k))
+		size(len(v))
+		b = append(b, k...)
+		b = append(b, v...)
+	}
+	return b
+}
+
+/*
+ * run a request on c, writing stdout to out. stdin is fed while the
+ * response is read, some apps answer before reading all of it. abort
+ * then unblocks the feeder reading body, do returns once it is done
+ */
+func (self *fcgiConn) do(env []string, body io.Reader, out io.Writer, stderr func([]byte), abort func()) (gotOutput bool, err error) {
+	self.record(fcgiBeginRequest, []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0})
+	if p := fcgiParamsOf(env); len(p) > 0 {
+		self.record(fcgiParams, p)
+	}
+	self.record(fcgiParams, nil)
+
+	fed := make(chan error, 1)
+	go func() {
+		buf := copyBuffers.Get().(*[]byte)
+		defer copyBuffers.Put(buf)
+		var err error
+		for body != nil {
+			n, e := body.Read(*buf)
+			if n > 0 {
+				if err = self.record(fcgiStdin, (*buf)[:n]); err == nil {
+					err = self.w.Flush()
+				}
+			}
+			if e != nil || err != nil {
+				break
+			}
+		}
+		if err == nil {
+			self.record(fcgiStdin, nil)
+			err = self.w.Flush()
+		}
+		fed <- err
+	}()
+	defer func() {
+		select {
+		case e := <-fed:
+			if err == nil {
+				err = e
+			}
+		default:
+			// answered without reading all of stdin
+			self.broken = true
+			self.conn.Close()
+			if abort != nil {
+				abort()
+			}
+			<-fed
+		}
+	}()
+
+	buf := fcgiBuffers.Get().(*[]byte)
+	defer fcgiBuffers.Put(buf)
+	for {
+		typ, content, e := self.read(*buf)
+		if e != nil {
+			if e == io.EOF {
+				e = errFcgiEnd
+			}
+			return gotOutput, e
+		}
+		gotOutput = true
+		switch typ {
+		case fcgiStdout:
+			if _, e := out.Write(content); e != nil {
+				// the client is gone, the connection can not be reused
+				self.broken = true
+				self.conn.Close()
+				return true, e
+			}
+		case fcgiStderr:
+			if stderr != nil && len(content) > 0 {
+				stderr(content)
+			}
+		case fcgiEndRequest:
+			if len(content) >= 5 && content[4] != 0 {
+				return true, fmt.Errorf("fastcgi protocol status %d", content[4])
+			}
+			return true, nil
+		}
+	}
+}
+
+/*
+ * FastCGI client, e.g. for php-fpm. the request env is the one of
+ * CgiProcessor, connections are kept alive and reused
+ */
+type FastCgiProcessor struct {
+	DefaultProcessor
+	network string
+	addr    string
+	envs    []string
+
+	idle    chan *fcgiConn
+	lock    sync.Mutex
+	closed  bool
+	timeout time.Duration // dial timeout
+
+	workers *fcgiWorkers // spawned by SpawnWorkers
+
+	clientRedirect bool          // see SetLocalRedirect
+	mode           CgiOutputMode // see SetOutputMode
+}
+
+func (self *FastCgiProcessor) get() (*fcgiConn, error) {
+	select {
+	case c := <-self.idle:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout(self.network, self.addr, self.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &fcgiConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+func (self *FastCgiProcessor) put(c *fcgiConn) {
+	if c.broken {
+		return
+	}
+	c.used = true
+	c.conn.SetDeadline(time.Time{})
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.closed {
+		select {
+		case self.idle <- c:
+			return
+		default:
+		}
+	}
+	c.conn.Close()
+}
+
+// run the request, once more on a new connection if a reused one turns
+// out closed before answering a request without body. reading the
+// response stops when stop is done
+func (self *FastCgiProcessor) roundtrip(ctx *NxContext, stop context.Context, env []string, out io.Writer, abort func()) error {
+	r := ctx.Req()
+	for {
+		c, err := self.get()
+		if err != nil {
+			return err
+		}
+		if t := self.GetTimeout(); t > 0 {
+			c.conn.SetDeadline(time.Now().Add(time.Duration(t) * time.Millisecond))
+		}
+
+		var body io.Reader
+		if r.Body != nil && r.Body != http.NoBody {
+			body = r.Body
+		}
+		unstop := context.AfterFunc(stop, func() {
+			c.conn.SetDeadline(time.Now())
+		})
+		got, err := c.do(env, body, out, func(b []byte) {
+			ctx.Logger().Warn("fastcgi stderr", "addr", self.addr, "output", string(b))
+		}, abort)
+		if !unstop() {
+			// the deadline may be set, not to be reused
+			c.broken = true
+			c.conn.Close()
+		}
+		if err == nil {
+			self.put(c)
+			return nil
+		}
+		c.conn.Close()
+		if got || !c.used || body != nil {
+			return err
+		}
+	}
+}
+
+func (self *FastCgiProcessor) Process(ctx *NxContext) {
+	self.serve(ctx, cgiEnv(ctx, self.envs, "", ctx.Req().URL.Path))
+}
+
+// send the request with env and its response
+func (self *FastCgiProcessor) serve(ctx *NxContext, env []string) {
+	_, span := ctx.StartSpan("fastcgi "+self.addr, attribute.String("fastcgi.addr", self.addr))
+	defer span.End()
+
+	// the request body must not be read once serve returns, a feeder
+	// blocked on it is unblocked by a read deadline and waited for
+	r := ctx.Req()
+	rc := http.NewResponseController(ctx.Res())
+	abort := func() {
+		rc.SetReadDeadline(time.Now())
+		r.Body.Close()
+	}
+	stop, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(self.roundtrip(ctx, stop, env, pw, abort))
+	}()
+
+	err := writeCgiResponse(ctx, pr, !self.clientRedirect, self.mode)
+	var redirect *cgiRedirect
+	if errors.As(err, &redirect) {
+		err = nil
+	}
+	pr.CloseWithError(err)
+	cancel()
+	<-done
+	if redirect != nil {
+		err = cgiLocalRedirect(ctx, redirect.loc)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		ctx.Logger().Error("fastcgi", "addr", self.addr, "error", err)
+		if ctx.ResponseStatus() == 0 {
+			status := http.StatusBadGateway
+			var ne net.Error
+			if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) && ne.Timeout() {
+				status = http.StatusGatewayTimeout
+			}
+			ctx.End(status)
+		} else {
+			ctx.End(0)
+		}
+		return
+	}
+	ctx.RunNext()
+}
+
+// extra params sent with every request, e.g. SCRIPT_FILENAME
+func (self *FastCgiProcessor) SetEnv(envmap map[string]string) *FastCgiProcessor {
+	for k, v := range envmap {
+		self.envs = append(self.envs, fmt.Sprintf("%s=%s", k, v))
+	}
+	return self
+}
+
+// see CgiProcessor.SetOutputMode
+func (self *FastCgiProcessor) SetOutputMode(mode CgiOutputMode) *FastCgiProcessor {
+	self.mode = mode
+	return self
+}
+
+// see CgiProcessor.SetLocalRedirect
+func (self *FastCgiProcessor) SetLocalRedirect(internal bool) *FastCgiProcessor {
+	self.clientRedirect = !internal
+	return self
+}
+
+// idle connections to keep, 0 for a connection per request
+func (self *FastCgiProcessor) SetMaxIdle(n int) *FastCgiProcessor {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.idle = make(chan *fcgiConn, n)
+	return self
+}
+
+func (self *FastCgiProcessor) SetDialTimeout(d time.Duration) *FastCgiProcessor {
+	self.timeout = d
+	return self
+}
+
+func (self *FastCgiProcessor) Validate() error {
+	conn, err := net.DialTimeout(self.network, self.addr, time.Second)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+// close idle connections and stop spawned workers
+func (self *FastCgiProcessor) Close() {
+	self.lock.Lock()
+	self.closed = true
+	w := self.workers
+	self.lock.Unlock()
+	if w != nil {
+		w.stop()
+	}
+	for {
+		select {
+		case c := <-self.idle:
+			c.conn.Close()
+		default:
+			self.DefaultProcessor.Close()
+			return
+		}
+	}
+}
+
+// network and addr as for net.Dial, e.g. "unix", "/run/php/php-fpm.sock"
+// or "tcp", "127.0.0.1:9000"
+func NewFastCgiProcessor(network, addr string) *FastCgiProcessor {
+	p := &FastCgiProcessor{}
+	p.init("fastcgi", network, addr)
+	return p
+}
+
+func (self *FastCgiProcessor) init(name, network, addr string) {
+	self.name = name
+	self.network = network
+	self.addr = addr
+	self.idle = make(chan *fcgiConn, FastCgiMaxIdle)
+	self.timeout = 5 * time.Second
+}
+
+/*
+ * long running fastcgi workers sharing a listening socket, for
+ * interpreters able to serve fastcgi on the socket passed as stdin,
+ * e.g. php-cgi. scripts then do not start a process per request
+ */
+type fcgiWorkers struct {
+	ln   net.Listener
+	file *os.File // ln as given to the workers
+	bin  string
+	args []string
+	env  []string
+
+	lock  sync.Mutex
+	procs map[*exec.Cmd]bool
+	quit  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// delay before a worker that exited is started again
+var FastCgiRespawnDelay = time.Second
+
+func (self *fcgiWorkers) run() {
+	defer self.wg.Done()
+	for {
+		cmd := exec.Command(self.bin, self.args...)
+		cmd.Stdin = self.file
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), self.env...)
+		if err := cmd.Start(); err != nil {
+			slog.Error("fastcgi worker", "bin", self.bin, "error", err)
+		} else {
+			self.lock.Lock()
+			self.procs[cmd] = true
+			self.lock.Unlock()
+
+			err = cmd.Wait()
+
+			self.lock.Lock()
+			delete(self.procs, cmd)
+			self.lock.Unlock()
+			select {
+			case <-self.quit:
+				return
+			default:
+			}
+			slog.Warn("fastcgi worker exited", "bin", self.bin, "error", err)
+		}
+
+		select {
+		case <-self.quit:
+			return
+		case <-time.After(FastCgiRespawnDelay):
+		}
+	}
+}
+
+func (self *fcgiWorkers) stop() {
+	close(self.quit)
+	self.lock.Lock()
+	for cmd := range self.procs {
+		cmd.Process.Kill()
+	}
+	self.lock.Unlock()
+	self.wg.Wait()
+	self.file.Close()
+	self.ln.Close()
+}
+
+/*
+ * listen on the address of the processor and keep n workers of cmd
+ * serving it, restarted when they exit, until Close. env is added to
+ * the environment of the workers, e.g. PHP_FCGI_CHILDREN=0 for php-cgi
+ */
+func (self *FastCgiProcessor) SpawnWorkers(n int, cmd string, envmap map[string]string) error {
+	fields := strings.Fields(cmd)
+	if n <= 0 || len(fields) == 0 {
+		return fmt.Errorf("invalid fastcgi workers %d %q", n, cmd)
+	}
+
+	ln, err := net.Listen(self.network, self.addr)
+	if err != nil {
+		return err
+	}
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		ln.Close()
+		return fmt.Errorf("fastcgi workers can not listen on %s", self.network)
+	}
+	file, err := fl.File()
+	if err != nil {
+		ln.Close()
+		return err
+	}
+
+	w := &fcgiWorkers{
+		ln:    ln,
+		file:  file,
+		bin:   fields[0],
+		args:  fields[1:],
+		procs: make(map[*exec.Cmd]bool),
+		quit:  make(chan struct{}),
+	}
+	for k, v := range envmap {
+		w.env = append(w.env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.closed || self.workers != nil {
+		w.file.Close()
+		w.ln.Close()
+		return fmt.Errorf("fastcgi workers of %s already spawned or closed", self.addr)
+	}
+	self.workers = w
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go w.run()
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package nxhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// executes a request and returns a json serializable result, normally
+// {"data": ..., "errors": [...]}. adapt graphql-go or any other engine
+type GraphQLExecutor interface {
+	Execute(ctx *NxContext, req *GraphQLRequest) interface{}
+}
+
+type GraphQLExecutorFunc func(ctx *NxContext, req *GraphQLRequest) interface{}
+
+func (self GraphQLExecutorFunc) Execute(ctx *NxContext, req *GraphQLRequest) interface{} {
+	return self(ctx, req)
+}
+
+type GraphQLOptions struct {
+	// resolves persisted query ids, sent as "id" or as the
+	// extensions.persistedQuery.sha256Hash of a request without query
+	PersistedQuery func(id string) (string, bool)
+
+	// serve the GraphiQL UI to browsers doing a plain GET
+	GraphiQL bool
+}
+
+// request context key of the NxContext, for resolvers
+type nxCtxKey struct{}
+
+// NxContext of the request executing with c, nil if none
+func NxContextFrom(c context.Context) *NxContext {
+	ctx, _ := c.Value(nxCtxKey{}).(*NxContext)
+	return ctx
+}
+
+/*
+ * graphql processor, GET and POST
+ */
+type GraphQLProcessor struct {
+	DefaultProcessor
+	exec GraphQLExecutor
+	opts GraphQLOptions
+}
+
+func (self *GraphQLProcessor) Process(ctx *NxContext) {
+	r := ctx.Req()
+
+	if self.opts.GraphiQL && r.Method == "GET" && len(r.URL.RawQuery) == 0 &&
+		strings.Contains(r.Header.Get("Accept"), "text/html") {
+		ctx.res.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// the path is escaped for the script it goes into
+		graphiqlPage.Execute(ctx.res, r.URL.Path)
+		ctx.RunNext()
+		return
+	}
+
+	req, err := self.parse(ctx)
+	if err == nil && len(req.Query) == 0 {
+		err = self.resolvePersisted(req)
+	}
+	if err != nil {
+		if ctx.ResponseStatus() != 0 {
+			// a body over the size limit, answered 413
+			ctx.End(0)
+		} else {
+			graphqlError(ctx, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	if r.Method == "GET" && graphqlOperation(req.Query, req.OperationName) == "mutation" {
+		ctx.res.Header().Set("Allow", "POST")
+		graphqlError(ctx, http.StatusMethodNotAllowed, "mutations are not allowed with GET")
+		return
+	}
+
+	ctx.req = r.WithContext(context.WithValue(r.Context(), nxCtxKey{}, ctx))
+	ctx.SendAsJson(self.exec.Execute(ctx, req))
+	ctx.RunNext()
+}
+
+func (self *GraphQLProcessor) parse(ctx *NxContext) (*GraphQLRequest, error) {
+	r := ctx.Req()
+	req := &GraphQLRequest{}
+
+	if r.Method == "GET" {
+		q := r.URL.Query()
+		req.Query = q.Get("query")
+		req.OperationName = q.Get("operationName")
+		if v := q.Get("variables"); len(v) > 0 {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return nil, fmt.Errorf("invalid variables: %v", err)
+			}
+		}
+		if v := q.Get("extensions"); len(v) > 0 {
+			if err := json.Unmarshal([]byte(v), &req.Extensions); err != nil {
+				return nil, fmt.Errorf("invalid extensions: %v", err)
+			}
+		}
+		if id := q.Get("id"); len(id) > 0 && len(req.Query) == 0 {
+			req.Extensions = map[string]interface{}{
+				"persistedQuery": map[string]interface{}{"sha256Hash": id},
+			}
+		}
+		return req, nil
+	}
+
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/graphql":
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			return nil, ctx.bodyError(err)
+		}
+		req.Query = string(b)
+	case "application/json", "":
+		if err := ctx.bodyError(json.NewDecoder(r.Body).Decode(req)); err != nil {
+			return nil, fmt.Errorf("invalid request body: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", mt)
+	}
+	return req, nil
+}
+
+func (self *GraphQLProcessor) resolvePersisted(req *GraphQLRequest) error {
+	pq, _ := req.Extensions["persistedQuery"].(map[string]interface{})
+	id, _ := pq["sha256Hash"].(string)
+	if len(id) == 0 {
+		return fmt.Errorf("query is missing")
+	}
+	if self.opts.PersistedQuery != nil {
+		if q, ok := self.opts.PersistedQuery(id); ok {
+			req.Query = q
+			return nil
+		}
+	}
+	return fmt.Errorf("PersistedQueryNotFound")
+}
+
+// type of the operation of query a request runs, "query", "mutation" or
+// "subscription". it is "mutation" if any operation is one and the one
+// run is not known, e.g. several operations without operationName
+func graphqlOperation(query, name string) string {
+	type operation struct{ kind, name string }
+	var ops []operation // fragments have no kind
+	depth, parens := 0, 0
+	open := false  // the last definition waits for its selection set
+	named := false // the last word was an operation keyword
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+			continue
+		case c == '"':
+			if strings.HasPrefix(query[i:], `"""`) {
+				end := strings.Index(query[i+3:], `"""`)
+				if end < 0 {
+					return "mutation"
+				}
+				i += end + 6
+				continue
+			}
+			for i++; i < len(query) && query[i] != '"'; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+		case c == '(':
+			parens++
+		case c == ')':
+			parens--
+		case c == '{':
+			if depth == 0 && !open {
+				// shorthand query
+				ops = append(ops, operation{kind: "query"})
+			}
+			depth++
+			open, named = false, false
+		case c == '}':
+			depth--
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(query) && (query[j] == '_' || unicode.IsLetter(rune(query[j])) || unicode.IsDigit(rune(query[j]))) {
+				j++
+			}
+			if word := query[i:j]; depth == 0 && parens == 0 {
+				switch {
+				case named:
+					ops[len(ops)-1].name = word
+				case word == "query" || word == "mutation" || word == "subscription":
+					ops = append(ops, operation{kind: word})
+					open = true
+				case word == "fragment":
+					ops = append(ops, operation{})
+					open = true
+				}
+				named = word == "query" || word == "mutation" || word == "subscription"
+			}
+			i = j
+			continue
+		}
+		i++
+	}
+
+	n, kind, mutation := 0, "", false
+	for _, op := range ops {
+		if len(op.kind) == 0 {
+			continue
+		}
+		if len(name) > 0 && op.name == name {
+			return op.kind
+		}
+		n, kind = n+1, op.kind
+		mutation = mutation || op.kind == "mutation"
+	}
+	if mutation && (n > 1 || len(name) > 0) {
+		return "mutation"
+	}
+	return kind
+}
+
+func graphqlError(ctx *NxContext, status int, msg string) {
+	ctx.res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	ctx.End(status)
+	json.NewEncoder(ctx.res).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"message": msg}},
+	})
+}
+
+func NewGraphQLProcessor(exec GraphQLExecutor, opts *GraphQLOptions) *GraphQLProcessor {
+	p := &GraphQLProcessor{
+		DefaultProcessor: DefaultProcessor{name: "graphql"},
+		exec:             exec,
+	}
+	if opts != nil {
+		p.opts = *opts
+	}
+	return p
+}
+
+// the endpoint goes into a script, html/template escapes it for there
+var graphiqlPage = template.Must(template.New("graphiql").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>GraphiQL</title>
+<link rel="stylesheet" href="https://unpkg.com/graphiql@3.8.3/graphiql.min.css" />
+</head>
+<body style="margin:0">
+<div id="graphiql" style="height:100vh"></div>
+<script crossorigin src="https://unpkg.com/react@18.3.1/umd/react.production.min.js"></script>
+<script crossorigin src="https://unpkg.com/react-dom@18.3.1/umd/react-dom.production.min.js"></script>
+<script crossorigin src="https://unpkg.com/graphiql@3.8.3/graphiql.min.js"></script>
+<script>
+ReactDOM.createRoot(document.getElementById('graphiql')).render(
+  React.createElement(GraphiQL, {fetcher: GraphiQL.createFetcher({url: {{.}}})}),
+);
+</script>
+</body>
+</html>
+`))
@@ -1,20 +1,195 @@
 package nxhttp
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type NxHandler struct {
-	getmap  map[string]Entry
-	postmap map[string]Entry
-	delmap  map[string]Entry
-	putmap  map[string]Entry
-	mounts  map[string]http.Handler
+	routes  *routeRef
 	timeout int
+	metrics *Metrics
+	onpanic PanicHandler
+	limiter *limiter // see SetConcurrencyLimit
+
+	jsonopts  *JsonOptions
+	jsoncodec JsonCodec
+	logger    *slog.Logger
+
+	cgiInterp map[string][]string // by extension, see SetCgiInterpreter
+}
+
+// trailing slash policies, applied when only the path with the trailing
+// slash added or removed is routed
+const (
+	SlashStrict      = iota // no match, the default
+	SlashRedirect301        // redirect with 301 Moved Permanently
+	SlashRedirect308        // redirect with 308 Permanent Redirect, keeps method and body
+	SlashRewrite            // serve the other path internally
+)
+
+// called with the recovered value and stack when request handling panics
+type PanicHandler func(ctx *NxContext, recovered interface{}, stack []byte)
+
+// request context key of the serving handler
+type handlerCtxKey struct{}
+
+// methods entries can be registered for
+var methods = []string{"GET", "POST", "DELETE", "PUT", "PATCH"}
+
+/*
+ * route table, never modified once published. registrations build a
+ * new table and swap it in so ServeHTTP needs no locking. it holds the
+ * settings applied by routing as well, Swap adopts them with the routes
+ */
+type routeTable struct {
+	entries  map[string]map[string]Entry // method -> pattern -> entry
+	matchers map[string]*matcher         // method -> matcher of entries
+	mounts   map[string]*mount
+	names    map[string]Entry // named routes
+
+	cacheSize int
+	cache     *routeCache // nil if disabled
+
+	maxbody int64
+	proxies []*net.IPNet // trusted proxies
+	cors    *CorsConfig
+	slash   int
+	strict  bool
+}
+
+// entry of method matching path
+func (self *routeTable) find(method, path string) (Entry, []string) {
+	if self.cache == nil {
+		return self.matchers[method].find(path)
+	}
+	key := method + " " + path
+	if en, params, ok := self.cache.get(key); ok {
+		return en, params
+	}
+	en, params := self.matchers[method].find(path)
+	if en != nil {
+		self.cache.put(key, en, params)
+	}
+	return en, params
+}
+
+// compile the matchers, keeping the entry order of prev
+func (self *routeTable) compile(prev *routeTable) {
+	for m, dict := range self.entries {
+		var o *matcher
+		if prev != nil {
+			o = prev.matchers[m]
+		}
+		self.matchers[m] = compileMatcher(dict, o)
+	}
+	if self.cacheSize > 0 {
+		self.cache = newRouteCache(self.cacheSize)
+	}
+}
+
+func (self *routeTable) clone() *routeTable {
+	t := newRouteTable()
+	for m, dict := range self.entries {
+		d := make(map[string]Entry, len(dict)+1)
+		for k, v := range dict {
+			d[k] = v
+		}
+		t.entries[m] = d
+	}
+	for k, v := range self.mounts {
+		t.mounts[k] = v
+	}
+	for k, v := range self.names {
+		t.names[k] = v
+	}
+	t.cacheSize = self.cacheSize
+	t.maxbody = self.maxbody
+	t.proxies = self.proxies
+	t.cors = self.cors
+	t.slash = self.slash
+	t.strict = self.strict
+	return t
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		entries:  make(map[string]map[string]Entry),
+		matchers: make(map[string]*matcher),
+		mounts:   make(map[string]*mount),
+		names:    make(map[string]Entry),
+	}
+}
+
+type routeRef struct {
+	lock sync.Mutex // serializes writers
+	cur  atomic.Pointer[routeTable]
+}
+
+// current route table, must not be modified
+func (self *NxHandler) table() *routeTable {
+	return self.routes.cur.Load()
+}
+
+// modify a copy of the route table and publish it
+func (self *NxHandler) update(f func(t *routeTable)) {
+	self.routes.lock.Lock()
+	defer self.routes.lock.Unlock()
+
+	old := self.routes.cur.Load()
+	t := old.clone()
+	f(t)
+	t.compile(old)
+	self.routes.cur.Store(t)
+}
+
+// atomically replace all routes with the ones of other, e.g. built from
+// a reloaded config, along with its max body size, trusted proxies, cors,
+// slash policy and strict matching. entries and mounts no longer routed
+// are closed. the routes are taken from other, which is left with none,
+// so closing it afterwards closes nothing served here. requests served
+// here see self as their handler, for its panic handler, metrics and codec
+func (self *NxHandler) Swap(other *NxHandler) {
+	if other.routes == self.routes {
+		return
+	}
+	other.routes.lock.Lock()
+	t := other.routes.cur.Load()
+	other.routes.cur.Store(newRouteTable())
+	other.routes.lock.Unlock()
+
+	self.routes.lock.Lock()
+	old := self.routes.cur.Load()
+	self.routes.cur.Store(t)
+	self.routes.lock.Unlock()
+
+	for m, dict := range old.entries {
+		for k, en := range dict {
+			if t.entries[m][k] != en {
+				en.Close()
+			}
+		}
+	}
+	for k, m := range old.mounts {
+		if n := t.mounts[k]; n != m {
+			var keep http.Handler
+			if n != nil {
+				keep = n.handler
+			}
+			m.close(keep)
+		}
+	}
 }
 
 func (self *NxHandler) SetTimeout(ms int) *NxHandler {
@@ -22,141 +197,469 @@ func (self *NxHandler) SetTimeout(ms int) *NxHandler {
 	return self
 }
 
+// max request body size in bytes for all entries and mounts, <= 0 means unlimited.
+// entries may override it by Entry.SetMaxBodySize
+func (self *NxHandler) SetMaxBodySize(n int64) *NxHandler {
+	self.update(func(t *routeTable) {
+		t.maxbody = n
+	})
+	return self
+}
+
+// replace the default panic handler, which logs the panic with stack
+// and responds with plain 500
+func (self *NxHandler) SetPanicHandler(f PanicHandler) *NxHandler {
+	self.onpanic = f
+	return self
+}
+
+// cors settings for all entries and mounts, nil disables cors, the
+// default. SetCors(DefaultCorsConfig()) allows any origin. entries may
+// override it with a CorsProcessor
+func (self *NxHandler) SetCors(conf *CorsConfig) *NxHandler {
+	if conf != nil {
+		if err := conf.validate(); err != nil {
+			log.Panic(err.Error())
+		}
+	}
+	self.update(func(t *routeTable) {
+		t.cors = conf
+	})
+	return self
+}
+
+// anchor patterns registered from now on with ^...$. off by default
+// for compatibility, patterns then match any substring of the path
+func (self *NxHandler) SetStrictMatch(b bool) *NxHandler {
+	self.update(func(t *routeTable) {
+		t.strict = b
+	})
+	return self
+}
+
+func (self *NxHandler) newEntry(pattern string, ps ...NxProcessor) *RegexpEntry {
+	if self.table().strict {
+		return NewAnchoredEntry(pattern, ps...)
+	}
+	return NewRegexpEntry(pattern, ps...)
+}
+
+func (self *NxHandler) SetSlashPolicy(policy int) *NxHandler {
+	self.update(func(t *routeTable) {
+		t.slash = policy
+	})
+	return self
+}
+
+// if path is served by an entry or mount
+func (self *routeTable) routed(method, path string) bool {
+	if en, _ := self.find(method, path); en != nil {
+		return true
+	}
+	return self.mount(path) != nil
+}
+
+// if an unrouted path is matched by a typed route but for the type of a
+// param, /orders/abc of /orders/{id:int}. it is then not found
+func (self *routeTable) typeMiss(method, path string) bool {
+	for m, dict := range self.entries {
+		if method != "OPTIONS" && m != method {
+			continue
+		}
+		for _, en := range dict {
+			if r, ok := en.(*RouteEntry); ok && r.RegexpEntry.Match(path) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply the slash policy, returns the request to route, a copy if the
+// path is rewritten, and false if a redirect was sent
+func (self *NxHandler) fixSlash(t *routeTable, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	path := r.URL.Path
+	if t.slash == SlashStrict || path == "/" || t.routed(r.Method, path) {
+		return r, true
+	}
+	alt := path + "/"
+	if strings.HasSuffix(path, "/") {
+		alt = strings.TrimRight(path, "/")
+	}
+	if len(alt) == 0 || !t.routed(r.Method, alt) {
+		return r, true
+	}
+
+	if t.slash == SlashRewrite {
+		// the caller keeps the path the client sent
+		u := *r.URL
+		u.Path = alt
+		u.RawPath = ""
+		r2 := *r
+		r2.URL = &u
+		return &r2, true
+	}
+	if strings.HasPrefix(alt, "//") {
+		// browsers take it for another host, //evil.com/
+		return r, true
+	}
+	u := *r.URL
+	u.Path = alt
+	u.RawPath = ""
+	code := http.StatusMovedPermanently
+	if t.slash == SlashRedirect308 {
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, u.RequestURI(), code)
+	return r, false
+}
+
+func defaultPanicHandler(ctx *NxContext, cv interface{}, stack []byte) {
+	ctx.Logger().Error("panic", "error", cv, "stack", string(stack))
+	ctx.res.WriteHeader(http.StatusInternalServerError)
+	ctx.res.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+}
+
+// must be called from the deferred recover func to get the right stack
+func (self *NxHandler) recovered(ctx *NxContext, cv interface{}) {
+	if cv == http.ErrAbortHandler {
+		// the server aborts the response quietly
+		panic(cv)
+	}
+	ctx.stopped = true
+	f := self.onpanic
+	if f == nil {
+		f = defaultPanicHandler
+	}
+	f(ctx, cv, debug.Stack())
+}
+
 func (self *NxHandler) Close() {
-	for _, o := range self.getmap {
-		o.Close()
+	t := self.table()
+	closed := make(map[Entry]bool) // entries may serve several methods
+	for _, dict := range t.entries {
+		for _, o := range dict {
+			if !closed[o] {
+				closed[o] = true
+				o.Close()
+			}
+		}
+	}
+	for _, m := range t.mounts {
+		m.close(nil)
+	}
+}
+
+func (self *NxHandler) addEntry(method string, en Entry) Entry {
+	self.update(func(t *routeTable) {
+		dict := t.entries[method]
+		if dict == nil {
+			dict = make(map[string]Entry)
+			t.entries[method] = dict
+		}
+		if _, ok := dict[en.Name()]; ok {
+			log.Panic(fmt.Sprintf("pattern %q already exists", en.Name()))
+		}
+		bindEntry(en)
+		dict[en.Name()] = en
+	})
+	return en
+}
+
+// unregister the entry of pattern and close it, false if there is none.
+// an entry also routed for other methods, e.g. by CgiAny, is closed when
+// the last of them is removed
+func (self *NxHandler) Remove(method, pattern string) bool {
+	method = strings.ToUpper(method)
+	var old Entry
+	inuse := false
+	self.update(func(t *routeTable) {
+		old = t.entries[method][pattern]
+		delete(t.entries[method], pattern)
+		inuse = t.references(old)
+		if !inuse {
+			t.unname(old)
+		}
+	})
+	if old == nil {
+		return false
 	}
-	for _, o := range self.postmap {
-		o.Close()
+	if !inuse {
+		old.Close()
 	}
-	for _, o := range self.delmap {
-		o.Close()
+	return true
+}
+
+// register en in place of the entry having the same pattern, the
+// replaced entry is closed unless other methods still route to it
+func (self *NxHandler) Replace(method string, en Entry) Entry {
+	method = strings.ToUpper(method)
+	var old Entry
+	inuse := false
+	self.update(func(t *routeTable) {
+		dict := t.entries[method]
+		if dict == nil {
+			dict = make(map[string]Entry)
+			t.entries[method] = dict
+		}
+		old = dict[en.Name()]
+		bindEntry(en)
+		dict[en.Name()] = en
+		inuse = t.references(old)
+		if !inuse {
+			t.unname(old)
+		}
+	})
+	if old != nil && !inuse {
+		old.Close()
 	}
-	for _, o := range self.putmap {
-		o.Close()
+	return en
+}
+
+// whether any method routes to en
+func (self *routeTable) references(en Entry) bool {
+	for _, dict := range self.entries {
+		for _, o := range dict {
+			if o == en {
+				return true
+			}
+		}
 	}
+	return false
 }
 
-func addproc(dict map[string]Entry, pattern string, ps []NxProcessor) Entry {
-	if _, ok := dict[pattern]; ok {
-		log.Panic(fmt.Sprintf("pattern %q already exists", pattern))
+// drop the route names of en
+func (self *routeTable) unname(en Entry) {
+	for k, o := range self.names {
+		if o == en {
+			delete(self.names, k)
+		}
 	}
-	a := NewRegexpEntry(pattern, ps...)
-	dict[pattern] = a
-	return a
+}
+
+func (self *NxHandler) addproc(method, pattern string, ps []NxProcessor) Entry {
+	return self.addEntry(method, self.newEntry(pattern, ps...))
 }
 
 func (self *NxHandler) DoGet(pattern string, ps ...NxProcessor) Entry {
-	return addproc(self.getmap, pattern, ps)
+	return self.addproc("GET", pattern, ps)
 }
 
 func (self *NxHandler) DoPost(pattern string, ps ...NxProcessor) Entry {
-	return addproc(self.postmap, pattern, ps)
+	return self.addproc("POST", pattern, ps)
 }
 
 func (self *NxHandler) DoDelete(pattern string, ps ...NxProcessor) Entry {
-	return addproc(self.delmap, pattern, ps)
+	return self.addproc("DELETE", pattern, ps)
 }
 
 func (self *NxHandler) DoPut(pattern string, ps ...NxProcessor) Entry {
-	return addproc(self.putmap, pattern, ps)
+	return self.addproc("PUT", pattern, ps)
+}
+
+func (self *NxHandler) DoPatch(pattern string, ps ...NxProcessor) Entry {
+	return self.addproc("PATCH", pattern, ps)
+}
+
+// remove the mount of subpath, false if there is none
+func (self *NxHandler) Unmount(subpath string) bool {
+	if !strings.HasSuffix(subpath, "/") {
+		subpath = subpath + "/"
+	}
+	var old *mount
+	self.update(func(t *routeTable) {
+		old = t.mounts[subpath]
+		delete(t.mounts, subpath)
+	})
+	if old == nil {
+		return false
+	}
+	old.close(nil)
+	return true
+}
+
+// serve requests under subpath by handler, with the prefix stripped.
+// processors run in front of handler and see the full path. a mount
+// replaced or removed is closed, with handler if it is a processor
+func (self *NxHandler) Mount(subpath string, handler http.Handler, ps ...NxProcessor) {
+	self.setMount(newMount(mountPath(subpath), handler, ps))
 }
 
-func (self *NxHandler) Mount(subpath string, handler http.Handler) {
+// subpath with a trailing slash, panics if it is empty or /
+func mountPath(subpath string) string {
 	if len(subpath) == 0 || subpath == "/" {
 		log.Panic(fmt.Sprintf("invalid mount path %q", subpath))
 	}
 	if !strings.HasSuffix(subpath, "/") {
 		subpath = subpath + "/"
 	}
-	self.mounts[subpath] = http.StripPrefix(subpath, handler)
+	return subpath
 }
 
-func find(dict map[string]Entry, path string) (Entry, []string) {
-	for _, en := range dict {
-		if params := en.Match(path); params != nil {
-			return en, params
-		}
+// publish m at its path, as given by mountPath. the mount it replaces is
+// closed, with its handler unless m mounts it again
+func (self *NxHandler) setMount(m *mount) {
+	var old *mount
+	self.update(func(t *routeTable) {
+		old = t.mounts[m.path]
+		t.mounts[m.path] = m
+	})
+	if old != nil {
+		old.close(m.handler)
+	}
+}
+
+// entry tables keyed by http method, must not be modified
+func (self *NxHandler) methodmaps() map[string]map[string]Entry {
+	return self.table().entries
+}
+
+func sendJsonError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// wrap request body with size limit, returns false if the declared
+// content length already exceeds the limit and 413 was sent. bodies
+// turning out longer get 413 from the Bind methods, see bodyError
+func limitBody(w http.ResponseWriter, r *http.Request, n int64) bool {
+	if n <= 0 {
+		return true
+	}
+	if r.ContentLength > n {
+		sendJsonError(w, http.StatusRequestEntityTooLarge, "request body too large")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, n)
+	return true
+}
+
+// answer a body cut by limitBody with the same 413 as a declared length
+// over the limit, unless a response is started. err is returned as is
+func (self *NxContext) bodyError(err error) error {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) && self.ResponseStatus() == 0 {
+		sendJsonError(self.res, http.StatusRequestEntityTooLarge, "request body too large")
 	}
-	return nil, nil
+	return err
 }
 
 func (self NxHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := newResponseWriter(w)
+	w = rw
+	r = r.WithContext(context.WithValue(r.Context(), handlerCtxKey{}, &self))
+
+	// cgi local redirects are served again by the handler, they hold the
+	// limiter slot of the request they come from and are counted with it
+	_, redirected := r.Context().Value(cgiRedirectKey{}).(int)
+	metrics := self.metrics
+	if redirected {
+		metrics = nil
+	}
+
+	route := ""
+	if metrics != nil {
+		start := time.Now()
+		defer func() {
+			metrics.observe(route, r.Method, rw, time.Since(start))
+		}()
+	}
+
 	defer func() {
 		if cv := recover(); cv != nil {
-			log.Print("****", cv)
-			log.Print(string(debug.Stack()))
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+			self.recovered(&NxContext{req: r, res: w, datakeys: make([]string, 0)}, cv)
 		}
 	}()
 
+	if l := self.limiter; l != nil && !redirected && !isUpgradeRequest(r) {
+		if !l.acquire(r) {
+			w.Header().Set("Retry-After", l.retryAfter())
+			sendJsonError(w, http.StatusServiceUnavailable, "server busy")
+			return
+		}
+		defer l.release()
+	}
+
 	// match entry & execute
-	var (
-		en   Entry
-		args []string
-	)
-	switch r.Method {
-	case "GET":
-		en, args = find(self.getmap, r.URL.Path)
-	case "POST":
-		en, args = find(self.postmap, r.URL.Path)
-	case "DELETE":
-		en, args = find(self.delmap, r.URL.Path)
-	case "PUT":
-		en, args = find(self.putmap, r.URL.Path)
-	case "OPTIONS":
+	t := self.table()
+	// not for OPTIONS, browsers fail preflights that redirect
+	if r.Method != "OPTIONS" {
+		var ok bool
+		if r, ok = self.fixSlash(t, w, r); !ok {
+			return
+		}
+	}
+	if r.Method == "OPTIONS" {
 		// when do CORS ajax
 		allow := make([]string, 0)
-		if u, _ := find(self.getmap, r.URL.Path); u != nil {
-			allow = append(allow, "GET")
-		}
-		if u, _ := find(self.postmap, r.URL.Path); u != nil {
-			allow = append(allow, "POST")
+		cors := t.cors
+		for _, m := range methods {
+			if u, _ := t.find(m, r.URL.Path); u != nil {
+				allow = append(allow, m)
+				if c := entryCors(u); c != nil && (len(allow) == 1 || m == r.Header.Get("Access-Control-Request-Method")) {
+					cors = c
+				}
+			}
 		}
-		if u, _ := find(self.delmap, r.URL.Path); u != nil {
-			allow = append(allow, "DELETE")
-		}
-		if u, _ := find(self.putmap, r.URL.Path); u != nil {
-			allow = append(allow, "PUT")
-		}
-		if len(allow) > 0 {
-			w.Header().Set("access-control-allow-methods", strings.Join(allow, ","))
-			// TODO: need to check Origin header value
-			w.Header().Set("access-control-allow-origin", r.Header.Get("origin"))
-			w.Header().Set("access-control-max-age", "180")
-			w.Header().Set("access-control-allow-headers", r.Header.Get("access-control-request-headers"))
-			w.WriteHeader(http.StatusOK)
-		} else {
+		if len(allow) == 0 && t.typeMiss(r.Method, r.URL.Path) {
+			w.WriteHeader(http.StatusNotFound)
+		} else if len(allow) == 0 {
 			w.WriteHeader(http.StatusNotImplemented)
+		} else if cors != nil && len(r.Header.Get("Origin")) > 0 {
+			cors.preflight(w, r, allow)
+		} else {
+			w.Header().Set("Allow", strings.Join(append(allow, "OPTIONS"), ","))
+			w.WriteHeader(http.StatusNoContent)
 		}
 		return
 	}
 
-	if en != nil {
-		en.Exec(w, r, args)
+	if en, args := t.find(r.Method, r.URL.Path); en != nil {
+		route = en.Name()
+		if t.cors != nil && entryCors(en) == nil {
+			t.cors.actual(w.Header(), r)
+		}
+		defer metrics.enter(route, r.Method)()
+
+		limit := t.maxbody
+		if n := en.MaxBodySize(); n != 0 {
+			limit = n
+		}
+		if limitBody(w, r, limit) {
+			en.Exec(w, r, args)
+		}
 		return
 	}
 
 	// match subpath
-	for sp, h := range self.mounts {
-		if strings.HasPrefix(r.URL.Path, sp) {
-			h.ServeHTTP(w, r)
-			return
+	if m := t.mount(r.URL.Path); m != nil {
+		route = m.path
+		defer metrics.enter(route, r.Method)()
+		if t.cors != nil {
+			t.cors.actual(w.Header(), r)
 		}
+
+		if limitBody(w, r, t.maxbody) {
+			m.ServeHTTP(w, r)
+		}
+		return
 	}
 
 	// no match
+	if t.typeMiss(r.Method, r.URL.Path) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(http.StatusText(http.StatusNotFound)))
+		return
+	}
 	w.WriteHeader(http.StatusNotImplemented)
 	w.Write([]byte(http.StatusText(http.StatusNotImplemented)))
 }
 
 func NewNxHandler() *NxHandler {
 	r := NxHandler{
-		getmap:  make(map[string]Entry),
-		postmap: make(map[string]Entry),
-		delmap:  make(map[string]Entry),
-		putmap:  make(map[string]Entry),
+		routes: &routeRef{},
 	}
+	r.routes.cur.Store(newRouteTable())
 	return &r
 }
@@ -0,0 +1,45 @@
+//go:build go1.24
+
+package nxhttp
+
+import (
+	"net/http"
+	"time"
+)
+
+/*
+ * http/2 settings of a http.Server serving a handler. with H2C the server
+ * speaks cleartext http/2 to clients with prior knowledge, e.g. grpc
+ * gateways or mesh sidecars behind a proxy terminating tls. websockets
+ * and hijacking handlers, e.g. nph scripts, need http/1.1. built with go
+ * 1.24 or later, for http.Server.HTTP2 and Protocols
+ */
+type HTTP2Options struct {
+	MaxConcurrentStreams int           // per connection, 0 for the default
+	IdleTimeout          time.Duration // of connections, http/1.1 ones too, 0 for none
+	H2C                  bool          // cleartext http/2 besides http/1.1
+}
+
+// apply o to srv, before it serves
+func ConfigureHTTP2(srv *http.Server, o *HTTP2Options) {
+	if o == nil {
+		return
+	}
+	if srv.HTTP2 == nil {
+		srv.HTTP2 = &http.HTTP2Config{}
+	}
+	if o.MaxConcurrentStreams > 0 {
+		srv.HTTP2.MaxConcurrentStreams = o.MaxConcurrentStreams
+	}
+	if o.IdleTimeout > 0 {
+		srv.IdleTimeout = o.IdleTimeout
+	}
+	if o.H2C {
+		if srv.Protocols == nil {
+			srv.Protocols = new(http.Protocols)
+			srv.Protocols.SetHTTP1(true)
+			srv.Protocols.SetHTTP2(true)
+		}
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+}
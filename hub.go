@@ -0,0 +1,280 @@
+package nxhttp
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+ * websocket clients, rooms and broadcasting. every websocket entry has a
+ * hub of its own unless given a shared one, which also lets ordinary
+ * handlers push to connected clients
+ *
+ *	hub := nxhttp.NewHub()
+ *	h.Websocket("/ws/a").SetHub(hub)
+ *	h.Websocket("/ws/b").SetHub(hub)
+ *	h.DoPost("/notify", nxhttp.MakeProcessor(func(ctx *nxhttp.NxContext) {
+ *		hub.BroadcastRoom(ctx.Param("room"), body)
+ *	}))
+ */
+type Hub struct {
+	clients map[*WebsocketClient]bool
+	ids     map[string]*WebsocketClient
+	rooms   map[string]map[*WebsocketClient]bool
+	lock    sync.RWMutex // guards clients, ids, rooms and the backend
+
+	backend BroadcastBackend
+	channel string
+	node    string // tells own broadcasts from those of other nodes
+	unsub   func()
+
+	draining int32 // new connections are refused once set
+	dropped  uint64
+	limited  uint64
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[*WebsocketClient]bool),
+		ids:     make(map[string]*WebsocketClient),
+		rooms:   make(map[string]map[*WebsocketClient]bool),
+	}
+}
+
+func (self *Hub) addClient(cli *WebsocketClient) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.clients[cli] = true
+	self.ids[cli.id] = cli
+}
+
+func (self *Hub) removeClient(cli *WebsocketClient) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, ok := self.clients[cli]; ok {
+		delete(self.clients, cli)
+		delete(self.ids, cli.id)
+	}
+	for room := range cli.rooms {
+		self.leave(cli, room)
+	}
+}
+
+// lock must be held
+func (self *Hub) leave(cli *WebsocketClient, room string) {
+	delete(cli.rooms, room)
+	if members, ok := self.rooms[room]; ok {
+		delete(members, cli)
+		if len(members) == 0 {
+			delete(self.rooms, room)
+		}
+	}
+}
+
+func (self *Hub) Stats() WebsocketStats {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	st := WebsocketStats{
+		Clients: len(self.clients),
+		Dropped: atomic.LoadUint64(&self.dropped),
+
+		RateLimited: atomic.LoadUint64(&self.limited),
+	}
+	for cli := range self.clients {
+		n := cli.QueueLen()
+		st.Queued += n
+		if n > st.MaxQueued {
+			st.MaxQueued = n
+		}
+	}
+	return st
+}
+
+// send a text message to all clients
+func (self *Hub) Broadcast(msg []byte) {
+	self.broadcastRoom("", wsMessage{websocket.TextMessage, msg})
+}
+
+func (self *Hub) BroadcastBinary(data []byte) {
+	self.broadcastRoom("", wsMessage{websocket.BinaryMessage, data})
+}
+
+// send a text message to the clients in room
+func (self *Hub) BroadcastRoom(room string, msg []byte) {
+	self.broadcastRoom(room, wsMessage{websocket.TextMessage, msg})
+}
+
+func (self *Hub) BroadcastRoomBinary(room string, data []byte) {
+	self.broadcastRoom(room, wsMessage{websocket.BinaryMessage, data})
+}
+
+// send a text message to the clients pred is true for. other nodes are
+// not reached, as pred can not travel
+func (self *Hub) BroadcastIf(msg []byte, pred func(cli *WebsocketClient) bool) {
+	self.broadcastIf(wsMessage{websocket.TextMessage, msg}, pred)
+}
+
+func (self *Hub) BroadcastBinaryIf(data []byte, pred func(cli *WebsocketClient) bool) {
+	self.broadcastIf(wsMessage{websocket.BinaryMessage, data}, pred)
+}
+
+func (self *Hub) broadcastIf(msg wsMessage, pred func(cli *WebsocketClient) bool) {
+	// pred runs unlocked, it may well look at rooms or ids
+	var fails []*WebsocketClient
+	for _, cli := range self.Clients() {
+		if !pred(cli) {
+			continue
+		}
+		if _, kill := cli.enqueue(msg); kill {
+			fails = append(fails, cli)
+		}
+	}
+	stopAll(fails)
+}
+
+func (self *Hub) broadcastRoom(room string, msg wsMessage) {
+	self.deliver(room, msg)
+	self.publish(room, msg)
+}
+
+// send msg to local clients in room, or all if room is empty. queueing
+// is done unlocked, blocking clients stop by removing themselves
+func (self *Hub) deliver(room string, msg wsMessage) {
+	self.lock.RLock()
+	set := self.clients
+	if len(room) > 0 {
+		set = self.rooms[room]
+	}
+	clients := make([]*WebsocketClient, 0, len(set))
+	for cli := range set {
+		clients = append(clients, cli)
+	}
+	self.lock.RUnlock()
+	stopAll(sendAll(clients, msg))
+}
+
+// queue msg to clients, returns those to be closed
+func sendAll(clients []*WebsocketClient, msg wsMessage) []*WebsocketClient {
+	var fails []*WebsocketClient
+	for _, cli := range clients {
+		if _, kill := cli.enqueue(msg); kill {
+			fails = append(fails, cli)
+		}
+	}
+	return fails
+}
+
+func stopAll(clients []*WebsocketClient) {
+	for _, c := range clients {
+		c.stop()
+	}
+}
+
+// connected clients
+func (self *Hub) Clients() []*WebsocketClient {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	clients := make([]*WebsocketClient, 0, len(self.clients))
+	for cli := range self.clients {
+		clients = append(clients, cli)
+	}
+	return clients
+}
+
+// client by id, nil if not connected
+func (self *Hub) Client(id string) *WebsocketClient {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.ids[id]
+}
+
+// send a text message to client id, false if it is not connected
+func (self *Hub) SendTo(id string, msg []byte) bool {
+	return self.sendTo(id, wsMessage{websocket.TextMessage, msg})
+}
+
+func (self *Hub) SendBinaryTo(id string, data []byte) bool {
+	return self.sendTo(id, wsMessage{websocket.BinaryMessage, data})
+}
+
+func (self *Hub) sendTo(id string, msg wsMessage) bool {
+	cli := self.Client(id)
+	if cli == nil {
+		return false
+	}
+	ok, kill := cli.enqueue(msg)
+	if kill {
+		cli.stop()
+	}
+	return ok
+}
+
+// rooms with at least one client
+func (self *Hub) Rooms() []string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	rooms := make([]string, 0, len(self.rooms))
+	for r := range self.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (self *Hub) RoomSize(room string) int {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.rooms[room])
+}
+
+// bound of Close waiting for clients to go away
+var WebsocketDrainTimeout = 5 * time.Second
+
+/*
+ * refuse new connections and close clients with CloseGoingAway after
+ * their queued messages are written. waits up to timeout for them, then
+ * drops the rest. returns the number of clients dropped
+ */
+func (self *Hub) Drain(reason string, timeout time.Duration) int {
+	atomic.StoreInt32(&self.draining, 1)
+	return drainClients(self.Clients(), reason, timeout)
+}
+
+func drainClients(clients []*WebsocketClient, reason string, timeout time.Duration) int {
+	for _, c := range clients {
+		c.CloseWith(websocket.CloseGoingAway, reason)
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	expired := false
+	dropped := 0
+	for _, c := range clients {
+		if !expired {
+			select {
+			case <-c.exited:
+				continue
+			case <-t.C:
+				expired = true
+			}
+		}
+		select {
+		case <-c.exited:
+		default:
+			c.stop()
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// drain clients and drop the broadcast backend
+func (self *Hub) Close() {
+	self.unsubscribe()
+	self.Drain("server shutdown", WebsocketDrainTimeout)
+}
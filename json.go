@@ -0,0 +1,347 @@
+package nxhttp
+
+import (
+	"encoding"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type JsonOptions struct {
+	EscapeHTML bool
+	Indent     string
+
+	// layout time.Time values are sent with, RFC 3339 if empty
+	TimeFormat string
+}
+
+// swap in jsoniter, segmentio or alike
+type JsonCodec interface {
+	Encode(w io.Writer, v interface{}, opts *JsonOptions) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+var defaultJsonOptions = JsonOptions{EscapeHTML: true}
+
+/* encoding/json codec */
+type stdJsonCodec struct{}
+
+func (self stdJsonCodec) Encode(w io.Writer, v interface{}, opts *JsonOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(opts.EscapeHTML)
+	if len(opts.Indent) > 0 {
+		enc.SetIndent("", opts.Indent)
+	}
+	if len(opts.TimeFormat) > 0 {
+		v = formatTimes(v, opts.TimeFormat)
+	}
+	return enc.Encode(v)
+}
+
+func (self stdJsonCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+var StdJsonCodec JsonCodec = stdJsonCodec{}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	emptyInterface    = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+/*
+ * time formatting of the std codec. values are copied into mirror types,
+ * made by reflect.StructOf, having string fields in place of time.Time
+ * ones and the original types everywhere else. encoding/json does the
+ * rest as usual, marshalers, tags and omitempty included. types that
+ * marshal themselves and non-empty interfaces are kept as they are
+ */
+type jsonMirror struct {
+	typ     reflect.Type
+	changed bool // typ differs, values must be converted
+	dynamic bool // typ is interface{}, values are mirrored by their type
+	elem    *jsonMirror
+	fields  []int         // of structs, source field of each mirror field
+	subs    []*jsonMirror // of the mirror fields
+}
+
+var jsonMirrors sync.Map // reflect.Type -> *jsonMirror
+
+var (
+	unchangedMirror = &jsonMirror{}
+	dynamicMirror   = &jsonMirror{typ: emptyInterface, changed: true, dynamic: true}
+	timeMirror      = &jsonMirror{typ: reflect.TypeOf(""), changed: true}
+)
+
+func keepsEncoding(t reflect.Type) bool {
+	if t.Implements(marshalerType) || t.Implements(textMarshalerType) {
+		return true
+	}
+	if t.Kind() != reflect.Ptr {
+		p := reflect.PointerTo(t)
+		return p.Implements(marshalerType) || p.Implements(textMarshalerType)
+	}
+	return false
+}
+
+// mirror of t, busy are the types being mirrored, cycles go through
+// interface{}
+func mirrorOf(t reflect.Type, busy map[reflect.Type]bool) *jsonMirror {
+	if m, ok := jsonMirrors.Load(t); ok {
+		return m.(*jsonMirror)
+	}
+	if t == timeType {
+		return timeMirror
+	}
+	if keepsEncoding(t) {
+		return unchangedMirror
+	}
+	if busy[t] {
+		return dynamicMirror
+	}
+	if busy == nil {
+		busy = make(map[reflect.Type]bool)
+	}
+	busy[t] = true
+	defer delete(busy, t)
+
+	m := unchangedMirror
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		if e := mirrorOf(t.Elem(), busy); e.changed {
+			m = &jsonMirror{changed: true, elem: e}
+			switch t.Kind() {
+			case reflect.Ptr:
+				m.typ = reflect.PointerTo(e.typ)
+			case reflect.Slice:
+				m.typ = reflect.SliceOf(e.typ)
+			case reflect.Array:
+				m.typ = reflect.ArrayOf(t.Len(), e.typ)
+			case reflect.Map:
+				m.typ = reflect.MapOf(t.Key(), e.typ)
+			}
+		}
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			m = dynamicMirror
+		}
+	case reflect.Struct:
+		m = mirrorStruct(t, busy, false)
+	}
+	actual, _ := jsonMirrors.LoadOrStore(t, m)
+	return actual.(*jsonMirror)
+}
+
+// with force the mirror type is made even if nothing changes, to embed
+// it without the methods of t
+func mirrorStruct(t reflect.Type, busy map[reflect.Type]bool, force bool) *jsonMirror {
+	busy[t] = true
+	defer delete(busy, t)
+
+	m := &jsonMirror{}
+	sfs := make([]reflect.StructField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		if f.Anonymous && len(name) == 0 && ft.Kind() == reflect.Struct {
+			// flattened by encoding/json
+			if busy[ft] {
+				// embedded in itself, its fields are shadowed
+				continue
+			}
+			e := mirrorStruct(ft, busy, true)
+			typ := e.typ
+			if f.Type.Kind() == reflect.Ptr {
+				typ = reflect.PointerTo(typ)
+			}
+			m.changed = m.changed || e.changed
+			sfs = append(sfs, reflect.StructField{Name: "Embedded" + strconv.Itoa(i), Type: typ, Tag: f.Tag, Anonymous: true})
+			m.fields = append(m.fields, i)
+			m.subs = append(m.subs, e)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		e := mirrorOf(f.Type, busy)
+		sf := reflect.StructField{Name: f.Name, Type: f.Type, Tag: f.Tag}
+		if e.changed {
+			m.changed = true
+			sf.Type = e.typ
+			sf.Tag = withoutStringOption(f.Tag)
+		}
+		sfs = append(sfs, sf)
+		m.fields = append(m.fields, i)
+		m.subs = append(m.subs, e)
+	}
+	if !m.changed && !force {
+		return unchangedMirror
+	}
+	m.typ = reflect.StructOf(sfs)
+	return m
+}
+
+// the string option quotes scalars, times are strings already
+func withoutStringOption(tag reflect.StructTag) reflect.StructTag {
+	v, ok := tag.Lookup("json")
+	if !ok {
+		return tag
+	}
+	opts := strings.Split(v, ",")
+	for i := len(opts) - 1; i > 0; i-- {
+		if opts[i] == "string" {
+			opts = append(opts[:i], opts[i+1:]...)
+		}
+	}
+	return reflect.StructTag(strings.Replace(string(tag), `json:"`+v+`"`, `json:"`+strings.Join(opts, ",")+`"`, 1))
+}
+
+// v converted to the type of m, times formatted by layout
+func convertTimes(v reflect.Value, m *jsonMirror, layout string) reflect.Value {
+	if !m.changed {
+		return v
+	}
+	if m.dynamic {
+		out := reflect.New(emptyInterface).Elem()
+		if v.Kind() == reflect.Interface {
+			if v.IsNil() {
+				return out
+			}
+			v = v.Elem()
+		}
+		out.Set(convertTimes(v, mirrorOf(v.Type(), nil), layout))
+		return out
+	}
+	if v.Type() == timeType {
+		return reflect.ValueOf(v.Interface().(time.Time).Format(layout))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return reflect.Zero(m.typ)
+		}
+		p := reflect.New(m.typ.Elem())
+		p.Elem().Set(convertTimes(v.Elem(), m.elem, layout))
+		return p
+	case reflect.Slice, reflect.Array:
+		var out reflect.Value
+		if v.Kind() == reflect.Slice {
+			if v.IsNil() {
+				return reflect.Zero(m.typ)
+			}
+			out = reflect.MakeSlice(m.typ, v.Len(), v.Len())
+		} else {
+			out = reflect.New(m.typ).Elem()
+		}
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(convertTimes(v.Index(i), m.elem, layout))
+		}
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(m.typ)
+		}
+		out := reflect.MakeMapWithSize(m.typ, v.Len())
+		for it := v.MapRange(); it.Next(); {
+			out.SetMapIndex(it.Key(), convertTimes(it.Value(), m.elem, layout))
+		}
+		return out
+	case reflect.Struct:
+		out := reflect.New(m.typ).Elem()
+		convertFields(out, v, m, layout)
+		return out
+	}
+	return v
+}
+
+// fields of the struct v into dst of its mirror m, embedded ones are
+// copied field by field as they may be unexported
+func convertFields(dst, v reflect.Value, m *jsonMirror, layout string) {
+	for j, i := range m.fields {
+		fv, sub := v.Field(i), m.subs[j]
+		if !m.typ.Field(j).Anonymous {
+			dst.Field(j).Set(convertTimes(fv, sub, layout))
+			continue
+		}
+		d := dst.Field(j)
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			d.Set(reflect.New(sub.typ))
+			d, fv = d.Elem(), fv.Elem()
+		}
+		convertFields(d, fv, sub, layout)
+	}
+}
+
+// v with times formatted by layout
+func formatTimes(v interface{}, layout string) interface{} {
+	if v == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	return convertTimes(rv, mirrorOf(rv.Type(), nil), layout).Interface()
+}
+
+// json encoding for all entries, nil restores the defaults
+func (self *NxHandler) SetJsonOptions(opts *JsonOptions) *NxHandler {
+	self.jsonopts = opts
+	return self
+}
+
+func (self *NxHandler) SetJsonCodec(c JsonCodec) *NxHandler {
+	self.jsoncodec = c
+	return self
+}
+
+func (self *NxContext) jsonCodec() (JsonCodec, JsonOptions) {
+	codec, opts := StdJsonCodec, defaultJsonOptions
+	if h := self.handler(); h != nil {
+		if h.jsoncodec != nil {
+			codec = h.jsoncodec
+		}
+		if h.jsonopts != nil {
+			opts = *h.jsonopts
+		}
+	}
+	return codec, opts
+}
+
+func (self *NxContext) sendJson(o interface{}, opts *JsonOptions, codec JsonCodec) *NxContext {
+	self.res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	self.writeStatus()
+	if err := codec.Encode(self.res, o, opts); err != nil {
+		panic(err)
+	}
+	return self
+}
+
+func (self *NxContext) SendAsJsonIndent(o interface{}, indent string) *NxContext {
+	codec, opts := self.jsonCodec()
+	opts.Indent = indent
+	return self.sendJson(o, &opts, codec)
+}
+
+// decode json request body into v. a body over the size limit is
+// answered with 413 and its error returned
+func (self *NxContext) BindJson(v interface{}) error {
+	codec, _ := self.jsonCodec()
+	return self.bodyError(codec.Decode(self.req.Body, v))
+}
@@ -0,0 +1,72 @@
+package nxhttp
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * handler-wide concurrency limit. up to max requests are served at once,
+ * up to queue more wait for a slot as long as wait. the others are shed
+ * with 503 and Retry-After, so a saturated server answers fast instead
+ * of piling up forks and database connections. upgrades, e.g. websockets,
+ * are not counted, they would hold slots for the life of the connection
+ */
+type limiter struct {
+	slots   chan struct{}
+	queue   int32
+	waiting int32
+	wait    time.Duration
+}
+
+// serve at most max requests at once, with up to queue requests waiting
+// at most wait for one to finish. max <= 0 removes the limit
+func (self *NxHandler) SetConcurrencyLimit(max, queue int, wait time.Duration) *NxHandler {
+	if max <= 0 {
+		self.limiter = nil
+		return self
+	}
+	self.limiter = &limiter{
+		slots: make(chan struct{}, max),
+		queue: int32(queue),
+		wait:  wait,
+	}
+	return self
+}
+
+// take a slot, false if the queue is full, the wait is over or the
+// client gave up
+func (self *limiter) acquire(r *http.Request) bool {
+	select {
+	case self.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	defer atomic.AddInt32(&self.waiting, -1)
+	if atomic.AddInt32(&self.waiting, 1) > self.queue || self.wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(self.wait)
+	defer t.Stop()
+	select {
+	case self.slots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (self *limiter) release() {
+	<-self.slots
+}
+
+// seconds to wait before retrying, at least 1
+func (self *limiter) retryAfter() string {
+	return strconv.Itoa(int(math.Max(1, math.Ceil(self.wait.Seconds()))))
+}
@@ -0,0 +1,30 @@
+package nxhttp
+
+import (
+	"log/slog"
+)
+
+// logger for ctx.Logger, nil uses slog.Default()
+func (self *NxHandler) SetLogger(l *slog.Logger) *NxHandler {
+	self.logger = l
+	return self
+}
+
+// structured logger of the request, with request id, route, method and
+// client ip attached
+func (self *NxContext) Logger() *slog.Logger {
+	l := slog.Default()
+	if h := self.handler(); h != nil && h.logger != nil {
+		l = h.logger
+	}
+
+	attrs := make([]interface{}, 0, 8)
+	if id := self.RequestID(); len(id) > 0 {
+		attrs = append(attrs, "request_id", id)
+	}
+	if self.entry != nil {
+		attrs = append(attrs, "route", self.entry.Name())
+	}
+	attrs = append(attrs, "method", self.req.Method, "client_ip", self.ClientIP())
+	return l.With(attrs...)
+}
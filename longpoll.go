@@ -0,0 +1,371 @@
+package nxhttp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// timing defaults of long-poll clients
+const (
+	LongPollTimeout     = 25 * time.Second // a poll answers empty after this
+	LongPollIdleTimeout = 60 * time.Second // clients not polling for this are dropped
+)
+
+/*
+ * long-poll fallback of websockets, for clients behind proxies that do
+ * not pass upgrades. its clients are WebsocketClients without a Conn, so
+ * the callbacks, Hub, rooms and broadcasts are the ones of websockets
+ *
+ *	GET  pattern            connect, answers {"token": "..."}
+ *	GET  pattern?token=t    wait for messages, answers a json array
+ *	POST pattern?token=t    send the body as a message, binary if it is
+ *	                        application/octet-stream
+ *	DELETE pattern?token=t  disconnect
+ *
+ * polled messages are {"type": "text", "data": "..."}, {"type": "binary",
+ * "data": "<base64>"} or a last {"type": "close", "code": 1001, "reason":
+ * "..."}. unknown or expired tokens get 404 and have to connect again.
+ * processors given to LongPoll guard connecting only, the token stands
+ * for them afterwards
+ */
+type longPoll struct {
+	ws      *WebsocketProcessor // callbacks, hub and queue settings
+	timeout time.Duration
+	idle    time.Duration
+
+	lock    sync.Mutex
+	clients map[string]*longPollClient // by token
+}
+
+type longPollClient struct {
+	*WebsocketClient
+	token string
+	recv  sync.Mutex // messages are handed to callbacks one at a time
+
+	polls int32 // polls in progress
+	last  int64 // unix nano of the end of the last poll
+}
+
+type longPollMessage struct {
+	Type   string `json:"type"`
+	Data   string `json:"data,omitempty"`
+	Code   int    `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+func (self *longPoll) client(ctx *NxContext) *longPollClient {
+	token := ctx.req.URL.Query().Get("token")
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.clients[token]
+}
+
+func (self *longPoll) connect(ctx *NxContext) {
+	w := self.ws
+	if atomic.LoadInt32(&w.draining) != 0 || atomic.LoadInt32(&w.hub.draining) != 0 {
+		ctx.End(http.StatusServiceUnavailable)
+		return
+	}
+
+	c := &longPollClient{
+		WebsocketClient: w.newClient(ctx, nil, false),
+		token:           newUUID(),
+		last:            time.Now().UnixNano(),
+	}
+	self.lock.Lock()
+	self.clients[c.token] = c
+	self.lock.Unlock()
+
+	if w.callbacks != nil && w.callbacks.OnConnect != nil {
+		w.callbacks.OnConnect(c.WebsocketClient)
+	}
+	go self.watch(c)
+
+	ctx.SetHeader("Cache-Control", "no-store")
+	ctx.SendAsJson(map[string]string{"token": c.token})
+}
+
+// drop the client when it stops polling or does not come back for its
+// close message
+func (self *longPoll) watch(c *longPollClient) {
+	defer func() {
+		c.stop()
+		self.lock.Lock()
+		delete(self.clients, c.token)
+		self.lock.Unlock()
+		close(c.exited)
+	}()
+
+	var tick <-chan time.Time
+	if self.idle > 0 {
+		t := time.NewTicker(self.idle / 4)
+		defer t.Stop()
+		tick = t.C
+	}
+	closing := c.closing
+	var expire <-chan time.Time
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-closing:
+			closing = nil
+			t := time.NewTimer(c.closeWait())
+			defer t.Stop()
+			expire = t.C
+		case <-expire:
+			return
+		case <-tick:
+			last := time.Unix(0, atomic.LoadInt64(&c.last))
+			if atomic.LoadInt32(&c.polls) == 0 && time.Since(last) > self.idle {
+				return
+			}
+		}
+	}
+}
+
+// wait up to the poll timeout for a message, then answer it with what
+// else is queued. a closing client gets its close message and is gone
+func (self *longPoll) poll(ctx *NxContext, c *longPollClient) {
+	atomic.AddInt32(&c.polls, 1)
+	defer func() {
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+		atomic.AddInt32(&c.polls, -1)
+	}()
+
+	t := time.NewTimer(self.timeout)
+	defer t.Stop()
+	msgs := []longPollMessage{}
+	select {
+	case m := <-c.send:
+		msgs = append(msgs, c.sent(m))
+	case <-c.closing:
+	case <-c.done:
+	case <-t.C:
+	case <-ctx.req.Context().Done():
+		return
+	}
+
+queued:
+	for {
+		select {
+		case m := <-c.send:
+			msgs = append(msgs, c.sent(m))
+		default:
+			break queued
+		}
+	}
+	if c.isClosing() {
+		if c.closeMsg != nil {
+			msgs = append(msgs, longPollMessage{Type: "close", Code: c.closeCode, Reason: c.closeReason})
+		}
+		c.stop()
+	}
+
+	ctx.SetHeader("Cache-Control", "no-store")
+	ctx.SendAsJson(msgs)
+}
+
+func (self *longPollClient) sent(m wsMessage) longPollMessage {
+	self.metrics.sent(len(m.data))
+	if m.typ == websocket.BinaryMessage {
+		return longPollMessage{Type: "binary", Data: base64.StdEncoding.EncodeToString(m.data)}
+	}
+	return longPollMessage{Type: "text", Data: string(m.data)}
+}
+
+// a message posted by the client, under the read and rate limits of
+// websockets
+func (self *longPoll) receive(ctx *NxContext, c *longPollClient) {
+	body := io.Reader(ctx.req.Body)
+	if limit := self.ws.readLimit; limit > 0 {
+		body = io.LimitReader(body, limit+1)
+	}
+	msg, err := io.ReadAll(body)
+	if err != nil {
+		ctx.End(http.StatusBadRequest)
+		return
+	}
+	if limit := self.ws.readLimit; limit > 0 && int64(len(msg)) > limit {
+		c.fail("read", ErrWebsocketTooBig)
+		ctx.End(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	typ := websocket.TextMessage
+	if strings.HasPrefix(ctx.req.Header.Get("Content-Type"), "application/octet-stream") {
+		typ = websocket.BinaryMessage
+	}
+
+	c.recv.Lock()
+	defer c.recv.Unlock()
+	c.metrics.received(len(msg))
+	if c.isClosing() {
+		ctx.End(http.StatusGone)
+		return
+	}
+	if !c.allow(msg) {
+		if !c.rateLimited(msg) {
+			c.fail("read", ErrWebsocketRateLimited)
+			c.CloseWith(websocket.ClosePolicyViolation, "rate limit exceeded")
+		}
+		ctx.End(http.StatusTooManyRequests)
+		return
+	}
+	c.dispatch(typ, msg)
+	ctx.End(http.StatusNoContent)
+}
+
+// connects and polls, sitting at the end of the GET entry
+type LongPollProcessor struct {
+	DefaultProcessor
+	lp *longPoll
+}
+
+func (self *LongPollProcessor) Process(ctx *NxContext) {
+	if len(ctx.req.URL.Query().Get("token")) == 0 {
+		self.lp.connect(ctx)
+		return
+	}
+	c := self.lp.client(ctx)
+	if c == nil {
+		ctx.End(http.StatusNotFound)
+		return
+	}
+	self.lp.poll(ctx, c)
+}
+
+func (self *LongPollProcessor) Close() {
+	self.lp.ws.Close()
+	self.DefaultProcessor.Close()
+}
+
+// messages and disconnects of clients, on the POST and DELETE entries
+type longPollPostProcessor struct {
+	DefaultProcessor
+	lp *longPoll
+}
+
+func (self *longPollPostProcessor) Process(ctx *NxContext) {
+	c := self.lp.client(ctx)
+	if c == nil {
+		ctx.End(http.StatusNotFound)
+		return
+	}
+	if ctx.req.Method == "DELETE" {
+		c.close(websocket.CloseNormalClosure, "", false)
+		c.stop()
+		ctx.End(http.StatusNoContent)
+		return
+	}
+	self.lp.receive(ctx, c)
+}
+
+type LongPollEntry struct {
+	RegexpEntry
+	lp *longPoll
+}
+
+func (self *LongPollEntry) SetCallback(c *WebsocketCallback) *LongPollEntry {
+	self.lp.ws.callbacks = c
+	return self
+}
+
+// share hub with websocket entries, to be called before serving
+func (self *LongPollEntry) SetHub(hub *Hub) *LongPollEntry {
+	self.lp.ws.hub = hub
+	self.lp.ws.ownHub = false
+	return self
+}
+
+func (self *LongPollEntry) Hub() *Hub {
+	return self.lp.ws.hub
+}
+
+// polls answer empty after poll, clients not polling for idle are
+// dropped, 0 keeps them
+func (self *LongPollEntry) SetTimeouts(poll, idle time.Duration) *LongPollEntry {
+	self.lp.timeout = poll
+	self.lp.idle = idle
+	return self
+}
+
+// see WSEntry.SetSendQueue, messages wait here between polls
+func (self *LongPollEntry) SetSendQueue(size int, overflow int) *LongPollEntry {
+	self.lp.ws.queue = size
+	self.lp.ws.overflow = overflow
+	return self
+}
+
+// refuse posted messages larger than n bytes, 0 for no limit
+func (self *LongPollEntry) SetReadLimit(n int64) *LongPollEntry {
+	self.lp.ws.readLimit = n
+	return self
+}
+
+// see WSEntry.SetRateLimit
+func (self *LongPollEntry) SetRateLimit(msgs, bytes float64) *LongPollEntry {
+	self.lp.ws.msgRate = msgs
+	self.lp.ws.byteRate = bytes
+	return self
+}
+
+func (self *LongPollEntry) Stats() WebsocketStats {
+	return self.Hub().Stats()
+}
+
+func (self *LongPollEntry) Broadcast(msg []byte) {
+	self.Hub().Broadcast(msg)
+}
+
+func (self *LongPollEntry) BroadcastRoom(room string, msg []byte) {
+	self.Hub().BroadcastRoom(room, msg)
+}
+
+func (self *LongPollEntry) Clients() []*WebsocketClient {
+	return self.Hub().Clients()
+}
+
+/*
+ * long-poll on pattern, GET with ps and the LongPollProcessor, POST and
+ * DELETE for messages and disconnects. give it the hub of a websocket
+ * entry to serve the same clients both ways
+ *
+ *	ws := h.Websocket("/ws").SetCallback(cbs)
+ *	h.LongPoll("/poll", auth).SetCallback(cbs).SetHub(ws.Hub())
+ */
+func (self *NxHandler) LongPoll(pattern string, ps ...NxProcessor) *LongPollEntry {
+	for _, m := range []string{"GET", "POST", "DELETE"} {
+		if _, ok := self.table().entries[m][pattern]; ok {
+			panic(fmt.Sprintf("pattern %q exists", pattern))
+		}
+	}
+
+	lp := &longPoll{
+		ws:      newWebsocketProcessor(),
+		timeout: LongPollTimeout,
+		idle:    LongPollIdleTimeout,
+		clients: make(map[string]*longPollClient),
+	}
+	p := &LongPollProcessor{DefaultProcessor: DefaultProcessor{name: "long-poll"}, lp: lp}
+	en := &LongPollEntry{
+		RegexpEntry: *self.newEntry(pattern, append(ps, p)...),
+		lp:          lp,
+	}
+	self.addEntry("GET", en)
+	for _, m := range []string{"POST", "DELETE"} {
+		self.addEntry(m, self.newEntry(pattern, &longPollPostProcessor{
+			DefaultProcessor: DefaultProcessor{name: "long-poll"},
+			lp:               lp,
+		}))
+	}
+	return en
+}
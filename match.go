@@ -0,0 +1,165 @@
+package nxhttp
+
+import (
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+/*
+ * per method route matcher, compiled when the route table is published.
+ * anchored literal patterns, /users with SetAnchored or a route without
+ * params, are found by a map lookup. other anchored patterns with a
+ * literal first segment, ^/orders/(\d+)$, are only tried for paths of
+ * that segment, the rest for every path. exact literals win, otherwise
+ * the first matching entry in registration order
+ */
+type matcher struct {
+	order   []string               // patterns in registration order
+	routes  map[string]*matchRoute // by pattern
+	literal map[string]Entry       // by exact path
+	groups  map[string][]*matchRoute
+	any     []*matchRoute
+}
+
+type matchRoute struct {
+	en      Entry
+	seq     int
+	literal string // exact path, if the pattern is an anchored literal
+	segment string // first path segment of anchored patterns, if literal
+}
+
+var noParams = []string{}
+
+// analyse the pattern of en, only regexp entries are known to match
+// their source
+func newMatchRoute(en Entry) *matchRoute {
+	r := &matchRoute{en: en}
+	if _, ok := en.(interface{ source() string }); !ok {
+		return r
+	}
+	re, err := syntax.Parse(entrySource(en), syntax.Perl)
+	if err != nil {
+		return r
+	}
+	re = re.Simplify()
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	if len(subs) < 2 || subs[0].Op != syntax.OpBeginText {
+		return r
+	}
+
+	prefix := ""
+	i := 1
+	if subs[i].Op == syntax.OpLiteral && subs[i].Flags&syntax.FoldCase == 0 {
+		prefix = string(subs[i].Rune)
+		i++
+	}
+	if i == len(subs)-1 && subs[i].Op == syntax.OpEndText {
+		r.literal = prefix
+	} else if strings.HasPrefix(prefix, "/") {
+		if n := strings.IndexByte(prefix[1:], '/'); n >= 0 {
+			r.segment = prefix[1 : n+1]
+		}
+	}
+	return r
+}
+
+// first segment of path, users of /users/1
+func firstSegment(path string) string {
+	if len(path) == 0 || path[0] != '/' {
+		return ""
+	}
+	path = path[1:]
+	if n := strings.IndexByte(path, '/'); n >= 0 {
+		return path[:n]
+	}
+	return path
+}
+
+// build the matcher of dict, keeping the order of prev for the patterns
+// still in dict. new patterns come last, sorted if several
+func compileMatcher(dict map[string]Entry, prev *matcher) *matcher {
+	m := &matcher{
+		order:   make([]string, 0, len(dict)),
+		routes:  make(map[string]*matchRoute, len(dict)),
+		literal: make(map[string]Entry),
+		groups:  make(map[string][]*matchRoute),
+		any:     make([]*matchRoute, 0),
+	}
+
+	seen := make(map[string]bool, len(dict))
+	if prev != nil {
+		for _, k := range prev.order {
+			if _, ok := dict[k]; ok {
+				m.order = append(m.order, k)
+				seen[k] = true
+			}
+		}
+	}
+	added := make([]string, 0)
+	for k := range dict {
+		if !seen[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	m.order = append(m.order, added...)
+
+	for i, k := range m.order {
+		en := dict[k]
+		var r *matchRoute
+		if prev != nil {
+			if o := prev.routes[k]; o != nil && o.en == en {
+				c := *o
+				r = &c
+			}
+		}
+		if r == nil {
+			r = newMatchRoute(en)
+		}
+		r.seq = i
+		m.routes[k] = r
+
+		switch {
+		case len(r.literal) > 0:
+			if _, ok := m.literal[r.literal]; !ok {
+				m.literal[r.literal] = en
+			}
+		case len(r.segment) > 0:
+			m.groups[r.segment] = append(m.groups[r.segment], r)
+		default:
+			m.any = append(m.any, r)
+		}
+	}
+	return m
+}
+
+func (self *matcher) find(path string) (Entry, []string) {
+	if self == nil {
+		return nil, nil
+	}
+	if en, ok := self.literal[path]; ok {
+		return en, noParams
+	}
+
+	// merge the segment group and the others by registration order
+	group := self.groups[firstSegment(path)]
+	i, j := 0, 0
+	for i < len(group) || j < len(self.any) {
+		var r *matchRoute
+		if j == len(self.any) || (i < len(group) && group[i].seq < self.any[j].seq) {
+			r = group[i]
+			i++
+		} else {
+			r = self.any[j]
+			j++
+		}
+		if params := r.en.Match(path); params != nil {
+			return r.en, params
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,277 @@
+package nxhttp
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+/*
+ * prometheus metrics
+ * requests are labeled by route (entry pattern, mount path or empty
+ * when nothing matched), method and status
+ */
+type Metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	inflight *prometheus.GaugeVec
+	latency  *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+
+	// websockets, by route
+	wsClients     *prometheus.GaugeVec
+	wsMessages    *prometheus.CounterVec // and direction
+	wsBytes       *prometheus.CounterVec // and direction
+	wsDropped     *prometheus.CounterVec
+	wsDisconnects *prometheus.CounterVec // and reason
+
+	// cgi scripts, by route
+	cgiRunning  *prometheus.GaugeVec
+	cgiDuration *prometheus.HistogramVec // and exit
+	cgiTimeouts *prometheus.CounterVec
+	cgiStderr   *prometheus.CounterVec
+}
+
+// registry of the metrics, to register application collectors
+func (self *Metrics) Registry() *prometheus.Registry {
+	return self.registry
+}
+
+// exposition handler
+func (self *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(self.registry, promhttp.HandlerOpts{})
+}
+
+// count request in flight, returns func to call when it is done
+func (self *Metrics) enter(route, method string) func() {
+	if self == nil {
+		return func() {}
+	}
+	g := self.inflight.WithLabelValues(route, method)
+	g.Inc()
+	return g.Dec
+}
+
+func (self *Metrics) observe(route, method string, w *responseWriter, d time.Duration) {
+	if self == nil {
+		return
+	}
+	status := strconv.Itoa(w.Status())
+	self.requests.WithLabelValues(route, method, status).Inc()
+	self.latency.WithLabelValues(route, method, status).Observe(d.Seconds())
+	self.size.WithLabelValues(route, method, status).Observe(float64(w.size))
+}
+
+func NewMetrics(namespace string) *Metrics {
+	labels := []string{"route", "method", "status"}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Number of handled requests.",
+		}, labels),
+		inflight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "requests_in_flight",
+			Help:      "Number of requests being handled.",
+		}, labels[:2]),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Request handling latency.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "response_size_bytes",
+			Help:      "Response body size.",
+			Buckets:   prometheus.ExponentialBuckets(100, 10, 7),
+		}, labels),
+	}
+	m.wsClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "websocket_clients",
+		Help:      "Number of connected websocket clients.",
+	}, []string{"route"})
+	m.wsMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_messages_total",
+		Help:      "Websocket messages received (in) and written (out).",
+	}, []string{"route", "direction"})
+	m.wsBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_message_bytes_total",
+		Help:      "Websocket message payload bytes received (in) and written (out).",
+	}, []string{"route", "direction"})
+	m.wsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_dropped_messages_total",
+		Help:      "Websocket messages not queued, for full queues or closed clients.",
+	}, []string{"route"})
+	m.wsDisconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "websocket_disconnects_total",
+		Help:      "Websocket disconnects by close reason.",
+	}, []string{"route", "reason"})
+
+	m.cgiRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cgi_running",
+		Help:      "Number of running cgi scripts.",
+	}, []string{"route"})
+	m.cgiDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cgi_duration_seconds",
+		Help:      "Cgi script run time by exit code, signal for killed scripts and error for those not started.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "exit"})
+	m.cgiTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cgi_timeouts_total",
+		Help:      "Cgi scripts killed for taking too long.",
+	}, []string{"route"})
+	m.cgiStderr = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cgi_stderr_bytes_total",
+		Help:      "Bytes cgi scripts wrote to stderr.",
+	}, []string{"route"})
+
+	m.registry.MustRegister(
+		m.requests, m.inflight, m.latency, m.size,
+		m.wsClients, m.wsMessages, m.wsBytes, m.wsDropped, m.wsDisconnects,
+		m.cgiRunning, m.cgiDuration, m.cgiTimeouts, m.cgiStderr,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// instrument all requests with m and expose it at path, e.g. "/metrics"
+func (self *NxHandler) EnableMetrics(path string, m *Metrics) Entry {
+	self.metrics = m
+	h := m.Handler()
+	return self.DoGet("^"+regexp.QuoteMeta(path)+"$", MakeProcessor(func(ctx *NxContext) {
+		h.ServeHTTP(ctx.Res(), ctx.Req())
+	}))
+}
+
+/* websocket metrics of one route, nil if metrics are off */
+type wsMetrics struct {
+	clients     prometheus.Gauge
+	inMsgs      prometheus.Counter
+	outMsgs     prometheus.Counter
+	inBytes     prometheus.Counter
+	outBytes    prometheus.Counter
+	dropped     prometheus.Counter
+	disconnects *prometheus.CounterVec
+}
+
+func (self *Metrics) websocket(route string) *wsMetrics {
+	if self == nil {
+		return nil
+	}
+	return &wsMetrics{
+		clients:     self.wsClients.WithLabelValues(route),
+		inMsgs:      self.wsMessages.WithLabelValues(route, "in"),
+		outMsgs:     self.wsMessages.WithLabelValues(route, "out"),
+		inBytes:     self.wsBytes.WithLabelValues(route, "in"),
+		outBytes:    self.wsBytes.WithLabelValues(route, "out"),
+		dropped:     self.wsDropped.WithLabelValues(route),
+		disconnects: self.wsDisconnects.MustCurryWith(prometheus.Labels{"route": route}),
+	}
+}
+
+func (self *wsMetrics) received(n int) {
+	if self != nil {
+		self.inMsgs.Inc()
+		self.inBytes.Add(float64(n))
+	}
+}
+
+func (self *wsMetrics) sent(n int) {
+	if self != nil {
+		self.outMsgs.Inc()
+		self.outBytes.Add(float64(n))
+	}
+}
+
+func (self *wsMetrics) drop() {
+	if self != nil {
+		self.dropped.Inc()
+	}
+}
+
+func (self *wsMetrics) connected() {
+	if self != nil {
+		self.clients.Inc()
+	}
+}
+
+func (self *wsMetrics) disconnected(code int) {
+	if self != nil {
+		self.clients.Dec()
+		self.disconnects.WithLabelValues(closeReason(code)).Inc()
+	}
+}
+
+// label of a close code, application codes are "other" to bound the
+// label values
+func closeReason(code int) string {
+	switch code {
+	case websocket.CloseNormalClosure, websocket.CloseNoStatusReceived:
+		return "normal"
+	case websocket.CloseGoingAway:
+		return "going_away"
+	case websocket.CloseAbnormalClosure:
+		return "abnormal"
+	case websocket.CloseProtocolError, websocket.CloseUnsupportedData, websocket.CloseInvalidFramePayloadData:
+		return "protocol_error"
+	case websocket.ClosePolicyViolation:
+		return "policy_violation"
+	case websocket.CloseMessageTooBig:
+		return "too_big"
+	case websocket.CloseInternalServerErr:
+		return "server_error"
+	}
+	return "other"
+}
+
+/* cgi metrics of one route, nil if metrics are off */
+type cgiMetrics struct {
+	route string
+	m     *Metrics
+}
+
+func (self *Metrics) cgi(route string) *cgiMetrics {
+	if self == nil {
+		return nil
+	}
+	return &cgiMetrics{route: route, m: self}
+}
+
+func (self *cgiMetrics) started() {
+	if self != nil {
+		self.m.cgiRunning.WithLabelValues(self.route).Inc()
+	}
+}
+
+func (self *cgiMetrics) finished(exit string, d time.Duration, stderr int64, timeout bool) {
+	if self == nil {
+		return
+	}
+	self.m.cgiRunning.WithLabelValues(self.route).Dec()
+	self.m.cgiDuration.WithLabelValues(self.route, exit).Observe(d.Seconds())
+	if stderr > 0 {
+		self.m.cgiStderr.WithLabelValues(self.route).Add(float64(stderr))
+	}
+	if timeout {
+		self.m.cgiTimeouts.WithLabelValues(self.route).Inc()
+	}
+}
@@ -0,0 +1,104 @@
+package nxhttp
+
+import (
+	"io/fs"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+/* mounted handler */
+type mount struct {
+	path    string
+	handler http.Handler // as given to Mount
+	strip   http.Handler
+	entry   Entry // running the processors, nil if none
+}
+
+func (self *mount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if self.entry != nil {
+		self.entry.Exec(w, r, nil)
+	} else {
+		self.strip.ServeHTTP(w, r)
+	}
+}
+
+// close the processors, and the handler if it is one, e.g. a proxy,
+// unless it is mounted again as keep
+func (self *mount) close(keep http.Handler) {
+	if self.entry != nil {
+		self.entry.Close()
+	}
+	if p, ok := self.handler.(NxProcessor); ok && keep != self.handler {
+		p.Close()
+	}
+}
+
+func newMount(path string, handler http.Handler, ps []NxProcessor) *mount {
+	m := &mount{
+		path:    path,
+		handler: handler,
+		strip:   http.StripPrefix(path, handler),
+	}
+	if len(ps) > 0 {
+		en := &BaseEntry{
+			name: path,
+			data: make(map[string]interface{}),
+		}
+		en.Use(append(ps, MakeProcessor(func(ctx *NxContext) {
+			m.strip.ServeHTTP(ctx.res, ctx.req)
+		}))...)
+		m.entry = en
+	}
+	return m
+}
+
+// serve the files of fsys under subpath, e.g. an embed.FS, so binaries
+// can ship their assets. use fs.Sub to serve a directory of it
+func (self *NxHandler) MountFS(subpath string, fsys fs.FS, ps ...NxProcessor) {
+	self.Mount(subpath, http.FileServerFS(fsys), ps...)
+}
+
+// mount with the longest path prefixing path, nil if none
+func (self *routeTable) mount(path string) *mount {
+	var best *mount
+	for sp, m := range self.mounts {
+		if strings.HasPrefix(path, sp) && (best == nil || len(sp) > len(best.path)) {
+			best = m
+		}
+	}
+	return best
+}
+
+type MountInfo struct {
+	Path       string
+	Handler    http.Handler
+	Processors []string
+}
+
+// mount table in match order, longest path first
+func (self *NxHandler) Mounts() []MountInfo {
+	ms := make([]MountInfo, 0)
+	for _, m := range self.table().mounts {
+		mi := MountInfo{
+			Path:       m.path,
+			Handler:    m.handler,
+			Processors: make([]string, 0),
+		}
+		if m.entry != nil {
+			for p := m.entry.Processor(); p != nil; p = p.getnext() {
+				mi.Processors = append(mi.Processors, p.Name())
+			}
+			// last one calls the handler
+			mi.Processors = mi.Processors[:len(mi.Processors)-1]
+		}
+		ms = append(ms, mi)
+	}
+	sort.Slice(ms, func(i, j int) bool {
+		if len(ms[i].Path) != len(ms[j].Path) {
+			return len(ms[i].Path) > len(ms[j].Path)
+		}
+		return ms[i].Path < ms[j].Path
+	})
+	return ms
+}
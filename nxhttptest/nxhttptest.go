@@ -0,0 +1,125 @@
+// utilities for testing nxhttp processors and entries without a server
+package nxhttptest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pumingjohnray/nxhttp"
+)
+
+// build a request, body is a string, []byte, io.Reader or nil. any
+// other value is sent as json
+func NewRequest(method, url string, body interface{}) *http.Request {
+	var rd io.Reader
+	isjson := false
+	switch b := body.(type) {
+	case nil:
+	case string:
+		rd = strings.NewReader(b)
+	case []byte:
+		rd = bytes.NewReader(b)
+	case io.Reader:
+		rd = b
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			panic(err)
+		}
+		rd = bytes.NewReader(data)
+		isjson = true
+	}
+
+	r := httptest.NewRequest(method, url, rd)
+	if isjson {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return r
+}
+
+// context recording its response, params are the url params
+func NewTestContext(method, url string, body interface{}, params ...string) (*nxhttp.NxContext, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	return nxhttp.NewContext(w, NewRequest(method, url, body), params...), w
+}
+
+// run p and its chained processors with ctx
+func RunProcessor(ctx *nxhttp.NxContext, p nxhttp.NxProcessor) {
+	ctx.Run(p)
+}
+
+// execute en as if routed to it, the url params are taken from matching
+// the request path. 404 is recorded if en does not match
+func RunEntry(en nxhttp.Entry, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	params := en.Match(r.URL.Path)
+	if params == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return w
+	}
+	en.Exec(w, r, params)
+	return w
+}
+
+// serve r with a handler, e.g. a whole NxHandler
+func Serve(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+/*
+ * assertions
+ */
+func AssertStatus(t testing.TB, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("status %d, want %d", w.Code, status)
+	}
+}
+
+func AssertHeader(t testing.TB, w *httptest.ResponseRecorder, key, val string) {
+	t.Helper()
+	if v := w.Header().Get(key); v != val {
+		t.Errorf("header %s %q, want %q", key, v, val)
+	}
+}
+
+func AssertBody(t testing.TB, w *httptest.ResponseRecorder, body string) {
+	t.Helper()
+	if b := w.Body.String(); b != body {
+		t.Errorf("body %q, want %q", b, body)
+	}
+}
+
+func AssertBodyContains(t testing.TB, w *httptest.ResponseRecorder, sub string) {
+	t.Helper()
+	if b := w.Body.String(); !strings.Contains(b, sub) {
+		t.Errorf("body %q does not contain %q", b, sub)
+	}
+}
+
+// compare the json body with v after a round trip through json, so
+// structs, maps and literals compare alike
+func AssertJson(t testing.TB, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	var got, want interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Errorf("invalid json body %q: %v", w.Body.String(), err)
+		return
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("can not encode %v: %v", v, err)
+	}
+	json.Unmarshal(data, &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("json body %s, want %s", strings.TrimSpace(w.Body.String()), data)
+	}
+}
@@ -0,0 +1,369 @@
+package nxhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type RouteDoc struct {
+	Summary     string
+	Description string
+	Tags        []string
+	OperationID string
+	Deprecated  bool
+
+	// names of the pattern captures in order, named groups and
+	// param1, param2... are used for missing ones
+	Params []string
+
+	// query parameter name -> description
+	Query map[string]string
+
+	// request body model, e.g. User{}
+	Request interface{}
+
+	// response models by status, nil model for no body
+	Responses map[int]interface{}
+}
+
+// OpenAPI 3 spec of all routes, those whose pattern has no OpenAPI path
+// are left out
+func (self *NxHandler) OpenAPISpec(title, version string) ([]byte, error) {
+	gen := &schemaGen{comps: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+
+	for method, dict := range self.methodmaps() {
+		for _, en := range dict {
+			doc := en.Doc()
+			if doc == nil {
+				doc = &RouteDoc{}
+			}
+			path, params, err := pathTemplate(entrySource(en), doc.Params)
+			if err == errNoTemplate {
+				// not in the spec rather than with a made up path
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if paths[path] == nil {
+				paths[path] = make(map[string]interface{})
+			}
+			paths[path][strings.ToLower(method)] = gen.operation(params, entryParamTypes(en), doc)
+		}
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   title,
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": gen.comps,
+		},
+	}, "", "  ")
+}
+
+// serve the spec at path and, if ui is set, Swagger UI at path/ui
+func (self *NxHandler) EnableOpenAPI(path, title, version string, ui bool) {
+	self.DoGet("^"+regexp.QuoteMeta(path)+"$", MakeProcessor(func(ctx *NxContext) {
+		b, err := self.OpenAPISpec(title, version)
+		if err != nil {
+			panic(err)
+		}
+		ctx.res.Header().Set("Content-Type", "application/json; charset=utf-8")
+		ctx.SendBytes(b)
+	}))
+	if ui {
+		self.DoGet("^"+regexp.QuoteMeta(path)+"/ui/?$", MakeProcessor(func(ctx *NxContext) {
+			ctx.res.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintf(ctx.res, swaggerPage, html.EscapeString(title), path)
+		}))
+	}
+}
+
+// types of the params of en, by position, nil unless it is a RouteEntry
+func entryParamTypes(en Entry) []string {
+	if r, ok := en.(*RouteEntry); ok {
+		return r.types
+	}
+	return nil
+}
+
+// schema of a path param of a route.go type
+func paramSchema(typ string) map[string]interface{} {
+	switch typ {
+	case "int":
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case "uint":
+		return map[string]interface{}{"type": "integer", "format": "int64", "minimum": 0}
+	case "uuid":
+		return map[string]interface{}{"type": "string", "format": "uuid"}
+	}
+	return map[string]interface{}{"type": "string"}
+}
+
+func (self *schemaGen) operation(params, types []string, doc *RouteDoc) map[string]interface{} {
+	op := map[string]interface{}{}
+	if len(doc.Summary) > 0 {
+		op["summary"] = doc.Summary
+	}
+	if len(doc.Description) > 0 {
+		op["description"] = doc.Description
+	}
+	if len(doc.Tags) > 0 {
+		op["tags"] = doc.Tags
+	}
+	if len(doc.OperationID) > 0 {
+		op["operationId"] = doc.OperationID
+	}
+	if doc.Deprecated {
+		op["deprecated"] = true
+	}
+
+	ps := make([]interface{}, 0)
+	for i, p := range params {
+		typ := ""
+		if i < len(types) {
+			typ = types[i]
+		}
+		ps = append(ps, map[string]interface{}{
+			"name":     p,
+			"in":       "path",
+			"required": true,
+			"schema":   paramSchema(typ),
+		})
+	}
+	qs := make([]string, 0, len(doc.Query))
+	for q := range doc.Query {
+		qs = append(qs, q)
+	}
+	sort.Strings(qs)
+	for _, q := range qs {
+		ps = append(ps, map[string]interface{}{
+			"name":        q,
+			"in":          "query",
+			"description": doc.Query[q],
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	if len(ps) > 0 {
+		op["parameters"] = ps
+	}
+
+	if doc.Request != nil {
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": self.schema(reflect.TypeOf(doc.Request)),
+				},
+			},
+		}
+	}
+
+	res := make(map[string]interface{})
+	for status, model := range doc.Responses {
+		r := map[string]interface{}{"description": http.StatusText(status)}
+		if model != nil {
+			r["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": self.schema(reflect.TypeOf(model)),
+				},
+			}
+		}
+		res[strconv.Itoa(status)] = r
+	}
+	if len(res) == 0 {
+		res["default"] = map[string]interface{}{"description": "response"}
+	}
+	op["responses"] = res
+	return op
+}
+
+// patterns matching paths no OpenAPI path describes, e.g. /files/\d+
+var errNoTemplate = errors.New("pattern can not be templated")
+
+// convert an entry pattern to an OpenAPI path, captures become {name},
+// those of optional parts too. other optional parts are left out
+func pathTemplate(pattern string, names []string) (string, []string, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	params := make([]string, 0)
+	var sb strings.Builder
+	var walk func(*syntax.Regexp) bool
+	walk = func(re *syntax.Regexp) bool {
+		switch re.Op {
+		case syntax.OpCapture:
+			if hasCapture(re.Sub[0]) {
+				// nested, the outer one is no path param
+				return false
+			}
+			name := re.Name
+			if re.Cap-1 < len(names) {
+				name = names[re.Cap-1]
+			}
+			if len(name) == 0 {
+				name = fmt.Sprintf("param%d", re.Cap)
+			}
+			params = append(params, name)
+			sb.WriteString("{" + name + "}")
+		case syntax.OpConcat:
+			for _, s := range re.Sub {
+				if !walk(s) {
+					return false
+				}
+			}
+		case syntax.OpLiteral:
+			sb.WriteString(string(re.Rune))
+		case syntax.OpQuest:
+			if hasCapture(re) {
+				return walk(re.Sub[0])
+			}
+		case syntax.OpStar, syntax.OpPlus:
+			// neither repeated captures nor unnamed wildcards are a path
+			// param, leaving them out would document another path
+			return false
+		case syntax.OpBeginText, syntax.OpEndText, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpEmptyMatch:
+		default:
+			return false
+		}
+		return true
+	}
+	if !walk(re.Simplify()) {
+		return "", nil, errNoTemplate
+	}
+	return sb.String(), params, nil
+}
+
+func hasCapture(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpCapture {
+		return true
+	}
+	for _, s := range re.Sub {
+		if hasCapture(s) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * json schema of go types
+ */
+type schemaGen struct {
+	comps map[string]interface{}
+}
+
+func (self *schemaGen) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32:
+		return map[string]interface{}{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": self.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": self.schema(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) == 0 {
+			return self.object(t)
+		}
+		if _, ok := self.comps[t.Name()]; !ok {
+			self.comps[t.Name()] = nil // guard recursion
+			self.comps[t.Name()] = self.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func (self *schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	self.fields(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (self *schemaGen) fields(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && len(name) == 0 {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				self.fields(ft, props)
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+
+		s := self.schema(f.Type)
+		if d := f.Tag.Get("doc"); len(d) > 0 {
+			if _, ref := s["$ref"]; ref {
+				s = map[string]interface{}{"allOf": []interface{}{s}}
+			}
+			s["description"] = d
+		}
+		props[name] = s
+	}
+}
+
+const swaggerPage = `<!DOCTYPE html>
+<html>
+<head>
+<title>%s</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist/swagger-ui.css" />
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist/swagger-ui-bundle.js"></script>
+<script>
+window.ui = SwaggerUIBundle({url: %q, dom_id: '#swagger-ui'});
+</script>
+</body>
+</html>
+`
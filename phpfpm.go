@@ -0,0 +1,122 @@
+package nxhttp
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * php scripts under a document root run by php-fpm, or any fastcgi server
+ * taking SCRIPT_FILENAME. /prefix/a/b.php/more runs root/a/b.php with
+ * PATH_INFO /more, a directory runs its index file. other paths go to the
+ * front controller if there is one, like try_files $uri $uri/ /index.php
+ * does for nginx. only .php files are run, other files are not served
+ */
+type PhpFpmProcessor struct {
+	FastCgiProcessor
+	prefix string // with the trailing slash
+	root   string
+	index  string
+	front  string // url path under prefix, empty for none
+}
+
+// the script for the request path p, its url path and path info
+func (self *PhpFpmProcessor) lookup(p string) (script, name, info string, err error) {
+	if script, name, info, _, err = lookupScript(self.root, self.prefix, p); err == nil {
+		return
+	}
+	if len(self.index) > 0 {
+		if script, name, _, _, err = lookupScript(self.root, self.prefix, path.Join(p, self.index)); err == nil {
+			return script, name, "", nil
+		}
+	}
+	if len(self.front) > 0 {
+		if script, name, _, _, err = lookupScript(self.root, self.prefix, self.prefix+self.front); err == nil {
+			return script, name, "", nil
+		}
+	}
+	return "", "", "", os.ErrNotExist
+}
+
+func (self *PhpFpmProcessor) Process(ctx *NxContext) {
+	script, name, info, err := self.lookup(ctx.Req().URL.Path)
+	if err != nil || !strings.EqualFold(filepath.Ext(script), ".php") {
+		ctx.End(http.StatusNotFound)
+		return
+	}
+
+	root, _ := filepath.Abs(self.root)
+	if abs, err := filepath.Abs(script); err == nil {
+		script = abs
+	}
+	env := cgiEnv(ctx, self.envs, name, info)
+	env = append(env,
+		"SCRIPT_FILENAME="+script,
+		"DOCUMENT_ROOT="+root,
+	)
+	if len(info) > 0 {
+		env = append(env, "PATH_TRANSLATED="+filepath.Join(root, filepath.FromSlash(info)))
+	}
+	self.serve(ctx, env)
+}
+
+// the file run for directories, "index.php" by default, empty for none
+func (self *PhpFpmProcessor) SetIndex(name string) *PhpFpmProcessor {
+	self.index = name
+	return self
+}
+
+// run script, e.g. "index.php", for paths not having one of their own.
+// the original path is left in REQUEST_URI
+func (self *PhpFpmProcessor) SetFrontController(script string) *PhpFpmProcessor {
+	self.front = strings.TrimPrefix(script, "/")
+	return self
+}
+
+func (self *PhpFpmProcessor) Validate() error {
+	fi, err := os.Stat(self.root)
+	if err == nil && !fi.IsDir() {
+		err = fmt.Errorf("%s is not a directory", self.root)
+	}
+	if err != nil {
+		return err
+	}
+	return self.FastCgiProcessor.Validate()
+}
+
+// network and addr of php-fpm as for net.Dial, e.g. "unix",
+// "/run/php/php-fpm.sock"
+func NewPhpFpmProcessor(prefix, docroot, network, addr string) *PhpFpmProcessor {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	p := &PhpFpmProcessor{
+		prefix: prefix,
+		root:   docroot,
+		index:  "index.php",
+	}
+	p.init("php-fpm", network, addr)
+	return p
+}
+
+/*
+ * serve the php scripts under docroot at prefix for any method, behind
+ * ps. docroot has to be the same for php-fpm
+ *
+ *	h.PhpFpm("/app/", "/var/www/app/public", "unix", "/run/php/php-fpm.sock").
+ *		SetFrontController("index.php")
+ */
+func (self *NxHandler) PhpFpm(prefix, docroot, network, addr string, ps ...NxProcessor) *PhpFpmProcessor {
+	p := NewPhpFpmProcessor(mountPath(prefix), docroot, network, addr)
+	en := &BaseEntry{
+		name: p.prefix,
+		data: make(map[string]interface{}),
+	}
+	en.Use(append(ps, p)...)
+	self.setMount(&mount{path: p.prefix, entry: en})
+	return p
+}
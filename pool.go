@@ -0,0 +1,58 @@
+package nxhttp
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+/*
+ * buffers shared by the cgi, fastcgi, scgi and websocket paths, so busy
+ * gateways do not allocate them per request
+ */
+
+// size of the copy buffers
+const copyBufferSize = 32 * 1024
+
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	},
+}
+
+// io.Copy with a pooled buffer
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+var bufReaders = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, 4096)
+	},
+}
+
+// pooled reader of r, to be given back by putBufReader when done
+func getBufReader(r io.Reader) *bufio.Reader {
+	br := bufReaders.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
+func putBufReader(br *bufio.Reader) {
+	br.Reset(nil)
+	bufReaders.Put(br)
+}
+
+// websocket write buffer pools, one per buffer size as the connections
+// take the pooled buffers as they are
+var wsWritePools sync.Map
+
+func websocketWritePool(size int) websocket.BufferPool {
+	p, _ := wsWritePools.LoadOrStore(size, &sync.Pool{})
+	return p.(*sync.Pool)
+}
@@ -2,8 +2,11 @@ package nxhttp
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
+
+	"go.opentelemetry.io/otel/codes"
 )
 
 type NxProcessor interface {
@@ -55,7 +58,7 @@ func (self *DefaultProcessor) SetTimeout(i int) NxProcessor {
 // append next processor to tail
 func (self *DefaultProcessor) Then(p NxProcessor) NxProcessor {
 	if self.next != nil {
-		log.Panicf("aleady has next processor ", self, self.next)
+		log.Panic(fmt.Sprintf("processor %q already has next processor %q", self.name, self.next.Name()))
 	}
 	self.next = p
 	return p
@@ -107,11 +110,9 @@ func MakeProcessor(fs ...func(*NxContext)) NxProcessor {
  * builtin processors
  */
 
+// access log in combined format to the standard logger's output
 func NewLoggingProc() NxProcessor {
-	return MakeProcessor(func(ctx *NxContext) {
-		log.Printf("[%s] %q", ctx.Req().Method, ctx.Req().URL.Path)
-		ctx.RunNext()
-	})
+	return NewAccessLogProcessor(log.Writer(), CombinedLogFormat)
 }
 
 func NoCacheProc() NxProcessor {
@@ -122,34 +123,111 @@ func NoCacheProc() NxProcessor {
 	})
 }
 
-// database transaction begin/commit processor
+/*
+ * database transaction processor, the transaction is begun with the
+ * request context and committed when the chain completed without panic
+ * or 5xx status, rolled back otherwise. without commit it is always
+ * rolled back, e.g. for dry runs. handlers get it by ctx.Tx, or by
+ * ctx.TxNamed for a named one, e.g. of a second database
+ */
 type DbTx struct {
 	DefaultProcessor
 	db     *sql.DB
 	commit bool
+	opts   sql.TxOptions
+	name   string
+	qlog   *QueryLog
 }
 
 func (self *DbTx) Process(ctx *NxContext) {
-	if tx, e := self.db.Begin(); e != nil {
-		log.Print(e)
-		ctx.End(http.StatusInternalServerError)
-	} else {
+	c, span := ctx.StartSpan("db transaction")
+	defer span.End()
+
+	if self.qlog != nil {
+		r := ctx.req
+		c = withQueryLog(c, ctx, self.qlog)
+		ctx.req = r.WithContext(c)
 		defer func() {
-			if self.commit {
-				tx.Commit()
-			} else {
-				tx.Rollback()
-			}
+			ctx.req = r
 		}()
-		ctx.PutData("_dbtx", tx).RunNext()
 	}
+
+	tx, e := self.db.BeginTx(c, &self.opts)
+	if e != nil {
+		span.RecordError(e)
+		span.SetStatus(codes.Error, e.Error())
+		ctx.Logger().Error("db begin", "error", e)
+		ctx.End(http.StatusInternalServerError)
+		return
+	}
+
+	completed := false
+	defer func() {
+		if !self.commit || !completed || ctx.ResponseStatus() >= 500 || ctx.status >= 500 {
+			span.AddEvent("rollback")
+			tx.Rollback()
+			return
+		}
+		span.AddEvent("commit")
+		if e := tx.Commit(); e != nil {
+			span.RecordError(e)
+			span.SetStatus(codes.Error, e.Error())
+			ctx.Logger().Error("db commit", "error", e)
+			if ctx.ResponseStatus() == 0 {
+				ctx.End(http.StatusInternalServerError)
+			}
+		}
+	}()
+	ctx.PutData(dbTxKey(self.name), tx).RunNext()
+	completed = true
 }
 
-func NewDbTx(db *sql.DB, commit bool) *DbTx {
+// isolation level of the transactions, the driver's default if not set
+func (self *DbTx) SetIsolation(level sql.IsolationLevel) *DbTx {
+	self.opts.Isolation = level
+	return self
+}
+
+func (self *DbTx) SetReadOnly(ro bool) *DbTx {
+	self.opts.ReadOnly = ro
+	return self
+}
+
+// logs and traces the statements of the transaction and of the request
+// context, the database must be opened by OpenTracedDB
+func (self *DbTx) SetQueryLog(q *QueryLog) *DbTx {
+	self.qlog = q
+	return self
+}
+
+// name is optional, for ctx.TxNamed
+func NewDbTx(db *sql.DB, commit bool, name ...string) *DbTx {
 	p := &DbTx{
-		DefaultProcessor{name: "dbtransx"},
-		db,
-		commit,
+		DefaultProcessor: DefaultProcessor{name: "dbtransx"},
+		db:               db,
+		commit:           commit,
+	}
+	if len(name) > 0 {
+		p.name = name[0]
 	}
 	return p
 }
+
+// data key of the transaction, "_dbtx" for the unnamed one
+func dbTxKey(name string) string {
+	if len(name) == 0 {
+		return "_dbtx"
+	}
+	return "_dbtx:" + name
+}
+
+// the transaction of the unnamed DbTx, nil outside of one
+func (self *NxContext) Tx() *sql.Tx {
+	return self.TxNamed("")
+}
+
+// the transaction of the DbTx named name, nil outside of one
+func (self *NxContext) TxNamed(name string) *sql.Tx {
+	tx, _ := GetDataAs[*sql.Tx](self, dbTxKey(name))
+	return tx
+}
@@ -0,0 +1,125 @@
+package nxhttp
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+/* protobuf codec, values must be proto.Message */
+type protoCodec struct{}
+
+func (self protoCodec) Encode(w io.Writer, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (self protoCodec) Decode(r io.Reader, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a proto.Message", v)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(b, m)
+}
+
+// the offer the Accept header prefers, offers[0] if it has no preference
+// and "" if none is acceptable
+func (self *NxContext) Accepts(offers ...string) string {
+	accept := self.req.Header.Values("Accept")
+	if len(offers) == 0 {
+		return ""
+	}
+	if len(accept) == 0 {
+		return offers[0]
+	}
+
+	type rng struct {
+		mt string
+		q  float64
+	}
+	rngs := make([]rng, 0)
+	for _, s := range splitList(accept) {
+		mt, params, err := mime.ParseMediaType(s)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		rngs = append(rngs, rng{mt, q})
+	}
+	// stable, more specific ranges first for equal q
+	sort.SliceStable(rngs, func(i, j int) bool {
+		if rngs[i].q != rngs[j].q {
+			return rngs[i].q > rngs[j].q
+		}
+		return strings.Count(rngs[i].mt, "*") < strings.Count(rngs[j].mt, "*")
+	})
+
+	for _, r := range rngs {
+		if r.q <= 0 {
+			continue
+		}
+		for _, o := range offers {
+			if r.mt == o || r.mt == "*/*" ||
+				(strings.HasSuffix(r.mt, "/*") && strings.HasPrefix(o, strings.TrimSuffix(r.mt, "*"))) {
+				return o
+			}
+		}
+	}
+	return ""
+}
+
+// send msg as protobuf or, negotiated by Accept, as json
+func (self *NxContext) SendAsProto(msg proto.Message) *NxContext {
+	switch self.Accepts("application/json", "application/x-protobuf", "application/protobuf") {
+	case "application/x-protobuf", "application/protobuf":
+		return self.SendAs("application/x-protobuf", msg)
+	}
+	b, err := protojson.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	self.res.Header().Set("Content-Type", "application/json; charset=utf-8")
+	return self.SendBytes(b)
+}
+
+// decode a protobuf or json request body into msg
+func (self *NxContext) BindProto(msg proto.Message) error {
+	mt, _, _ := mime.ParseMediaType(self.req.Header.Get("Content-Type"))
+	switch mt {
+	case "application/x-protobuf", "application/protobuf":
+		return self.bodyError(protoCodec{}.Decode(self.req.Body, msg))
+	case "application/json", "":
+		b, err := io.ReadAll(self.req.Body)
+		if err != nil {
+			return self.bodyError(err)
+		}
+		return protojson.Unmarshal(b, msg)
+	}
+	return fmt.Errorf("unsupported content type %q", mt)
+}
+
+func init() {
+	RegisterCodec("application/x-protobuf", protoCodec{})
+	RegisterCodec("application/protobuf", protoCodec{})
+}
@@ -0,0 +1,238 @@
+package nxhttp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type ProxyOptions struct {
+	// removed from the request path before it is joined to the target path
+	StripPrefix string
+
+	// rewrite the outgoing path, applied after StripPrefix
+	PathRewrite func(ctx *NxContext, path string) string
+
+	// keep the client's Host header instead of the target host
+	PreserveHost bool
+
+	// defaults to http.DefaultTransport
+	Transport http.RoundTripper
+
+	// flush interval of streamed responses, negative flushes immediately
+	FlushInterval time.Duration
+
+	// optional breaker guarding the upstream
+	Breaker *CircuitBreaker
+
+	// extra attempts on other backends when an idempotent request without
+	// body fails to connect
+	Retries int
+}
+
+// request context key of the current proxy call
+type proxyCtxKey struct{}
+
+type proxyCall struct {
+	ctx     *NxContext
+	backend *Backend
+	err     error
+}
+
+/*
+ * reverse proxy processor
+ */
+type ProxyProcessor struct {
+	DefaultProcessor
+	pool  *ProxyPool
+	opts  ProxyOptions
+	proxy *httputil.ReverseProxy
+}
+
+func (self *ProxyProcessor) Process(ctx *NxContext) {
+	if b := self.opts.Breaker; b != nil && !b.Allow() {
+		ctx.End(http.StatusServiceUnavailable)
+		ctx.res.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		return
+	}
+
+	c, span := ctx.StartSpan("proxy")
+	defer span.End()
+
+	// upgraded connections are tunneled by the reverse proxy for as long as
+	// both ends keep them open, so the timeout does not apply to them
+	upgrade := isUpgradeRequest(ctx.req)
+	if upgrade {
+		span.SetAttributes(attribute.String("proxy.upgrade", ctx.req.Header.Get("Upgrade")))
+	}
+
+	if self.GetTimeout() > 0 && !upgrade {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, time.Duration(self.GetTimeout())*time.Millisecond)
+		defer cancel()
+	}
+
+	tries := 1
+	if isIdempotent(ctx.req.Method) && (ctx.req.Body == nil || ctx.req.Body == http.NoBody || ctx.req.ContentLength == 0) {
+		tries += self.opts.Retries
+	}
+
+	var err error = errNoBackend
+	exclude := make(map[*Backend]bool)
+	for i := 0; i < tries; i++ {
+		b := self.pool.pick(exclude)
+		if b == nil {
+			break
+		}
+		span.SetAttributes(attribute.String("proxy.target", b.url.String()))
+
+		call := &proxyCall{ctx: ctx, backend: b}
+		atomic.AddInt64(&b.active, 1)
+		self.proxy.ServeHTTP(ctx.res, ctx.req.WithContext(context.WithValue(c, proxyCtxKey{}, call)))
+		atomic.AddInt64(&b.active, -1)
+
+		if err = call.err; err == nil {
+			self.pool.report(b, ctx.ResponseStatus() < 500)
+			break
+		}
+		self.pool.report(b, false)
+		exclude[b] = true
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+	}
+
+	if err != nil {
+		ctx.Logger().Error("proxy", "error", err)
+		switch {
+		case errors.Is(err, context.Canceled):
+			// client is gone
+		case errors.Is(err, context.DeadlineExceeded):
+			ctx.res.WriteHeader(http.StatusGatewayTimeout)
+			ctx.res.Write([]byte(http.StatusText(http.StatusGatewayTimeout)))
+		case err == errNoBackend:
+			ctx.res.WriteHeader(http.StatusServiceUnavailable)
+			ctx.res.Write([]byte(http.StatusText(http.StatusServiceUnavailable)))
+		default:
+			ctx.res.WriteHeader(http.StatusBadGateway)
+			ctx.res.Write([]byte(http.StatusText(http.StatusBadGateway)))
+		}
+	}
+
+	if status := ctx.ResponseStatus(); err != nil || status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+		if b := self.opts.Breaker; b != nil {
+			b.Failure()
+		}
+		ctx.stopped = true
+		return
+	} else if b := self.opts.Breaker; b != nil {
+		b.Success()
+	}
+	ctx.RunNext()
+}
+
+var errNoBackend = errors.New("no available backend")
+
+// e.g. websocket handshake
+func isUpgradeRequest(r *http.Request) bool {
+	if len(r.Header.Get("Upgrade")) == 0 {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (self *ProxyProcessor) rewrite(pr *httputil.ProxyRequest) {
+	call := pr.In.Context().Value(proxyCtxKey{}).(*proxyCall)
+
+	path := pr.In.URL.Path
+	if len(self.opts.StripPrefix) > 0 {
+		path = strings.TrimPrefix(path, self.opts.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if self.opts.PathRewrite != nil {
+		path = self.opts.PathRewrite(call.ctx, path)
+	}
+	pr.Out.URL.Path = path
+	pr.Out.URL.RawPath = ""
+
+	pr.SetURL(call.backend.url)
+	pr.SetXForwarded()
+	if self.opts.PreserveHost {
+		pr.Out.Host = pr.In.Host
+	}
+
+	// continue the request trace upstream
+	propagation.TraceContext{}.Inject(pr.Out.Context(), propagation.HeaderCarrier(pr.Out.Header))
+}
+
+// upstream could not be reached, the response is left to Process
+func (self *ProxyProcessor) onerror(w http.ResponseWriter, r *http.Request, err error) {
+	r.Context().Value(proxyCtxKey{}).(*proxyCall).err = err
+}
+
+// proxy as plain http.Handler, e.g. for NxHandler.Mount
+func (self *ProxyProcessor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.Process(&NxContext{
+		req:      r,
+		res:      newResponseWriter(w),
+		datakeys: make([]string, 0),
+	})
+}
+
+func (self *ProxyProcessor) Pool() *ProxyPool {
+	return self.pool
+}
+
+func (self *ProxyProcessor) Close() {
+	self.pool.Close()
+	self.DefaultProcessor.Close()
+}
+
+// proxy to a single upstream
+func NewProxyProcessor(target string, opts *ProxyOptions) *ProxyProcessor {
+	return NewPoolProxyProcessor(NewProxyPool(BalanceRoundRobin, target), opts)
+}
+
+// proxy to backends of the pool
+func NewPoolProxyProcessor(pool *ProxyPool, opts *ProxyOptions) *ProxyProcessor {
+	p := &ProxyProcessor{
+		DefaultProcessor: DefaultProcessor{name: "proxy"},
+		pool:             pool,
+	}
+	if opts != nil {
+		p.opts = *opts
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite:       p.rewrite,
+		Transport:     p.opts.Transport,
+		FlushInterval: p.opts.FlushInterval,
+		ErrorHandler:  p.onerror,
+	}
+	return p
+}
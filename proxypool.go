@@ -0,0 +1,226 @@
+package nxhttp
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// balancing policies
+const (
+	BalanceRoundRobin = iota
+	BalanceLeastConn
+	BalanceWeighted
+)
+
+type Backend struct {
+	url     *url.URL
+	weight  int
+	active  int64 // requests in flight
+	healthy int32 // set by health checks, 1 if healthy
+	fails   int   // consecutive failures
+	ejected time.Time
+	cweight int // smooth weighted round robin state
+}
+
+func (self *Backend) URL() *url.URL {
+	return self.url
+}
+
+func (self *Backend) Weight() int {
+	return self.weight
+}
+
+func (self *Backend) Active() int64 {
+	return atomic.LoadInt64(&self.active)
+}
+
+func (self *Backend) Healthy() bool {
+	return atomic.LoadInt32(&self.healthy) == 1
+}
+
+/*
+ * upstream pool for the proxy processor
+ */
+type ProxyPool struct {
+	lock       sync.Mutex
+	backends   []*Backend
+	policy     int
+	rr         int
+	ejectAfter int
+	ejectFor   time.Duration
+	stop       chan struct{}
+}
+
+func (self *ProxyPool) AddBackend(target string, weight int) *ProxyPool {
+	u, err := url.Parse(target)
+	if err != nil {
+		log.Panicf("invalid backend %q: %v", target, err)
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+
+	// websocket targets are dialed as http, the handshake upgrades them
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.backends = append(self.backends, &Backend{
+		url:     u,
+		weight:  weight,
+		healthy: 1,
+	})
+	return self
+}
+
+func (self *ProxyPool) Backends() []*Backend {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return append([]*Backend(nil), self.backends...)
+}
+
+// eject a backend for the given period after n consecutive failures
+// (connection errors or 5xx). n <= 0 disables ejection
+func (self *ProxyPool) SetEjection(n int, period time.Duration) *ProxyPool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ejectAfter = n
+	self.ejectFor = period
+	return self
+}
+
+// pick an available backend not in exclude, nil if there is none
+func (self *ProxyPool) pick(exclude map[*Backend]bool) *Backend {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	now := time.Now()
+	cands := make([]*Backend, 0, len(self.backends))
+	for _, b := range self.backends {
+		if !exclude[b] && b.Healthy() && !now.Before(b.ejected) {
+			cands = append(cands, b)
+		}
+	}
+	if len(cands) == 0 {
+		return nil
+	}
+
+	switch self.policy {
+	case BalanceLeastConn:
+		best := cands[0]
+		for _, b := range cands[1:] {
+			if b.Active() < best.Active() {
+				best = b
+			}
+		}
+		return best
+	case BalanceWeighted:
+		var best *Backend
+		total := 0
+		for _, b := range cands {
+			b.cweight += b.weight
+			total += b.weight
+			if best == nil || b.cweight > best.cweight {
+				best = b
+			}
+		}
+		best.cweight -= total
+		return best
+	default:
+		self.rr++
+		return cands[self.rr%len(cands)]
+	}
+}
+
+func (self *ProxyPool) report(b *Backend, ok bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if ok {
+		b.fails = 0
+		return
+	}
+	b.fails++
+	if self.ejectAfter > 0 && b.fails >= self.ejectAfter {
+		log.Printf("proxy backend %s ejected for %s", b.url, self.ejectFor)
+		b.ejected = time.Now().Add(self.ejectFor)
+		b.fails = 0
+	}
+}
+
+// probe path on every backend each interval, backends answering with
+// an error or non 2xx/3xx status are taken out until they recover
+func (self *ProxyPool) StartHealthCheck(path string, interval, timeout time.Duration) *ProxyPool {
+	self.lock.Lock()
+	if self.stop != nil {
+		close(self.stop)
+	}
+	stop := make(chan struct{})
+	self.stop = stop
+	self.lock.Unlock()
+
+	client := &http.Client{Timeout: timeout}
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			for _, b := range self.Backends() {
+				go self.probe(client, b, path)
+			}
+			select {
+			case <-stop:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return self
+}
+
+func (self *ProxyPool) probe(client *http.Client, b *Backend, path string) {
+	u := *b.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+
+	healthy := int32(0)
+	if res, err := client.Get(u.String()); err == nil {
+		res.Body.Close()
+		if res.StatusCode < 400 {
+			healthy = 1
+		}
+	}
+	if atomic.SwapInt32(&b.healthy, healthy) != healthy {
+		log.Printf("proxy backend %s healthy: %v", b.url, healthy == 1)
+	}
+}
+
+// stop health checks
+func (self *ProxyPool) Close() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.stop != nil {
+		close(self.stop)
+		self.stop = nil
+	}
+}
+
+func NewProxyPool(policy int, targets ...string) *ProxyPool {
+	p := &ProxyPool{
+		backends: make([]*Backend, 0),
+		policy:   policy,
+		rr:       -1,
+	}
+	for _, t := range targets {
+		p.AddBackend(t, 1)
+	}
+	return p
+}
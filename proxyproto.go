@@ -0,0 +1,216 @@
+package nxhttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * listener taking the peer address from a HAProxy PROXY protocol header
+ * (v1 or v2), for servers behind a l4 load balancer. RemoteAddr of the
+ * connections, so ctx.ClientIP, is the address of the real peer. only
+ * connections from trusted networks are looked at, their header is
+ * optional. the header is read by the first Read or RemoteAddr of a
+ * connection, not by Accept, so slow peers do not hold up others
+ *
+ *	ln, _ := net.Listen("tcp", ":8080")
+ *	pl, _ := nxhttp.NewProxyProtoListener(ln, "10.0.0.0/8")
+ *	http.Serve(pl, h)
+ */
+type ProxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// time to wait for the header
+var ProxyProtoTimeout = 5 * time.Second
+
+var errProxyProto = errors.New("invalid proxy protocol header")
+
+// v2 signature
+var proxyProtoSig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// trusted are cidrs or plain addresses of the balancers, at least one
+func NewProxyProtoListener(ln net.Listener, trusted ...string) (*ProxyProtoListener, error) {
+	if len(trusted) == 0 {
+		return nil, errors.New("proxy protocol listener without trusted networks")
+	}
+	nets, err := parseNetworks(trusted)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyProtoListener{
+		Listener: ln,
+		trusted:  nets,
+		timeout:  ProxyProtoTimeout,
+	}, nil
+}
+
+func (self *ProxyProtoListener) SetTimeout(d time.Duration) *ProxyProtoListener {
+	self.timeout = d
+	return self
+}
+
+func (self *ProxyProtoListener) Accept() (net.Conn, error) {
+	c, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !self.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyProtoConn{Conn: c, br: bufio.NewReader(c), timeout: self.timeout}, nil
+}
+
+func (self *ProxyProtoListener) isTrusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range self.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	remote net.Addr // from the header, nil if none
+	err    error
+}
+
+func (self *proxyProtoConn) init() {
+	self.once.Do(func() {
+		if self.timeout > 0 {
+			self.Conn.SetReadDeadline(time.Now().Add(self.timeout))
+			defer self.Conn.SetReadDeadline(time.Time{})
+		}
+		self.remote, self.err = readProxyHeader(self.br)
+		if self.err != nil {
+			self.Conn.Close()
+		}
+	})
+}
+
+func (self *proxyProtoConn) Read(p []byte) (int, error) {
+	self.init()
+	if self.err != nil {
+		return 0, self.err
+	}
+	return self.br.Read(p)
+}
+
+func (self *proxyProtoConn) RemoteAddr() net.Addr {
+	self.init()
+	if self.remote != nil {
+		return self.remote
+	}
+	return self.Conn.RemoteAddr()
+}
+
+// peer address of the header at the start of br, nil without header or
+// for LOCAL and UNKNOWN ones
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	b, err := br.Peek(5)
+	if err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	switch {
+	case string(b) == "PROXY":
+		return readProxyV1(br)
+	case b[0] == proxyProtoSig[0]:
+		if sig, err := br.Peek(len(proxyProtoSig)); err == nil && bytes.Equal(sig, proxyProtoSig) {
+			return readProxyV2(br)
+		}
+	}
+	return nil, nil
+}
+
+// PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyProto
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, errProxyProto
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errProxyProto
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0:
+		// LOCAL, e.g. health checks of the balancer
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("proxy protocol command %d", hdr[12]&0xf)
+	}
+	switch hdr[13] {
+	case 0x11, 0x12: // tcp or udp over ipv4
+		if len(body) < 12 {
+			return nil, errProxyProto
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21, 0x22: // over ipv6
+		if len(body) < 36 {
+			return nil, errProxyProto
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// unix sockets or unspecified
+	return nil, nil
+}
@@ -0,0 +1,171 @@
+package nxhttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// v2 header of cmd and family with body
+func proxyV2(cmd, fam byte, body []byte) []byte {
+	b := append([]byte{}, proxyProtoSig...)
+	b = append(b, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(body)))
+	return append(b, body...)
+}
+
+func proxyV2Inet(ip net.IP, port uint16) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		body := make([]byte, 12)
+		copy(body, ip4)
+		binary.BigEndian.PutUint16(body[8:], port)
+		return proxyV2(1, 0x11, body)
+	}
+	body := make([]byte, 36)
+	copy(body, ip.To16())
+	binary.BigEndian.PutUint16(body[32:], port)
+	return proxyV2(1, 0x21, body)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     []byte
+		remote string // "" for none
+		fail   bool
+	}{
+		{"none", []byte("GET / HTTP/1.1\r\n"), "", false},
+		{"empty", nil, "", false},
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nGET"), "192.0.2.1:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nGET"), "[2001:db8::1]:56324", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\nGET"), "", false},
+		{"v1 unknown addresses", []byte("PROXY UNKNOWN 192.0.2.1 192.0.2.2 1 2\r\nGET"), "", false},
+		{"v1 no crlf", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\nGET"), "", true},
+		{"v1 fields", []byte("PROXY TCP4 192.0.2.1 56324\r\n"), "", true},
+		{"v1 protocol", []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n"), "", true},
+		{"v1 address", []byte("PROXY TCP4 nonsense 192.0.2.2 56324 443\r\n"), "", true},
+		{"v1 port", []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n"), "", true},
+		{"v1 too long", []byte("PROXY " + strings.Repeat("x", 120) + "\r\n"), "", true},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), "", true},
+		{"v2 ipv4", proxyV2Inet(net.ParseIP("192.0.2.1"), 56324), "192.0.2.1:56324", false},
+		{"v2 ipv6", proxyV2Inet(net.ParseIP("2001:db8::1"), 56324), "[2001:db8::1]:56324", false},
+		{"v2 local", proxyV2(0, 0x11, make([]byte, 12)), "", false},
+		{"v2 unspecified", proxyV2(1, 0x00, nil), "", false},
+		{"v2 unix", proxyV2(1, 0x31, make([]byte, 216)), "", false},
+		{"v2 command", proxyV2(2, 0x11, make([]byte, 12)), "", true},
+		{"v2 version", append(append([]byte{}, proxyProtoSig...), 0x11, 0x11, 0, 0), "", true},
+		{"v2 short ipv4", proxyV2(1, 0x11, make([]byte, 4)), "", true},
+		{"v2 short ipv6", proxyV2(1, 0x21, make([]byte, 12)), "", true},
+		{"v2 truncated", proxyV2Inet(net.ParseIP("192.0.2.1"), 1)[:20], "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.in)))
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("no error, remote %v", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := ""
+			if addr != nil {
+				remote = addr.String()
+			}
+			if remote != tt.remote {
+				t.Fatalf("remote %q, want %q", remote, tt.remote)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderKeepsData(t *testing.T) {
+	br := bufio.NewReader(bytes.NewReader(append(proxyV2Inet(net.ParseIP("192.0.2.1"), 1), "GET"...)))
+	if _, err := readProxyHeader(br); err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(br)
+	if string(rest) != "GET" {
+		t.Fatalf("data after the header %q", rest)
+	}
+}
+
+func TestNewProxyProtoListener(t *testing.T) {
+	if _, err := NewProxyProtoListener(nil); err == nil {
+		t.Fatal("listener without trusted networks")
+	}
+	if _, err := NewProxyProtoListener(nil, "nonsense"); err == nil {
+		t.Fatal("listener with an invalid network")
+	}
+}
+
+func TestProxyProtoListener(t *testing.T) {
+	serve := func(t *testing.T, trusted string) func(prefix []byte) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pl, err := NewProxyProtoListener(ln, trusted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := NewNxHandler()
+		h.DoGet("/ip", MakeProcessor(func(ctx *NxContext) {
+			ctx.SendString(ctx.req.RemoteAddr)
+		}))
+		go http.Serve(pl, h)
+		t.Cleanup(func() { pl.Close() })
+
+		// body of the response, "" if the connection is closed
+		return func(prefix []byte) string {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			c.Write(append(prefix, "GET /ip HTTP/1.0\r\nHost: x\r\n\r\n"...))
+			b, _ := io.ReadAll(c)
+			if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+				return string(b[i+4:])
+			}
+			return ""
+		}
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		do := serve(t, "127.0.0.1")
+		if got := do([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n")); got != "203.0.113.7:5555" {
+			t.Fatalf("v1 remote %q", got)
+		}
+		if got := do(proxyV2Inet(net.ParseIP("2001:db8::1"), 1234)); got != "[2001:db8::1]:1234" {
+			t.Fatalf("v2 remote %q", got)
+		}
+		if got := do(proxyV2(0, 0, nil)); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Fatalf("local remote %q", got)
+		}
+		if got := do(nil); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Fatalf("remote without header %q", got)
+		}
+		if got := do([]byte("PROXY TCP4 nonsense\r\n")); got != "" {
+			t.Fatalf("malformed header served %q", got)
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		do := serve(t, "192.0.2.0/24")
+		if got := do(nil); !strings.HasPrefix(got, "127.0.0.1:") {
+			t.Fatalf("remote %q", got)
+		}
+		// the header is not looked at, so it breaks the request
+		if got := do([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 80\r\n")); strings.HasPrefix(got, "203.0.113.7") {
+			t.Fatalf("header of an untrusted peer used, remote %q", got)
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package nxhttp
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// context data key of the request id
+const requestIdKey = "request:id"
+
+const RequestIdHeader = "X-Request-ID"
+
+/*
+ * request id processor
+ * takes the request id from the incoming header or generates one, and
+ * sets it on the response and back on the request headers so it reaches
+ * CGI scripts and upstream services
+ */
+type RequestIdProcessor struct {
+	DefaultProcessor
+	header string
+}
+
+func (self *RequestIdProcessor) Process(ctx *NxContext) {
+	id := ctx.req.Header.Get(self.header)
+	if !isValidRequestId(id) {
+		id = newUUID()
+		ctx.req.Header.Set(self.header, id)
+	}
+	ctx.res.Header().Set(self.header, id)
+	ctx.PutData(requestIdKey, id).RunNext()
+}
+
+// accept only short printable ids from clients
+func isValidRequestId(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// random (version 4) uuid
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// header defaults to X-Request-ID
+func NewRequestIdProcessor(header string) *RequestIdProcessor {
+	if len(header) == 0 {
+		header = RequestIdHeader
+	}
+	return &RequestIdProcessor{
+		DefaultProcessor: DefaultProcessor{name: "requestid"},
+		header:           header,
+	}
+}
+
+// request id set by RequestIdProcessor, empty if none
+func (self *NxContext) RequestID() string {
+	if s, ok := self.GetData(requestIdKey).(string); ok {
+		return s
+	}
+	return ""
+}
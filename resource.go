@@ -0,0 +1,86 @@
+package nxhttp
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+/*
+ * REST resource controllers, a controller implements any of these
+ */
+type ResourceIndexer interface {
+	Index(ctx *NxContext)
+}
+
+type ResourceCreator interface {
+	Create(ctx *NxContext)
+}
+
+type ResourceShower interface {
+	Show(ctx *NxContext, id string)
+}
+
+type ResourceUpdater interface {
+	Update(ctx *NxContext, id string)
+}
+
+type ResourceDeleter interface {
+	Delete(ctx *NxContext, id string)
+}
+
+// processors run in front of every action of the controller. called once
+// per route since processors can not be shared between entries
+type ResourceMiddleware interface {
+	Middleware() []NxProcessor
+}
+
+// wire controller actions to routes under path:
+//
+//	GET    path      Index
+//	POST   path      Create
+//	GET    path/{id} Show
+//	PUT    path/{id} Update
+//	DELETE path/{id} Delete
+func (self *NxHandler) Resource(path string, controller interface{}) []Entry {
+	base := "^" + regexp.QuoteMeta(strings.TrimSuffix(path, "/"))
+	coll := base + "/?$"
+	item := base + "/([^/]+)$"
+
+	procs := func(f func(*NxContext)) []NxProcessor {
+		ps := make([]NxProcessor, 0)
+		if m, ok := controller.(ResourceMiddleware); ok {
+			ps = append(ps, m.Middleware()...)
+		}
+		return append(ps, MakeProcessor(f))
+	}
+
+	ens := make([]Entry, 0)
+	if c, ok := controller.(ResourceIndexer); ok {
+		ens = append(ens, self.DoGet(coll, procs(c.Index)...))
+	}
+	if c, ok := controller.(ResourceCreator); ok {
+		ens = append(ens, self.DoPost(coll, procs(c.Create)...))
+	}
+	if c, ok := controller.(ResourceShower); ok {
+		ens = append(ens, self.DoGet(item, procs(func(ctx *NxContext) {
+			c.Show(ctx, ctx.UrlParam(0))
+		})...))
+	}
+	if c, ok := controller.(ResourceUpdater); ok {
+		ens = append(ens, self.DoPut(item, procs(func(ctx *NxContext) {
+			c.Update(ctx, ctx.UrlParam(0))
+		})...))
+	}
+	if c, ok := controller.(ResourceDeleter); ok {
+		ens = append(ens, self.DoDelete(item, procs(func(ctx *NxContext) {
+			c.Delete(ctx, ctx.UrlParam(0))
+		})...))
+	}
+
+	if len(ens) == 0 {
+		log.Panic(fmt.Sprintf("%T implements no resource action", controller))
+	}
+	return ens
+}
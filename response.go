@@ -0,0 +1,100 @@
+package nxhttp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+/*
+ * response writer keeping track of status and body size
+ */
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (self *responseWriter) WriteHeader(status int) {
+	if self.status == 0 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *responseWriter) Write(b []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	n, err := self.ResponseWriter.Write(b)
+	self.size += int64(n)
+	return n, err
+}
+
+func (self *responseWriter) Flush() {
+	if f, ok := self.ResponseWriter.(http.Flusher); ok {
+		if self.status == 0 {
+			self.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (self *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := self.ResponseWriter.(http.Hijacker); ok {
+		if self.status == 0 {
+			self.status = http.StatusSwitchingProtocols
+		}
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("hijacking not supported")
+}
+
+// for http.ResponseController
+func (self *responseWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+// status sent to client, 200 if nothing was written yet
+func (self *responseWriter) Status() int {
+	if self.status == 0 {
+		return http.StatusOK
+	}
+	return self.status
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w}
+}
+
+// take over the connection, for custom protocols and CONNECT handlers.
+// the handler must not write the response afterwards
+func (self *NxContext) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(self.res).Hijack()
+}
+
+// status written so far, 0 if headers are not sent yet
+func (self *NxContext) ResponseStatus() int {
+	switch w := self.res.(type) {
+	case *responseWriter:
+		return w.status
+	case *bufferedResponse:
+		return w.status
+	}
+	return 0
+}
+
+// number of body bytes written so far
+func (self *NxContext) ResponseSize() int64 {
+	switch w := self.res.(type) {
+	case *responseWriter:
+		return w.size
+	case *bufferedResponse:
+		return int64(w.body.Len())
+	}
+	return 0
+}
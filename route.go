@@ -0,0 +1,264 @@
+package nxhttp
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * routes with typed params, /orders/{id:int}/items/{sku:uuid}.
+ * sugar over anchored regexps, a path whose param fails its type does not
+ * match, so /users/{id:int} and /users/{name:alpha} may both be routed.
+ * a path no route takes but for the type of a param is answered 404
+ */
+type RouteEntry struct {
+	RegexpEntry
+	checks []func(string) bool
+	types  []string // of params, "" if untyped
+}
+
+func (self *RouteEntry) Match(path string) []string {
+	params := self.RegexpEntry.Match(path)
+	for i, c := range self.checks {
+		if c != nil && i < len(params) && !c(params[i]) {
+			return nil
+		}
+	}
+	return params
+}
+
+var (
+	paramTypes = map[string]func(string) bool{
+		"int": func(s string) bool {
+			_, err := strconv.ParseInt(s, 10, 64)
+			return err == nil
+		},
+		"uint": func(s string) bool {
+			_, err := strconv.ParseUint(s, 10, 64)
+			return err == nil
+		},
+		"uuid":  regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`).MatchString,
+		"alpha": regexp.MustCompile(`^[A-Za-z]+$`).MatchString,
+		"alnum": regexp.MustCompile(`^[A-Za-z0-9]+$`).MatchString,
+		"slug":  regexp.MustCompile(`^[a-z0-9]+(?:-[a-z0-9]+)*$`).MatchString,
+		"path":  nil, // rest of the path, slashes included
+	}
+	paramTypesLock sync.RWMutex
+)
+
+var paramNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// add a param type usable as {name:typ}
+func RegisterParamType(typ string, check func(string) bool) {
+	paramTypesLock.Lock()
+	defer paramTypesLock.Unlock()
+	if _, ok := paramTypes[typ]; ok {
+		log.Panic(fmt.Sprintf("param type %q already exists", typ))
+	}
+	paramTypes[typ] = check
+}
+
+// convert a route to a regexp with a named group per param. a param is
+// {name}, {name:type} or {name:regexp}, types are "" for the latter
+func parseRoute(route string) (string, []func(string) bool, []string, error) {
+	var sb strings.Builder
+	checks := make([]func(string) bool, 0)
+	types := make([]string, 0)
+	sb.WriteString("^")
+	for len(route) > 0 {
+		i := strings.IndexByte(route, '{')
+		if i < 0 {
+			sb.WriteString(regexp.QuoteMeta(route))
+			break
+		}
+		sb.WriteString(regexp.QuoteMeta(route[:i]))
+		route = route[i:]
+
+		// matching brace, custom regexps may contain braces
+		depth, end := 0, -1
+		for j, c := range route {
+			if c == '{' {
+				depth++
+			} else if c == '}' {
+				depth--
+				if depth == 0 {
+					end = j
+					break
+				}
+			}
+		}
+		if end < 0 {
+			return "", nil, nil, fmt.Errorf("unclosed param in %q", route)
+		}
+		name, typ, _ := strings.Cut(route[1:end], ":")
+		route = route[end+1:]
+		if !paramNameRe.MatchString(name) {
+			return "", nil, nil, fmt.Errorf("invalid param name %q", name)
+		}
+
+		group := "[^/]+"
+		var check func(string) bool
+		known := ""
+		if len(typ) > 0 {
+			paramTypesLock.RLock()
+			c, ok := paramTypes[typ]
+			paramTypesLock.RUnlock()
+			if ok {
+				check, known = c, typ
+				if typ == "path" {
+					group = ".+"
+				}
+			} else {
+				re, err := regexp.Compile("^(?:" + typ + ")$")
+				if err != nil {
+					return "", nil, nil, fmt.Errorf("param %q: %v", name, err)
+				}
+				check = re.MatchString
+			}
+		}
+		sb.WriteString("(?P<" + name + ">" + group + ")")
+		checks = append(checks, check)
+		types = append(types, known)
+	}
+	sb.WriteString("$")
+	return sb.String(), checks, types, nil
+}
+
+func NewRouteEntry(route string, ps ...NxProcessor) *RouteEntry {
+	pattern, checks, types, err := parseRoute(route)
+	if err != nil {
+		log.Panic(fmt.Sprintf("invalid route %q: %v", route, err))
+	}
+	r := &RouteEntry{
+		RegexpEntry: *NewRegexpEntry(pattern),
+		checks:      checks,
+		types:       types,
+	}
+	r.name = route
+	r.bind(r)
+	if len(ps) > 0 {
+		r.Use(ps...)
+	}
+	return r
+}
+
+// register a route with typed params for method
+func (self *NxHandler) DoRoute(method, route string, ps ...NxProcessor) Entry {
+	method = strings.ToUpper(method)
+	if !isRouteMethod(method) {
+		log.Panic(fmt.Sprintf("unsupported method %q", method))
+	}
+	return self.addEntry(method, NewRouteEntry(route, ps...))
+}
+
+/*
+ * named params, from {name} routes or (?P<name>...) groups
+ */
+func (self *NxContext) Param(name string) string {
+	for i, n := range self.pnames {
+		if n == name {
+			return self.UrlParam(i)
+		}
+	}
+	return ""
+}
+
+// 0 if missing or not an int
+func (self *NxContext) ParamInt(name string) int {
+	i, _ := strconv.Atoi(self.Param(name))
+	return i
+}
+
+func (self *NxContext) ParamInt64(name string) int64 {
+	i, _ := strconv.ParseInt(self.Param(name), 10, 64)
+	return i
+}
+
+/*
+ * reverse routing
+ */
+
+// name en, which must be registered, for URLFor
+func (self *NxHandler) NameRoute(name string, en Entry) Entry {
+	self.update(func(t *routeTable) {
+		if _, ok := t.names[name]; ok {
+			log.Panic(fmt.Sprintf("route name %q already exists", name))
+		}
+		if !t.references(en) {
+			log.Panic(fmt.Sprintf("route %q is not registered", en.Name()))
+		}
+		t.names[name] = en
+	})
+	return en
+}
+
+// path of the named route with params filled in order. works on {name}
+// routes and on regexps whose non capture parts are plain literals
+func (self *NxHandler) URLFor(name string, params ...interface{}) (string, error) {
+	en, ok := self.table().names[name]
+	if !ok {
+		return "", fmt.Errorf("unknown route %q", name)
+	}
+	tmpl, names, err := pathTemplate(entrySource(en), nil)
+	if err != nil {
+		return "", err
+	}
+	if len(names) != len(params) {
+		return "", fmt.Errorf("route %q takes %d params, %d given", name, len(names), len(params))
+	}
+
+	rc, ok := en.(*RouteEntry)
+	for i, n := range names {
+		v := fmt.Sprint(params[i])
+		if ok && i < len(rc.checks) && rc.checks[i] != nil && !rc.checks[i](v) {
+			return "", fmt.Errorf("route %q: invalid %s %q", name, n, v)
+		}
+		tmpl = strings.Replace(tmpl, "{"+n+"}", escapeParam(v), 1)
+	}
+	if en.Match(tmpl) == nil {
+		return "", fmt.Errorf("route %q does not match %q", name, tmpl)
+	}
+	return tmpl, nil
+}
+
+// escape a param value, slashes are kept for {name:path} params
+func escapeParam(v string) string {
+	parts := strings.Split(v, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+/*
+ * matched route
+ */
+type RouteInfo struct {
+	Pattern string // entry pattern, or path of a mount
+	Method  string
+	Entry   Entry
+	Data    map[string]interface{} // entry data, see Entry.PutData
+}
+
+// route the request was matched to, zero if executed outside of an entry
+func (self *NxContext) Route() RouteInfo {
+	if self.entry == nil {
+		return RouteInfo{}
+	}
+	ri := RouteInfo{
+		Pattern: self.entry.Name(),
+		Method:  self.req.Method,
+		Entry:   self.entry,
+	}
+	if d, ok := self.entry.(interface{ Data() map[string]interface{} }); ok {
+		ri.Data = d.Data()
+	} else {
+		ri.Data = make(map[string]interface{})
+	}
+	return ri
+}
@@ -0,0 +1,77 @@
+package nxhttp
+
+import (
+	"container/list"
+	"sync"
+)
+
+/*
+ * lru cache of route resolution, method and path to entry and params.
+ * it belongs to a route table, so registering or removing routes starts
+ * with an empty one. only hits are cached, unrouted paths can not evict
+ * the hot ones
+ */
+type routeCache struct {
+	lock  sync.Mutex
+	items map[string]*list.Element
+	lru   *list.List // front is the most recently used
+	limit int
+}
+
+type routeCacheItem struct {
+	key    string
+	en     Entry
+	params []string
+}
+
+func newRouteCache(limit int) *routeCache {
+	return &routeCache{
+		items: make(map[string]*list.Element, limit),
+		lru:   list.New(),
+		limit: limit,
+	}
+}
+
+func (self *routeCache) get(key string) (Entry, []string, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	e, ok := self.items[key]
+	if !ok {
+		return nil, nil, false
+	}
+	self.lru.MoveToFront(e)
+	it := e.Value.(*routeCacheItem)
+	return it.en, copyParams(it.params), true
+}
+
+func (self *routeCache) put(key string, en Entry, params []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.items[key]; ok {
+		return
+	}
+	if self.lru.Len() >= self.limit {
+		oldest := self.lru.Back()
+		self.lru.Remove(oldest)
+		delete(self.items, oldest.Value.(*routeCacheItem).key)
+	}
+	self.items[key] = self.lru.PushFront(&routeCacheItem{key: key, en: en, params: copyParams(params)})
+}
+
+// params are handed to the request as is, a handler modifying them must
+// not change those of others
+func copyParams(params []string) []string {
+	if len(params) == 0 {
+		return params
+	}
+	return append([]string(nil), params...)
+}
+
+// cache route resolution of up to size paths, 0 disables it. worth it
+// for many routes and a bounded set of hot urls
+func (self *NxHandler) SetRouteCache(size int) *NxHandler {
+	self.update(func(t *routeTable) {
+		t.cacheSize = size
+	})
+	return self
+}
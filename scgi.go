@@ -0,0 +1,169 @@
+package nxhttp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+/*
+ * SCGI client. the request env is the one of CgiProcessor, sent as a
+ * netstring ahead of the body, the response is read as cgi output until
+ * the backend closes the connection
+ */
+type ScgiProcessor struct {
+	DefaultProcessor
+	network string
+	addr    string
+	envs    []string
+	timeout time.Duration // dial timeout
+
+	clientRedirect bool          // see SetLocalRedirect
+	mode           CgiOutputMode // see SetOutputMode
+}
+
+// bodies of unknown length buffered at most, larger ones get 413
+const ScgiMaxBufferedBody = 10 << 20
+
+// netstring of env, CONTENT_LENGTH first and SCGI=1 as the spec wants
+func scgiHeader(env []string, length int64) []byte {
+	var b bytes.Buffer
+	b.WriteString("CONTENT_LENGTH\x00" + strconv.FormatInt(length, 10) + "\x00")
+	b.WriteString("SCGI\x001\x00")
+	for _, kv := range env {
+		k, v, _ := strings.Cut(kv, "=")
+		if k == "CONTENT_LENGTH" || k == "SCGI" {
+			continue
+		}
+		b.WriteString(k + "\x00" + v + "\x00")
+	}
+	h := strconv.AppendInt(nil, int64(b.Len()), 10)
+	h = append(h, ':')
+	h = append(h, b.Bytes()...)
+	return append(h, ',')
+}
+
+func (self *ScgiProcessor) Process(ctx *NxContext) {
+	r := ctx.Req()
+	env := cgiEnv(ctx, self.envs, "", ctx.Req().URL.Path)
+
+	_, span := ctx.StartSpan("scgi "+self.addr, attribute.String("scgi.addr", self.addr))
+	defer span.End()
+
+	fail := func(err error) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		ctx.Logger().Error("scgi", "addr", self.addr, "error", err)
+		if ctx.ResponseStatus() == 0 {
+			ctx.End(http.StatusBadGateway)
+		} else {
+			ctx.End(0)
+		}
+	}
+
+	// the length goes first, bodies of unknown length are read up front
+	var body io.Reader = r.Body
+	length := r.ContentLength
+	if body == nil || body == http.NoBody {
+		body, length = nil, 0
+	} else if length < 0 {
+		b, err := io.ReadAll(http.MaxBytesReader(ctx.Res(), r.Body, ScgiMaxBufferedBody))
+		if err != nil {
+			if ctx.bodyError(err); ctx.ResponseStatus() == 0 {
+				ctx.End(http.StatusBadRequest)
+			} else {
+				ctx.End(0)
+			}
+			return
+		}
+		body, length = bytes.NewReader(b), int64(len(b))
+	}
+
+	conn, err := net.DialTimeout(self.network, self.addr, self.timeout)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer conn.Close()
+	if t := self.GetTimeout(); t > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(t) * time.Millisecond))
+	}
+
+	if _, err := conn.Write(scgiHeader(env, length)); err != nil {
+		fail(err)
+		return
+	}
+	if body != nil {
+		if _, err := copyPooled(conn, io.LimitReader(body, length)); err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	err = writeCgiResponse(ctx, conn, !self.clientRedirect, self.mode)
+	var redirect *cgiRedirect
+	if errors.As(err, &redirect) {
+		// served without holding the connection
+		conn.Close()
+		err = cgiLocalRedirect(ctx, redirect.loc)
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	ctx.RunNext()
+}
+
+// extra variables sent with every request
+func (self *ScgiProcessor) SetEnv(envmap map[string]string) *ScgiProcessor {
+	for k, v := range envmap {
+		self.envs = append(self.envs, fmt.Sprintf("%s=%s", k, v))
+	}
+	return self
+}
+
+// see CgiProcessor.SetOutputMode
+func (self *ScgiProcessor) SetOutputMode(mode CgiOutputMode) *ScgiProcessor {
+	self.mode = mode
+	return self
+}
+
+// see CgiProcessor.SetLocalRedirect
+func (self *ScgiProcessor) SetLocalRedirect(internal bool) *ScgiProcessor {
+	self.clientRedirect = !internal
+	return self
+}
+
+func (self *ScgiProcessor) SetDialTimeout(d time.Duration) *ScgiProcessor {
+	self.timeout = d
+	return self
+}
+
+func (self *ScgiProcessor) Validate() error {
+	conn, err := net.DialTimeout(self.network, self.addr, time.Second)
+	if err == nil {
+		conn.Close()
+	}
+	return err
+}
+
+// network and addr as for net.Dial, e.g. "tcp", "127.0.0.1:4000"
+func NewScgiProcessor(network, addr string) *ScgiProcessor {
+	return &ScgiProcessor{
+		DefaultProcessor: DefaultProcessor{
+			name: "scgi",
+		},
+		network: network,
+		addr:    addr,
+		timeout: 5 * time.Second,
+	}
+}
@@ -0,0 +1,125 @@
+package nxhttp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// context data key of the per-request CSP nonce
+const cspNonceKey = "secure:nonce"
+
+// placeholder in ContentSecurityPolicy replaced by the request nonce,
+// e.g. "script-src 'self' 'nonce-{nonce}'"
+const CspNoncePlaceholder = "{nonce}"
+
+type SecureHeadersConfig struct {
+	// Strict-Transport-Security, disabled when HSTSMaxAge <= 0
+	HSTSMaxAge            int
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+
+	// X-Content-Type-Options: nosniff
+	NoSniff bool
+
+	// X-Frame-Options, e.g. DENY or SAMEORIGIN. empty to skip
+	FrameOptions string
+
+	// Referrer-Policy, empty to skip
+	ReferrerPolicy string
+
+	// Content-Security-Policy, empty to skip
+	ContentSecurityPolicy string
+}
+
+// sensible defaults, no CSP since it is application specific
+func DefaultSecureHeadersConfig() *SecureHeadersConfig {
+	return &SecureHeadersConfig{
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubdomains: true,
+		NoSniff:               true,
+		FrameOptions:          "SAMEORIGIN",
+		ReferrerPolicy:        "strict-origin-when-cross-origin",
+	}
+}
+
+type SecureHeadersProcessor struct {
+	DefaultProcessor
+	conf *SecureHeadersConfig
+	hsts string
+}
+
+func (self *SecureHeadersProcessor) Process(ctx *NxContext) {
+	h := ctx.Res().Header()
+
+	if len(self.hsts) > 0 {
+		h.Set("Strict-Transport-Security", self.hsts)
+	}
+	if self.conf.NoSniff {
+		h.Set("X-Content-Type-Options", "nosniff")
+	}
+	if len(self.conf.FrameOptions) > 0 {
+		h.Set("X-Frame-Options", self.conf.FrameOptions)
+	}
+	if len(self.conf.ReferrerPolicy) > 0 {
+		h.Set("Referrer-Policy", self.conf.ReferrerPolicy)
+	}
+
+	if csp := self.conf.ContentSecurityPolicy; len(csp) > 0 {
+		if strings.Contains(csp, CspNoncePlaceholder) {
+			nonce, err := makeNonce()
+			if err != nil {
+				ctx.Logger().Error("csp nonce", "error", err)
+				ctx.End(http.StatusInternalServerError)
+				return
+			}
+			ctx.PutData(cspNonceKey, nonce)
+			csp = strings.Replace(csp, CspNoncePlaceholder, nonce, -1)
+		}
+		h.Set("Content-Security-Policy", csp)
+	}
+
+	ctx.RunNext()
+}
+
+func makeNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func NewSecureHeadersProcessor(conf *SecureHeadersConfig) *SecureHeadersProcessor {
+	if conf == nil {
+		conf = DefaultSecureHeadersConfig()
+	}
+
+	hsts := ""
+	if conf.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", conf.HSTSMaxAge)
+		if conf.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if conf.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+
+	return &SecureHeadersProcessor{
+		DefaultProcessor: DefaultProcessor{name: "secureheaders"},
+		conf:             conf,
+		hsts:             hsts,
+	}
+}
+
+// CSP nonce of current request, for use in templates:
+// <script nonce="{{.Nonce}}">. empty if no nonce was generated
+func (self *NxContext) CspNonce() string {
+	if s, ok := self.GetData(cspNonceKey).(string); ok {
+		return s
+	}
+	return ""
+}
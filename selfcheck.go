@@ -0,0 +1,248 @@
+package nxhttp
+
+import (
+	"fmt"
+	"net/http"
+	"regexp/syntax"
+	"sort"
+	"strings"
+)
+
+// processors may implement it to be verified by NxHandler.SelfCheck
+type Validator interface {
+	Validate() error
+}
+
+type SelfCheckEntry struct {
+	Method     string   `json:"method"`
+	Pattern    string   `json:"pattern"`
+	Sample     string   `json:"sample"`
+	Params     int      `json:"params"`
+	Processors []string `json:"processors"`
+	Problems   []string `json:"problems,omitempty"`
+}
+
+type SelfCheckMount struct {
+	Path     string   `json:"path"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+type SelfCheckReport struct {
+	Entries []SelfCheckEntry `json:"entries"`
+	Mounts  []SelfCheckMount `json:"mounts"`
+	OK      bool             `json:"ok"`
+}
+
+// human readable report, suitable as startup banner
+func (self *SelfCheckReport) String() string {
+	var sb strings.Builder
+	for _, e := range self.Entries {
+		fmt.Fprintf(&sb, "%-7s %-40s %s [%s]", e.Method, e.Pattern, e.Sample, strings.Join(e.Processors, " -> "))
+		for _, p := range e.Problems {
+			fmt.Fprintf(&sb, "\n        ! %s", p)
+		}
+		sb.WriteString("\n")
+	}
+	for _, m := range self.Mounts {
+		fmt.Fprintf(&sb, "%-7s %s", "MOUNT", m.Path)
+		for _, p := range m.Problems {
+			fmt.Fprintf(&sb, "\n        ! %s", p)
+		}
+		sb.WriteString("\n")
+	}
+	if self.OK {
+		sb.WriteString("self check OK\n")
+	} else {
+		sb.WriteString("self check FAILED\n")
+	}
+	return sb.String()
+}
+
+// verify every registered route: a sample path is generated from each
+// pattern and resolved against the route table, capture counts and
+// processor chains are checked, mounts are checked for reachability
+func (self *NxHandler) SelfCheck() *SelfCheckReport {
+	rep := &SelfCheckReport{
+		Entries: make([]SelfCheckEntry, 0),
+		Mounts:  make([]SelfCheckMount, 0),
+		OK:      true,
+	}
+	t := self.table()
+
+	for method, dict := range t.entries {
+		for pattern, en := range dict {
+			rep.Entries = append(rep.Entries, checkEntry(method, pattern, en, dict))
+		}
+	}
+	sort.Slice(rep.Entries, func(i, j int) bool {
+		a, b := rep.Entries[i], rep.Entries[j]
+		if a.Pattern == b.Pattern {
+			return a.Method < b.Method
+		}
+		return a.Pattern < b.Pattern
+	})
+
+	for sp := range t.mounts {
+		m := SelfCheckMount{Path: sp}
+		if en, _ := t.find("GET", sp+"x"); en != nil {
+			m.Problems = append(m.Problems, fmt.Sprintf("shadowed by GET entry %q", en.Name()))
+		}
+		rep.Mounts = append(rep.Mounts, m)
+	}
+	sort.Slice(rep.Mounts, func(i, j int) bool {
+		return rep.Mounts[i].Path < rep.Mounts[j].Path
+	})
+
+	for _, e := range rep.Entries {
+		if len(e.Problems) > 0 {
+			rep.OK = false
+		}
+	}
+	for _, m := range rep.Mounts {
+		if len(m.Problems) > 0 {
+			rep.OK = false
+		}
+	}
+	return rep
+}
+
+func checkEntry(method, pattern string, en Entry, dict map[string]Entry) SelfCheckEntry {
+	ce := SelfCheckEntry{
+		Method:     method,
+		Pattern:    pattern,
+		Processors: make([]string, 0),
+	}
+	problem := func(f string, args ...interface{}) {
+		ce.Problems = append(ce.Problems, fmt.Sprintf(f, args...))
+	}
+
+	// processors
+	if en.Processor() == nil {
+		problem("no processor")
+	}
+	seen := make(map[NxProcessor]bool)
+	for p := en.Processor(); p != nil; p = p.getnext() {
+		if seen[p] {
+			problem("processor %q chained more than once", p.Name())
+			break
+		}
+		seen[p] = true
+		ce.Processors = append(ce.Processors, p.Name())
+
+		if _, ok := p.(*DefaultProcessor); ok {
+			problem("bare DefaultProcessor %q can not process requests", p.Name())
+		}
+		if v, ok := p.(Validator); ok {
+			if err := v.Validate(); err != nil {
+				problem("processor %q: %v", p.Name(), err)
+			}
+		}
+	}
+
+	// pattern
+	re, err := syntax.Parse(entrySource(en), syntax.Perl)
+	if err != nil {
+		problem("invalid pattern: %v", err)
+		return ce
+	}
+	ce.Params = re.MaxCap()
+
+	// typed params take a value of their type, custom types and regexps
+	// have no known sample so only the pattern is checked
+	caps := make(map[int]string)
+	match := en.Match
+	if r, ok := en.(*RouteEntry); ok {
+		for i, typ := range r.types {
+			if v, ok := paramSamples[typ]; ok {
+				caps[i+1] = v
+			} else if r.checks[i] != nil {
+				match = r.RegexpEntry.Match
+			}
+		}
+	}
+
+	var sb strings.Builder
+	writeSample(&sb, re.Simplify(), caps)
+	ce.Sample = sb.String()
+
+	params := match(ce.Sample)
+	if params == nil {
+		problem("sample path %q does not match", ce.Sample)
+		return ce
+	}
+	if len(params) != ce.Params {
+		problem("sample path %q yields %d params, %d declared", ce.Sample, len(params), ce.Params)
+	}
+	for k, o := range dict {
+		if k != pattern && o.Match(ce.Sample) != nil {
+			problem("sample path %q also matched by %q", ce.Sample, k)
+		}
+	}
+	if !strings.HasPrefix(ce.Sample, "/") {
+		problem("sample path %q is not absolute", ce.Sample)
+	}
+	if _, err := http.NewRequest(method, ce.Sample, nil); err != nil {
+		problem("sample path %q is not a valid url: %v", ce.Sample, err)
+	}
+	return ce
+}
+
+// samples of the builtin param types
+var paramSamples = map[string]string{
+	"int":   "1",
+	"uint":  "1",
+	"uuid":  "00000000-0000-4000-8000-000000000001",
+	"alpha": "a",
+	"alnum": "a",
+	"slug":  "a",
+	"path":  "a",
+}
+
+// write a string matched by re, captures in caps by index are written as is
+func writeSample(sb *strings.Builder, re *syntax.Regexp, caps map[int]string) {
+	switch re.Op {
+	case syntax.OpLiteral:
+		sb.WriteString(string(re.Rune))
+	case syntax.OpCharClass:
+		sb.WriteRune(sampleRune(re.Rune))
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		sb.WriteRune('x')
+	case syntax.OpCapture:
+		if v, ok := caps[re.Cap]; ok {
+			sb.WriteString(v)
+		} else {
+			writeSample(sb, re.Sub[0], caps)
+		}
+	case syntax.OpPlus, syntax.OpStar:
+		writeSample(sb, re.Sub[0], caps)
+	case syntax.OpRepeat:
+		n := re.Min
+		if n == 0 && re.Max != 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			writeSample(sb, re.Sub[0], caps)
+		}
+	case syntax.OpConcat:
+		for _, s := range re.Sub {
+			writeSample(sb, s, caps)
+		}
+	case syntax.OpAlternate:
+		writeSample(sb, re.Sub[0], caps)
+	}
+}
+
+// pick a url friendly rune from char class ranges
+func sampleRune(ranges []rune) rune {
+	for _, c := range "a0x-_" {
+		for i := 0; i+1 < len(ranges); i += 2 {
+			if ranges[i] <= c && c <= ranges[i+1] {
+				return c
+			}
+		}
+	}
+	if len(ranges) > 0 {
+		return ranges[0]
+	}
+	return 'x'
+}
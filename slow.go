@@ -0,0 +1,153 @@
+package nxhttp
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SlowRequest struct {
+	Route    string
+	Method   string
+	URL      string
+	Duration time.Duration
+
+	// stacks of the request goroutine sampled while it was over the
+	// threshold, at most 3 taken one threshold apart, see SlowStackInterval
+	Stacks []string
+}
+
+/*
+ * slow request detection
+ * measures the rest of chain and reports requests exceeding threshold
+ */
+type SlowRequestProcessor struct {
+	DefaultProcessor
+	threshold time.Duration
+	onslow    func(ctx *NxContext, sr *SlowRequest)
+}
+
+const slowRequestSamples = 3
+
+func (self *SlowRequestProcessor) Process(ctx *NxContext) {
+	gid := goroutineId()
+	done := make(chan struct{})
+	var (
+		lock   sync.Mutex
+		stacks []string
+	)
+	go func() {
+		t := time.NewTimer(self.threshold)
+		defer t.Stop()
+		for i := 0; i < slowRequestSamples; i++ {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if s := goroutineStack(gid); len(s) > 0 {
+				lock.Lock()
+				stacks = append(stacks, s)
+				lock.Unlock()
+			}
+			t.Reset(self.threshold)
+		}
+	}()
+
+	start := time.Now()
+	defer func() {
+		close(done)
+		d := time.Since(start)
+		if d < self.threshold {
+			return
+		}
+		lock.Lock()
+		sr := &SlowRequest{
+			Route:    ctx.Route().Pattern,
+			Method:   ctx.req.Method,
+			URL:      ctx.req.URL.String(),
+			Duration: d,
+			Stacks:   stacks,
+		}
+		lock.Unlock()
+		self.onslow(ctx, sr)
+	}()
+	ctx.RunNext()
+}
+
+func logSlowRequest(ctx *NxContext, sr *SlowRequest) {
+	ctx.Logger().Warn("slow request", "url", sr.URL, "duration", sr.Duration,
+		"stacks", strings.Join(sr.Stacks, "\n\n"))
+}
+
+// id of the calling goroutine, from the stack header "goroutine 12 [...]"
+func goroutineId() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		id, _ := strconv.ParseUint(string(buf[:i]), 10, 64)
+		return id
+	}
+	return 0
+}
+
+// dumps of all goroutines stop the world, they are taken at most once
+// per interval and shared by the requests sampled meanwhile
+var SlowStackInterval = time.Second
+
+// largest dump taken, the rest is cut
+const slowStackMaxDump = 64 << 20
+
+var slowStacks struct {
+	lock  sync.Mutex
+	taken time.Time
+	dump  []byte
+}
+
+// all goroutine stacks, at most SlowStackInterval old
+func allStacks() []byte {
+	slowStacks.lock.Lock()
+	defer slowStacks.lock.Unlock()
+	if slowStacks.dump != nil && time.Since(slowStacks.taken) < SlowStackInterval {
+		return slowStacks.dump
+	}
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= slowStackMaxDump {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	slowStacks.taken, slowStacks.dump = time.Now(), buf
+	return buf
+}
+
+// stack of goroutine gid, "" if it is gone
+func goroutineStack(gid uint64) string {
+	prefix := []byte("goroutine " + strconv.FormatUint(gid, 10) + " ")
+	for _, s := range bytes.Split(allStacks(), []byte("\n\n")) {
+		if bytes.HasPrefix(s, prefix) {
+			return string(s)
+		}
+	}
+	return ""
+}
+
+// report requests taking longer than threshold to onslow, which logs
+// with stack samples if nil
+func NewSlowRequestProcessor(threshold time.Duration, onslow func(ctx *NxContext, sr *SlowRequest)) *SlowRequestProcessor {
+	if onslow == nil {
+		onslow = logSlowRequest
+	}
+	return &SlowRequestProcessor{
+		DefaultProcessor: DefaultProcessor{name: "slowrequest"},
+		threshold:        threshold,
+		onslow:           onslow,
+	}
+}
@@ -0,0 +1,202 @@
+package nxhttp
+
+import (
+	"bytes"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * file server of fsys, for NxHandler.Mount. directories are served by
+ * their index.html, without one they get 404 unless auto-index is on,
+ * then a listing is rendered by a html template. listings sort by the
+ * sort (name, size, modified) and order (asc, desc) query parameters
+ * and leave out hidden files unless SetShowHidden
+ */
+type FileServer struct {
+	fsys      fs.FS
+	files     http.Handler
+	autoindex bool
+	hidden    bool
+	tmpl      *template.Template
+}
+
+// data of listing templates
+type DirListing struct {
+	Path    string // of the directory in the url, with a trailing slash
+	Entries []DirListingEntry
+	Sort    string
+	Desc    bool
+}
+
+type DirListingEntry struct {
+	Name    string // with a trailing slash for directories
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// relative link of the entry, the name escaped as a path, so names like
+// "a?b" or "c:d" link to themselves
+func (self DirListingEntry) Href() string {
+	return (&url.URL{Path: self.Name}).String()
+}
+
+// query of the link sorting by col, the order is toggled if the listing
+// is sorted by col already
+func (self *DirListing) SortURL(col string) string {
+	order := "asc"
+	if col == self.Sort && !self.Desc {
+		order = "desc"
+	}
+	return "?" + url.Values{"sort": {col}, "order": {order}}.Encode()
+}
+
+var dirListingTemplate = template.Must(template.New("dirlisting").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body><h1>Index of {{.Path}}</h1>
+<table>
+<tr><th><a href="{{.SortURL "name"}}">Name</a></th><th><a href="{{.SortURL "size"}}">Size</a></th><th><a href="{{.SortURL "modified"}}">Modified</a></th></tr>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{if not .ModTime.IsZero}}{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}{{end}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+func NewFileServer(fsys fs.FS) *FileServer {
+	return &FileServer{
+		fsys:  fsys,
+		files: http.FileServerFS(fsys),
+		tmpl:  dirListingTemplate,
+	}
+}
+
+// list directories without index.html
+func (self *FileServer) SetAutoIndex(on bool) *FileServer {
+	self.autoindex = on
+	return self
+}
+
+// list files starting with a dot too
+func (self *FileServer) SetShowHidden(on bool) *FileServer {
+	self.hidden = on
+	return self
+}
+
+// template rendering listings with a *DirListing, nil restores the
+// builtin one
+func (self *FileServer) SetListingTemplate(t *template.Template) *FileServer {
+	if t == nil {
+		t = dirListingTemplate
+	}
+	self.tmpl = t
+	return self
+}
+
+func (self *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		// mounted, the prefix is stripped with its slash
+		upath = "/" + upath
+	}
+	name := strings.TrimPrefix(path.Clean(upath), "/")
+	if len(name) == 0 {
+		name = "."
+	}
+	fi, err := fs.Stat(self.fsys, name)
+	if err != nil || !fi.IsDir() {
+		self.files.ServeHTTP(w, r)
+		return
+	}
+	if _, err := fs.Stat(self.fsys, path.Join(name, "index.html")); err == nil {
+		self.files.ServeHTTP(w, r)
+		return
+	}
+
+	if !self.autoindex {
+		http.NotFound(w, r)
+		return
+	}
+	if !strings.HasSuffix(upath, "/") {
+		// relative links of the listing need the slash
+		target := path.Base(upath) + "/"
+		if len(r.URL.RawQuery) > 0 {
+			target += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	self.list(w, r, upath, name)
+}
+
+func (self *FileServer) list(w http.ResponseWriter, r *http.Request, upath, name string) {
+	des, err := fs.ReadDir(self.fsys, name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	d := &DirListing{
+		Path:    upath,
+		Entries: make([]DirListingEntry, 0, len(des)),
+		Sort:    q.Get("sort"),
+		Desc:    q.Get("order") == "desc",
+	}
+	for _, de := range des {
+		if !self.hidden && strings.HasPrefix(de.Name(), ".") {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		e := DirListingEntry{Name: de.Name(), IsDir: de.IsDir(), Size: fi.Size(), ModTime: fi.ModTime()}
+		if e.IsDir {
+			e.Name += "/"
+			e.Size = 0
+		}
+		d.Entries = append(d.Entries, e)
+	}
+
+	var less func(a, b *DirListingEntry) bool
+	switch d.Sort {
+	case "size":
+		less = func(a, b *DirListingEntry) bool { return a.Size < b.Size }
+	case "modified":
+		less = func(a, b *DirListingEntry) bool { return a.ModTime.Before(b.ModTime) }
+	default:
+		d.Sort = "name"
+		less = func(a, b *DirListingEntry) bool { return a.Name < b.Name }
+	}
+	sort.SliceStable(d.Entries, func(i, j int) bool {
+		a, b := &d.Entries[i], &d.Entries[j]
+		if a.IsDir != b.IsDir {
+			// directories first, whatever the order
+			return a.IsDir
+		}
+		if d.Desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	})
+
+	var buf bytes.Buffer
+	if err := self.tmpl.Execute(&buf, d); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,124 @@
+package nxhttp
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// streams are flushed to the client at least this often while writing
+var StreamFlushInterval = time.Second
+
+/*
+ * streamed rows or objects, flushed periodically so the response is
+ * never held in memory
+ */
+type stream struct {
+	ctx  *NxContext
+	last time.Time
+}
+
+// call flush if due, fails once the client is gone
+func (self *stream) wrote(flush func() error) error {
+	if err := self.ctx.req.Context().Err(); err != nil {
+		return err
+	}
+	if time.Since(self.last) >= StreamFlushInterval {
+		self.last = time.Now()
+		return flush()
+	}
+	return nil
+}
+
+func flushResponse(w http.ResponseWriter) error {
+	return http.NewResponseController(w).Flush()
+}
+
+type CSVStream struct {
+	stream
+	w *csv.Writer
+}
+
+func (self *CSVStream) Write(row []string) error {
+	if err := self.w.Write(row); err != nil {
+		return err
+	}
+	return self.wrote(self.Flush)
+}
+
+// send buffered rows now
+func (self *CSVStream) Flush() error {
+	self.w.Flush()
+	if err := self.w.Error(); err != nil {
+		return err
+	}
+	return flushResponse(self.ctx.res)
+}
+
+// stream csv rows, header is written first unless nil. Flush when done
+func (self *NxContext) StreamCSV(header []string) *CSVStream {
+	self.res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	self.writeStatus()
+	s := &CSVStream{
+		stream: stream{ctx: self, last: time.Now()},
+		w:      csv.NewWriter(self.res),
+	}
+	if header != nil {
+		s.w.Write(header)
+	}
+	return s
+}
+
+type NDJSONStream struct {
+	stream
+	enc *json.Encoder
+}
+
+// write v as one line
+func (self *NDJSONStream) Encode(v interface{}) error {
+	if err := self.enc.Encode(v); err != nil {
+		return err
+	}
+	return self.wrote(self.Flush)
+}
+
+func (self *NDJSONStream) Flush() error {
+	return flushResponse(self.ctx.res)
+}
+
+// stream newline delimited json objects
+func (self *NxContext) StreamNDJSON() *NDJSONStream {
+	self.res.Header().Set("Content-Type", "application/x-ndjson")
+	self.writeStatus()
+	return &NDJSONStream{
+		stream: stream{ctx: self, last: time.Now()},
+		enc:    json.NewEncoder(self.res),
+	}
+}
+
+// send what was written so far to the client
+func (self *NxContext) Flush() error {
+	return flushResponse(self.res)
+}
+
+// write through to the client from now on, buffering processors (timeout,
+// stale-if-error) stop buffering and proxies are asked not to buffer
+func (self *NxContext) Streaming() *NxContext {
+	if b, ok := self.res.(*bufferedResponse); ok {
+		b.passThrough()
+	}
+	self.res.Header().Set("X-Accel-Buffering", "no")
+	self.res.Header().Set("Cache-Control", "no-cache")
+	return self
+}
+
+// closed when the client goes away or the request times out
+func (self *NxContext) Done() <-chan struct{} {
+	return self.req.Context().Done()
+}
+
+// why Done was closed, nil if it is not
+func (self *NxContext) Err() error {
+	return self.req.Context().Err()
+}
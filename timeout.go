@@ -0,0 +1,119 @@
+package nxhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+/*
+ * timeout processor
+ * runs the rest of chain with a deadline derived from its timeout (set by
+ * Entry.SetTimeout as well), downstream processors see it through
+ * ctx.Req().Context(). the response is buffered and replaced by an error
+ * status when the deadline is exceeded. the chain is not stopped then,
+ * it runs on in its goroutine with a done context and its writes fail,
+ * so downstream processors should watch the context of the request.
+ * panics of the chain go to the panic handler with their own stack
+ */
+type TimeoutProcessor struct {
+	DefaultProcessor
+	status int
+}
+
+func (self *TimeoutProcessor) Process(ctx *NxContext) {
+	if self.GetTimeout() <= 0 {
+		ctx.RunNext()
+		return
+	}
+
+	c, cancel := context.WithTimeout(ctx.req.Context(), time.Duration(self.GetTimeout())*time.Millisecond)
+	defer cancel()
+
+	// downstream works on its own copy so it can be abandoned on timeout,
+	// slices it appends to are copied. the data is in the request context
+	buf := newBufferedResponse(ctx.res)
+	sub := *ctx
+	sub.req = ctx.req.WithContext(c)
+	sub.res = buf
+	sub.datakeys = append([]string(nil), ctx.datakeys...)
+	sub.timings = append([]ProcessorTiming(nil), ctx.timings...)
+
+	done := make(chan struct{})
+	panicked := make(chan *TimeoutPanic, 1)
+	go func() {
+		defer func() {
+			if cv := recover(); cv != nil {
+				if h := sub.handler(); h != nil && cv != http.ErrAbortHandler {
+					// here, for the stack of the panic
+					h.recovered(&sub, cv)
+				} else {
+					panicked <- &TimeoutPanic{Value: cv, Stack: debug.Stack()}
+					return
+				}
+			}
+			close(done)
+		}()
+		sub.RunNext()
+	}()
+
+	select {
+	case cv := <-panicked:
+		if cv.Value == http.ErrAbortHandler {
+			panic(cv.Value)
+		}
+		panic(cv)
+	case <-done:
+		// c is cancelled once Process returns, upstream processors go on
+		// with the context of the request and the data put downstream
+		w, rc := ctx.res, ctx.req.Context()
+		*ctx = sub
+		ctx.req = sub.req.WithContext(valuesContext{Context: rc, values: sub.req.Context()})
+		ctx.res = w
+		buf.SendTo(w)
+	case <-c.Done():
+		ctx.stopped = true
+		// a streaming response already went out, it just ends here
+		if buf.abandon() && c.Err() == context.DeadlineExceeded {
+			ctx.res.WriteHeader(self.status)
+			ctx.res.Write([]byte(http.StatusText(self.status)))
+		}
+	}
+}
+
+// deadline and cancellation of the embedded context, values of values
+type valuesContext struct {
+	context.Context
+	values context.Context
+}
+
+func (self valuesContext) Value(key interface{}) interface{} {
+	return self.values.Value(key)
+}
+
+// panic of a chain run by a TimeoutProcessor outside of a handler, raised
+// again in the goroutine of the request
+type TimeoutPanic struct {
+	Value interface{}
+	Stack []byte // of the goroutine of the panic
+}
+
+func (self *TimeoutPanic) Error() string {
+	return fmt.Sprintf("%v\n\n%s", self.Value, self.Stack)
+}
+
+// ms <= 0 leaves the timeout to Entry.SetTimeout. status is sent when the
+// deadline is exceeded, 503 if 0
+func NewTimeoutProcessor(ms int, status int) *TimeoutProcessor {
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	p := &TimeoutProcessor{
+		DefaultProcessor: DefaultProcessor{name: "timeout"},
+		status:           status,
+	}
+	p.SetTimeout(ms)
+	return p
+}
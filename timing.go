@@ -0,0 +1,82 @@
+package nxhttp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// execution of a processor, recorded in debug mode
+type ProcessorTiming struct {
+	Name       string
+	Start      time.Duration // since the first processor started
+	Duration   time.Duration // including downstream processors
+	Self       time.Duration // excluding downstream processors
+	CalledNext bool
+	Ended      bool // stopped the chain by End, Redirect...
+}
+
+// run p, timing it in debug mode
+func (self *NxContext) run(p NxProcessor) {
+	if !self.debug {
+		p.Process(self)
+		return
+	}
+
+	if len(self.timings) == 0 {
+		self.tstart = time.Now()
+	}
+	idx := len(self.timings)
+	self.timings = append(self.timings, ProcessorTiming{
+		Name:  p.Name(),
+		Start: time.Since(self.tstart),
+	})
+	stopped := self.stopped
+
+	start := time.Now()
+	p.Process(self)
+	d := time.Since(start)
+
+	t := &self.timings[idx]
+	t.Duration = d
+	t.Self = d
+	if len(self.timings) > idx+1 {
+		t.CalledNext = true
+		t.Self -= self.timings[idx+1].Duration
+	}
+	t.Ended = !stopped && self.stopped && !t.CalledNext
+}
+
+// processor timings so far, only recorded when debug is on
+func (self *NxContext) Timings() []ProcessorTiming {
+	return self.timings
+}
+
+// Server-Timing header value of the timings
+func (self *NxContext) ServerTiming() string {
+	ss := make([]string, 0, len(self.timings))
+	for i, t := range self.timings {
+		ss = append(ss, fmt.Sprintf("p%d;dur=%.3f;desc=%q", i, float64(t.Self)/float64(time.Millisecond), t.Name))
+	}
+	return strings.Join(ss, ", ")
+}
+
+// log the trace and send it as Server-Timing trailer
+func (self *NxContext) emitTimings() {
+	if len(self.timings) == 0 {
+		return
+	}
+	self.res.Header().Set("Server-Timing", self.ServerTiming())
+
+	var sb strings.Builder
+	for _, t := range self.timings {
+		flow := "-"
+		if t.CalledNext {
+			flow = "next"
+		} else if t.Ended {
+			flow = "end"
+		}
+		fmt.Fprintf(&sb, "\n  %-20s %10s %10s %s", t.Name, t.Self, t.Duration, flow)
+	}
+	self.Logger().Info("processor trace" + sb.String())
+}
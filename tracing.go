@@ -0,0 +1,91 @@
+package nxhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/pumingjohnray/nxhttp"
+
+/*
+ * opentelemetry tracing processor
+ * starts a server span per request, continuing the trace of the W3C
+ * traceparent header if any. the span is carried by ctx.Req().Context()
+ */
+type TracingProcessor struct {
+	DefaultProcessor
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+func (self *TracingProcessor) Process(ctx *NxContext) {
+	r := ctx.Req()
+	parent := self.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	route := r.URL.Path
+	if ctx.entry != nil {
+		route = ctx.entry.Name()
+	}
+
+	c, span := self.tracer.Start(parent, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+		),
+	)
+	defer span.End()
+
+	defer func() {
+		if cv := recover(); cv != nil {
+			span.RecordError(fmt.Errorf("panic: %v", cv))
+			span.SetStatus(codes.Error, "panic")
+			panic(cv)
+		}
+	}()
+
+	ctx.req = r.WithContext(c)
+	ctx.RunNext()
+
+	status := ctx.ResponseStatus()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// tp defaults to the global tracer provider
+func NewTracingProcessor(tp trace.TracerProvider) *TracingProcessor {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &TracingProcessor{
+		DefaultProcessor: DefaultProcessor{name: "tracing"},
+		tracer:           tp.Tracer(tracerName),
+		propagator:       propagation.TraceContext{},
+	}
+}
+
+// span of current request, a no-op span if tracing is not enabled
+func (self *NxContext) Span() trace.Span {
+	return trace.SpanFromContext(self.req.Context())
+}
+
+// start a child span of the request span, caller must End() it.
+// the returned context carries the child span for further calls
+func (self *NxContext) StartSpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	parent := self.req.Context()
+	tracer := trace.SpanFromContext(parent).TracerProvider().Tracer(tracerName)
+	return tracer.Start(parent, name, trace.WithAttributes(attrs...))
+}
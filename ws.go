@@ -1,50 +1,297 @@
 package nxhttp
 
 import (
+	"compress/flate"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
-	"log"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
  * Websocket Client & callback
  */
 type WebsocketCallback struct {
-	OnConnect     func(*WebsocketClient)
-	OnMessage     func(*WebsocketClient, []byte)
+	OnConnect func(*WebsocketClient)
+	OnMessage func(*WebsocketClient, []byte)
+
+	// binary messages, they go to OnMessage if not set
+	OnBinaryMessage func(*WebsocketClient, []byte)
+
+	// text messages that are valid json, others go to OnMessage
+	OnJSONMessage func(*WebsocketClient, json.RawMessage)
+
+	// ping and pong frames, pings are answered before the call
+	OnControl func(cli *WebsocketClient, msgType int, data []byte)
+
+	// a message over the rate limit, return true to drop only the
+	// message. the client is closed if not set
+	OnRateLimit func(cli *WebsocketClient, msg []byte) bool
+
+	// read and write failures, not called for normal closes. errors are
+	// logged if not set
+	OnError func(cli *WebsocketClient, err error)
+
+	// cli.CloseStatus tells the close code and reason
 	OnClose       func(*WebsocketClient)
 	OnCheckOrigin func(*http.Request) bool
 }
 
+type wsMessage struct {
+	typ  int // websocket.TextMessage, BinaryMessage...
+	data []byte
+}
+
 type WebsocketClient struct {
 	ctx  *NxContext
 	proc *WebsocketProcessor
+	hub  *Hub
 	conn *websocket.Conn
-	send chan []byte
+	send chan wsMessage
+	ctrl chan wsMessage // control frames, written first
+	done chan struct{}  // closed when stopped
+	once sync.Once
+
+	closing     chan struct{} // closed by CloseWith, carries closeMsg
+	closeMsg    []byte        // nil if no close frame is to be sent
+	closeCode   int
+	closeReason string
+	closeOnce   sync.Once
+	closedByUs  bool          // set before closing is closed
+	exited      chan struct{} // closed when the writer is gone
+
+	peerClosed chan struct{} // closed when the peer's close frame arrives
+
+	compress int32 // 1 if permessage-deflate was negotiated and is on
+	deflate  bool  // permessage-deflate was negotiated
+
+	metrics *wsMetrics
+
+	msgRate  *tokenBucket // used by the reader only
+	byteRate *tokenBucket
+
+	data     map[string]interface{}
+	dataLock sync.RWMutex
+
+	id    string          // guarded by hub.lock
+	rooms map[string]bool // guarded by hub.lock
 }
 
+// random uuid unless set by SetID
+func (self *WebsocketClient) ID() string {
+	self.hub.lock.RLock()
+	defer self.hub.lock.RUnlock()
+	return self.id
+}
+
+// replace the client id, e.g. with the user id once authenticated. fails
+// if another client has it
+func (self *WebsocketClient) SetID(id string) error {
+	self.hub.lock.Lock()
+	defer self.hub.lock.Unlock()
+	if id == self.id {
+		return nil
+	}
+	if _, ok := self.hub.ids[id]; ok {
+		return fmt.Errorf("websocket client %q exists", id)
+	}
+	if !self.hub.clients[self] {
+		return fmt.Errorf("websocket client %q is closed", self.id)
+	}
+	delete(self.hub.ids, self.id)
+	self.hub.ids[id] = self
+	self.id = id
+	return nil
+}
+
+// nil for long-poll clients
 func (self *WebsocketClient) Conn() *websocket.Conn {
 	return self.conn
 }
 
-func (self *WebsocketClient) Send(msg []byte) {
+var (
+	ErrWebsocketClosed      = errors.New("websocket client closed")
+	ErrWebsocketQueueFull   = errors.New("websocket send queue full")
+	ErrWebsocketTooBig      = errors.New("websocket message too big")
+	ErrWebsocketRateLimited = errors.New("websocket rate limit exceeded")
+)
+
+// send a text message
+func (self *WebsocketClient) Send(msg []byte) error {
+	return self.SendMessage(websocket.TextMessage, msg)
+}
+
+func (self *WebsocketClient) SendText(text string) error {
+	return self.SendMessage(websocket.TextMessage, []byte(text))
+}
+
+func (self *WebsocketClient) SendBinary(data []byte) error {
+	return self.SendMessage(websocket.BinaryMessage, data)
+}
+
+// queue a message of websocket.TextMessage or BinaryMessage type. fails
+// if the client is gone or the message is dropped by the queue policy
+func (self *WebsocketClient) SendMessage(msgType int, data []byte) error {
 	if self.IsDebug() {
-		fmt.Println("[ws-send]", msg)
+		fmt.Println("[ws-send]", msgType, data)
+	}
+	ok, kill := self.enqueue(wsMessage{msgType, data})
+	if kill {
+		self.stop()
+	}
+	switch {
+	case ok:
+		return nil
+	case kill || self.IsAlive():
+		return ErrWebsocketQueueFull
+	}
+	return ErrWebsocketClosed
+}
+
+// queue msg by the overflow policy, kill is set if the client is to be
+// closed, which must be done without holding the processor lock
+func (self *WebsocketClient) enqueue(msg wsMessage) (ok bool, kill bool) {
+	select {
+	case self.send <- msg:
+		return true, false
+	case <-self.done:
+		self.metrics.drop()
+		return false, false
+	default:
+	}
+
+	switch self.proc.overflow {
+	case WebsocketBlock:
+		select {
+		case self.send <- msg:
+			return true, false
+		case <-self.done:
+			self.metrics.drop()
+			return false, false
+		}
+	case WebsocketDropNewest:
+	case WebsocketDropOldest:
+		select {
+		case <-self.send:
+			atomic.AddUint64(&self.hub.dropped, 1)
+			self.metrics.drop()
+		default:
+		}
+		select {
+		case self.send <- msg:
+			return true, false
+		default:
+		}
+	default:
+		atomic.AddUint64(&self.hub.dropped, 1)
+		self.metrics.drop()
+		return false, true
+	}
+	atomic.AddUint64(&self.hub.dropped, 1)
+	self.metrics.drop()
+	return false, false
+}
+
+// messages waiting to be written
+func (self *WebsocketClient) QueueLen() int {
+	return len(self.send)
+}
+
+// send a ping, pong or close frame ahead of queued messages
+func (self *WebsocketClient) SendControl(msgType int, data []byte) error {
+	t := time.NewTimer(time.Second)
+	defer t.Stop()
+	select {
+	case self.ctrl <- wsMessage{msgType, data}:
+		return nil
+	case <-self.done:
+		return ErrWebsocketClosed
+	case <-t.C:
+		return ErrWebsocketQueueFull
 	}
-	self.send <- msg
 }
 
 func (self *WebsocketClient) Broadcast(msg []byte) {
-	self.proc.broadcast(msg)
+	self.hub.Broadcast(msg)
 }
 
+func (self *WebsocketClient) BroadcastBinary(data []byte) {
+	self.hub.BroadcastBinary(data)
+}
+
+// add client to room, a stopped client can not join
+func (self *WebsocketClient) Join(room string) {
+	self.hub.lock.Lock()
+	defer self.hub.lock.Unlock()
+	if !self.hub.clients[self] {
+		return
+	}
+	members, ok := self.hub.rooms[room]
+	if !ok {
+		members = make(map[*WebsocketClient]bool)
+		self.hub.rooms[room] = members
+	}
+	members[self] = true
+	self.rooms[room] = true
+}
+
+func (self *WebsocketClient) Leave(room string) {
+	self.hub.lock.Lock()
+	defer self.hub.lock.Unlock()
+	self.hub.leave(self, room)
+}
+
+// rooms the client is in
+func (self *WebsocketClient) Rooms() []string {
+	self.hub.lock.RLock()
+	defer self.hub.lock.RUnlock()
+	rooms := make([]string, 0, len(self.rooms))
+	for r := range self.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func (self *WebsocketClient) InRoom(room string) bool {
+	self.hub.lock.RLock()
+	defer self.hub.lock.RUnlock()
+	return self.rooms[room]
+}
+
+// send to everyone in room, the client too if it joined
+func (self *WebsocketClient) BroadcastRoom(room string, msg []byte) {
+	self.hub.BroadcastRoom(room, msg)
+}
+
+// client data, safe to use from other goroutines, e.g. BroadcastIf
+// predicates
 func (self *WebsocketClient) PutData(key string, val interface{}) {
-	self.ctx.PutData(key, val)
+	self.dataLock.Lock()
+	defer self.dataLock.Unlock()
+	if self.data == nil {
+		self.data = make(map[string]interface{})
+	}
+	self.data[key] = val
 }
 
+// data put on the client, or else on the upgrade request's context
 func (self *WebsocketClient) GetData(key string) interface{} {
+	self.dataLock.RLock()
+	v, ok := self.data[key]
+	self.dataLock.RUnlock()
+	if ok {
+		return v
+	}
 	return self.ctx.GetData(key)
 }
 
@@ -52,8 +299,77 @@ func (self *WebsocketClient) IsDebug() bool {
 	return self.ctx.IsDebug()
 }
 
+// whether messages to the client are compressed, false unless the
+// processor enables compression and the client supports it
+func (self *WebsocketClient) Compressed() bool {
+	return atomic.LoadInt32(&self.compress) == 1
+}
+
+// turn compression off or back on for this client, e.g. for already
+// compressed payloads. no effect if it was not negotiated
+func (self *WebsocketClient) SetCompression(on bool) {
+	if !self.deflate {
+		return
+	}
+	if on {
+		atomic.StoreInt32(&self.compress, 1)
+	} else {
+		atomic.StoreInt32(&self.compress, 0)
+	}
+}
+
+// whether the extensions header h names permessage-deflate
+func hasDeflate(h http.Header) bool {
+	for _, ext := range splitList(h.Values("Sec-Websocket-Extensions")) {
+		if name, _, _ := strings.Cut(ext, ";"); strings.TrimSpace(name) == "permessage-deflate" {
+			return true
+		}
+	}
+	return false
+}
+
+// flush queued messages, send a close frame with code and reason and
+// stop once the peer answers. returns without waiting
+func (self *WebsocketClient) CloseWith(code int, reason string) {
+	self.close(code, reason, true)
+}
+
+// first close wins, by us, by the peer or by the connection failing
+func (self *WebsocketClient) close(code int, reason string, ours bool) {
+	self.closeOnce.Do(func() {
+		switch {
+		case ours:
+			self.closeMsg = websocket.FormatCloseMessage(code, reason)
+		case code != websocket.CloseAbnormalClosure:
+			// echo the code of the peer
+			self.closeMsg = websocket.FormatCloseMessage(code, "")
+		}
+		self.closeCode = code
+		self.closeReason = reason
+		self.closedByUs = ours
+		close(self.closing)
+	})
+}
+
+/*
+ * close code and reason, sent by the peer or by us, whichever closed
+ * first. CloseAbnormalClosure if the connection was lost without a
+ * close frame, 0 while connected. set by the time OnClose is called
+ */
+func (self *WebsocketClient) CloseStatus() (code int, reason string) {
+	if !self.isClosing() {
+		return 0, ""
+	}
+	return self.closeCode, self.closeReason
+}
+
 func (self *WebsocketClient) IsAlive() bool {
-	return self.send != nil
+	select {
+	case <-self.done:
+		return false
+	default:
+		return true
+	}
 }
 
 func (self *WebsocketClient) start() {
@@ -61,66 +377,269 @@ func (self *WebsocketClient) start() {
 		fmt.Println("[ws-start] ", self)
 	}
 
-	if self.proc.callbacks != nil && self.proc.callbacks.OnConnect != nil {
-		self.proc.callbacks.OnConnect(self)
+	cbs := self.proc.callbacks
+	if cbs != nil && cbs.OnConnect != nil {
+		cbs.OnConnect(self)
+	}
+
+	// pongs and close answers are written by the writer like anything else
+	self.conn.SetPingHandler(func(data string) error {
+		select {
+		case self.ctrl <- wsMessage{websocket.PongMessage, []byte(data)}:
+		default: // a pong is missed, the peer pings again
+		}
+		if cbs != nil && cbs.OnControl != nil {
+			cbs.OnControl(self, websocket.PingMessage, []byte(data))
+		}
+		return nil
+	})
+	self.conn.SetCloseHandler(func(code int, text string) error {
+		close(self.peerClosed)
+		self.close(code, text, false)
+		return nil
+	})
+
+	// connections not answering pings within pongWait are dropped
+	pongWait := self.proc.pongWait
+	if pongWait > 0 {
+		self.conn.SetReadDeadline(time.Now().Add(pongWait))
 	}
+	self.conn.SetPongHandler(func(data string) error {
+		if pongWait > 0 {
+			self.conn.SetReadDeadline(time.Now().Add(pongWait))
+		}
+		if cbs != nil && cbs.OnControl != nil {
+			cbs.OnControl(self, websocket.PongMessage, []byte(data))
+		}
+		return nil
+	})
 
 	// start reader
 	go func(cli *WebsocketClient) {
 		defer cli.stop()
 		for {
-			if _, msg, err := cli.conn.ReadMessage(); err != nil {
-				log.Println(err)
+			typ, msg, err := cli.readMessage()
+			if errors.Is(err, ErrWebsocketTooBig) {
+				cli.fail("read", err)
+				cli.CloseWith(websocket.ClosePolicyViolation, "message too big")
+				continue
+			} else if err != nil {
+				cli.fail("read", err)
 				break
-			} else {
-				if self.IsDebug() {
-					fmt.Println("[ws-recv] ", msg)
-				}
-				if cli.proc.callbacks != nil && cli.proc.callbacks.OnMessage != nil {
-					cli.proc.callbacks.OnMessage(cli, msg)
+			}
+			if self.IsDebug() {
+				fmt.Println("[ws-recv] ", typ, msg)
+			}
+			cli.metrics.received(len(msg))
+			if cli.isClosing() {
+				// waiting for the close answer
+				continue
+			}
+			if !cli.allow(msg) {
+				if !cli.rateLimited(msg) {
+					cli.fail("read", ErrWebsocketRateLimited)
+					cli.CloseWith(websocket.ClosePolicyViolation, "rate limit exceeded")
 				}
+				continue
+			}
+			cli.dispatch(typ, msg)
+		}
+		if cli.isClosing() {
+			// let the writer finish the close handshake
+			t := time.NewTimer(cli.closeWait())
+			defer t.Stop()
+			select {
+			case <-cli.exited:
+			case <-t.C:
 			}
 		}
 	}(self)
 
-	// start writer
+	// start writer, the only one writing to conn
 	go func(cli *WebsocketClient) {
+		defer close(cli.exited)
 		defer cli.stop()
+
+		var ping <-chan time.Time
+		if cli.proc.pingInterval > 0 {
+			t := time.NewTicker(cli.proc.pingInterval)
+			defer t.Stop()
+			ping = t.C
+		}
+		write := func(typ int, data []byte) error {
+			if cli.proc.writeWait > 0 {
+				cli.conn.SetWriteDeadline(time.Now().Add(cli.proc.writeWait))
+			}
+			// small messages are not worth deflating
+			cli.conn.EnableWriteCompression(cli.Compressed() && len(data) >= cli.proc.compressMin)
+			return cli.conn.WriteMessage(typ, data)
+		}
+
 		for {
+			var message wsMessage
+			// control frames go ahead of queued messages
 			select {
-			case message, ok := <-cli.send:
-				if !ok {
-					cli.conn.WriteMessage(websocket.CloseMessage, []byte{})
-					break
-				} else {
-					if cli.IsDebug() {
-						fmt.Println("[ws-send] ", message)
-					}
-					cli.conn.WriteMessage(websocket.TextMessage, []byte(message))
+			case message = <-cli.ctrl:
+			default:
+				select {
+				case message = <-cli.ctrl:
+				case message = <-cli.send:
+				case <-ping:
+					message = wsMessage{websocket.PingMessage, nil}
+				case <-cli.done:
+					return
+				case <-cli.closing:
+					cli.drain(write)
+					return
 				}
 			}
+			if cli.IsDebug() {
+				fmt.Println("[ws-send] ", message.typ, message.data)
+			}
+			if err := write(message.typ, message.data); err != nil {
+				cli.fail("write", err)
+				return
+			}
+			if message.typ == websocket.TextMessage || message.typ == websocket.BinaryMessage {
+				cli.metrics.sent(len(message.data))
+			}
 		}
 	}(self)
 }
 
+// hand a received message to the callbacks
+func (self *WebsocketClient) dispatch(typ int, msg []byte) {
+	cbs := self.proc.callbacks
+	if cbs == nil {
+		return
+	}
+	switch {
+	case typ == websocket.BinaryMessage && cbs.OnBinaryMessage != nil:
+		cbs.OnBinaryMessage(self, msg)
+	case typ == websocket.TextMessage && cbs.OnJSONMessage != nil && json.Valid(msg):
+		cbs.OnJSONMessage(self, json.RawMessage(msg))
+	case cbs.OnMessage != nil:
+		cbs.OnMessage(self, msg)
+	}
+}
+
+// report err to OnError unless it is a normal end of the connection
+func (self *WebsocketClient) fail(op string, err error) {
+	var ce *websocket.CloseError
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) ||
+		(errors.As(err, &ce) && self.isClosing() && self.closedByUs) || // answer to our close
+		(errors.Is(err, net.ErrClosed) && !self.IsAlive()) {
+		self.ctx.Logger().Debug("ws "+op, "error", err)
+		return
+	}
+	if cbs := self.proc.callbacks; cbs != nil && cbs.OnError != nil {
+		cbs.OnError(self, err)
+		return
+	}
+	self.ctx.Logger().Warn("ws "+op, "error", err)
+}
+
+// next message, messages over the read limit are not read to the end
+// and fail with ErrWebsocketTooBig
+func (self *WebsocketClient) readMessage() (int, []byte, error) {
+	limit := self.proc.readLimit
+	if limit <= 0 {
+		return self.conn.ReadMessage()
+	}
+	typ, r, err := self.conn.NextReader()
+	if err != nil {
+		return typ, nil, err
+	}
+	msg, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return typ, nil, err
+	}
+	if int64(len(msg)) > limit {
+		return typ, nil, ErrWebsocketTooBig
+	}
+	return typ, msg, nil
+}
+
+func (self *WebsocketClient) isClosing() bool {
+	select {
+	case <-self.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// how long the close handshake may take
+func (self *WebsocketClient) closeWait() time.Duration {
+	if self.proc.writeWait > 0 {
+		return self.proc.writeWait
+	}
+	return WebsocketWriteWait
+}
+
+// write what is queued and the close frame, then give the peer
+// closeWait to answer it. nothing is written before answering a close
+// of the peer
+func (self *WebsocketClient) drain(write func(int, []byte) error) {
+	peerClosed := false
+	select {
+	case <-self.peerClosed:
+		peerClosed = true
+	default:
+	}
+
+queued:
+	for !peerClosed {
+		select {
+		case m := <-self.ctrl:
+			if err := write(m.typ, m.data); err != nil {
+				return
+			}
+		case m := <-self.send:
+			if err := write(m.typ, m.data); err != nil {
+				return
+			}
+			self.metrics.sent(len(m.data))
+		default:
+			break queued
+		}
+	}
+	if self.closeMsg == nil {
+		return
+	}
+	if err := write(websocket.CloseMessage, self.closeMsg); err != nil || peerClosed {
+		return
+	}
+
+	t := time.NewTimer(self.closeWait())
+	defer t.Stop()
+	select {
+	case <-self.peerClosed:
+	case <-self.done:
+	case <-t.C:
+	}
+}
+
 func (self *WebsocketClient) stop() {
-	if self.IsAlive() {
+	self.once.Do(func() {
 		if self.IsDebug() {
 			fmt.Println("[ws-stop]", self)
 		}
 
-		self.proc.removeClient(self)
+		self.hub.removeClient(self)
+		self.close(websocket.CloseAbnormalClosure, "", false)
+		self.metrics.disconnected(self.closeCode)
 
 		if self.proc.callbacks != nil && self.proc.callbacks.OnClose != nil {
 			self.proc.callbacks.OnClose(self)
 		}
 
-		close(self.send)
-		self.conn.Close()
-
 		// to mark client is gone
-		self.send = nil
-	}
+		close(self.done)
+		if self.conn != nil {
+			self.conn.Close()
+		}
+	})
 }
 
 /*
@@ -128,76 +647,146 @@ func (self *WebsocketClient) stop() {
  */
 type WebsocketProcessor struct {
 	DefaultProcessor
-	bufsize   int
-	callbacks *WebsocketCallback
-	clients   map[*WebsocketClient]bool
-	lock      sync.RWMutex
+	upgrader websocket.Upgrader
+
+	allowOrigin func(*http.Request) bool // set by AllowOrigins
+	callbacks   *WebsocketCallback
+	hub         *Hub
+	ownHub      bool // created with the processor, closed with it
+
+	pingInterval time.Duration
+	pongWait     time.Duration
+	writeWait    time.Duration
+
+	queue    int // send queue capacity per client
+	overflow int
+
+	draining int32 // new connections are refused once set
+
+	readLimit int64 // max message size, 0 for no limit
+
+	msgRate  float64 // per client and second, 0 for no limit
+	byteRate float64
+
+	compress      bool
+	compressLevel int
+	compressMin   int // smaller messages are sent uncompressed
 }
 
-func (self *WebsocketProcessor) removeClient(cli *WebsocketClient) {
-	self.lock.Lock()
-	defer self.lock.Unlock()
+// messages shorter than this are not compressed by default
+const WebsocketCompressMin = 256
 
-	if _, ok := self.clients[cli]; ok {
-		delete(self.clients, cli)
-	}
+// what happens to a message for a client whose send queue is full
+const (
+	WebsocketCloseSlow  = iota // close the client, the default
+	WebsocketDropNewest        // drop the message
+	WebsocketDropOldest        // drop the oldest queued message
+	WebsocketBlock             // wait, a slow client stalls the sender
+)
+
+const WebsocketSendQueue = 64
+
+type WebsocketStats struct {
+	Clients   int
+	Queued    int // messages waiting in all queues
+	MaxQueued int // longest queue
+	Dropped   uint64
+
+	RateLimited uint64 // messages over the rate limit
 }
 
-func (self *WebsocketProcessor) broadcast(msg []byte) {
-	fails := make([]*WebsocketClient, 0)
-	{
-		self.lock.RLock()
-		defer self.lock.RUnlock()
-		for cli := range self.clients {
-			select {
-			case cli.send <- msg:
-			default: // fail sending msg to cli
-				fails = append(fails, cli)
-			}
-		}
-	}
+// keepalive defaults, a client is dropped when a pong does not arrive
+// within pongWait
+const (
+	WebsocketPingInterval = 50 * time.Second
+	WebsocketPongWait     = 60 * time.Second
+	WebsocketWriteWait    = 10 * time.Second
+)
 
-	if len(fails) > 0 {
-		// close failed clients
-		for _, c := range fails {
-			c.stop()
-		}
-	}
+func (self *WebsocketProcessor) Hub() *Hub {
+	return self.hub
 }
 
+// close the clients of this processor, and its hub if not shared
 func (self *WebsocketProcessor) Close() {
-	for c := range self.clients {
-		c.stop()
-		delete(self.clients, c)
+	atomic.StoreInt32(&self.draining, 1)
+	if self.ownHub {
+		self.hub.Close()
+	} else {
+		var clients []*WebsocketClient
+		for _, c := range self.hub.Clients() {
+			if c.proc == self {
+				clients = append(clients, c)
+			}
+		}
+		drainClients(clients, "server shutdown", WebsocketDrainTimeout)
 	}
 	self.DefaultProcessor.Close()
 }
 
-func (self *WebsocketProcessor) Process(ctx *NxContext) {
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  self.bufsize,
-		WriteBufferSize: self.bufsize,
+// client on conn, added to the hub but not started
+func (self *WebsocketProcessor) newClient(ctx *NxContext, conn *websocket.Conn, deflate bool) *WebsocketClient {
+	cli := &WebsocketClient{
+		ctx:  ctx,
+		proc: self,
+		hub:  self.hub,
+		conn: conn,
+		send: make(chan wsMessage, self.queue),
+		ctrl: make(chan wsMessage, 8),
+		done: make(chan struct{}),
+
+		closing: make(chan struct{}),
+		exited:  make(chan struct{}),
+
+		peerClosed: make(chan struct{}),
+		rooms:      make(map[string]bool),
+		id:         newUUID(),
+
+		msgRate:  newTokenBucket(self.msgRate),
+		byteRate: newTokenBucket(self.byteRate),
 	}
-	if self.callbacks != nil {
-		upgrader.CheckOrigin = self.callbacks.OnCheckOrigin
+	if h := ctx.handler(); h != nil && ctx.entry != nil {
+		cli.metrics = h.metrics.websocket(ctx.entry.Name())
+		cli.metrics.connected()
 	}
+	if deflate {
+		conn.SetCompressionLevel(self.compressLevel)
+		cli.deflate = true
+		cli.compress = 1
+	}
+	self.hub.addClient(cli)
+	return cli
+}
 
-	if conn, err := upgrader.Upgrade(ctx.res, ctx.req, nil); err == nil {
-		cli := &WebsocketClient{
-			ctx:  ctx,
-			proc: self,
-			conn: conn,
-			send: make(chan []byte),
-		}
-
-		self.lock.Lock()
-		self.clients[cli] = true
-		self.lock.Unlock()
+// OnCheckOrigin if set, then AllowOrigins, else the same host check of
+// gorilla
+func (self *WebsocketProcessor) checkOrigin(r *http.Request) bool {
+	if self.callbacks != nil && self.callbacks.OnCheckOrigin != nil {
+		return self.callbacks.OnCheckOrigin(r)
+	}
+	if self.allowOrigin != nil {
+		return self.allowOrigin(r)
+	}
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
 
-		cli.start()
+func (self *WebsocketProcessor) Process(ctx *NxContext) {
+	if atomic.LoadInt32(&self.draining) != 0 || atomic.LoadInt32(&self.hub.draining) != 0 {
+		ctx.End(http.StatusServiceUnavailable)
+		return
+	}
+	if conn, err := self.upgrader.Upgrade(ctx.res, ctx.req, nil); err == nil {
+		// offered by the client, so accepted by the upgrader
+		deflate := self.compress && hasDeflate(ctx.req.Header)
+		self.newClient(ctx, conn, deflate).start()
 		ctx.RunNext()
 	} else {
-		log.Print(err)
+		ctx.Logger().Warn("ws upgrade", "error", err)
 		ctx.End(http.StatusNotAcceptable)
 	}
 }
@@ -216,24 +805,166 @@ func (self *WSEntry) SetCallback(c *WebsocketCallback) *WSEntry {
 	return self
 }
 
-/* handler methods for ws */
-func (self *NxHandler) Websocket(pattern string, ps ...NxProcessor) *WSEntry {
-	if _, ok := self.getmap[pattern]; ok {
-		panic(fmt.Sprintf("pattern %q exists", pattern))
+func (self *WSEntry) wsproc() *WebsocketProcessor {
+	for p := self.Processor(); p != nil; p = p.getnext() {
+		if w, ok := p.(*WebsocketProcessor); ok {
+			return w
+		}
+	}
+	return nil
+}
+
+// ping every pingInterval and drop clients silent for pongWait, 0
+// disables either. writes taking longer than writeWait fail
+func (self *WSEntry) SetKeepalive(pingInterval, pongWait, writeWait time.Duration) *WSEntry {
+	w := self.wsproc()
+	w.pingInterval = pingInterval
+	w.pongWait = pongWait
+	w.writeWait = writeWait
+	return self
+}
+
+// per client send queue capacity and the policy when it is full
+func (self *WSEntry) SetSendQueue(size int, overflow int) *WSEntry {
+	w := self.wsproc()
+	w.queue = size
+	w.overflow = overflow
+	return self
+}
+
+// share hub with other entries, clients of all of them are managed and
+// broadcast to together. to be called before serving
+func (self *WSEntry) SetHub(hub *Hub) *WSEntry {
+	w := self.wsproc()
+	w.hub = hub
+	w.ownHub = false
+	return self
+}
+
+func (self *WSEntry) Hub() *Hub {
+	return self.wsproc().hub
+}
+
+func (self *WSEntry) Stats() WebsocketStats {
+	return self.Hub().Stats()
+}
+
+// send to all clients from outside a client callback
+func (self *WSEntry) Broadcast(msg []byte) {
+	self.Hub().Broadcast(msg)
+}
+
+// send to the clients pred is true for
+func (self *WSEntry) BroadcastIf(msg []byte, pred func(cli *WebsocketClient) bool) {
+	self.Hub().BroadcastIf(msg, pred)
+}
+
+// send to a room from outside a client callback
+func (self *WSEntry) BroadcastRoom(room string, msg []byte) {
+	self.Hub().BroadcastRoom(room, msg)
+}
+
+func (self *WSEntry) Rooms() []string {
+	return self.Hub().Rooms()
+}
+
+// connection buffer sizes, they do not limit message sizes
+func (self *WSEntry) SetBufferSizes(read, write int) *WSEntry {
+	u := self.Upgrader()
+	u.ReadBufferSize = read
+	u.WriteBufferSize = write
+	u.WriteBufferPool = websocketWritePool(write)
+	return self
+}
+
+func (self *WSEntry) SetHandshakeTimeout(d time.Duration) *WSEntry {
+	self.Upgrader().HandshakeTimeout = d
+	return self
+}
+
+// the upgrader of the entry, made once, for settings without a setter,
+// e.g. Subprotocols. to be changed before serving
+func (self *WSEntry) Upgrader() *websocket.Upgrader {
+	return &self.wsproc().upgrader
+}
+
+// close clients sending messages larger than n bytes, 0 for no limit
+func (self *WSEntry) SetReadLimit(n int64) *WSEntry {
+	self.wsproc().readLimit = n
+	return self
+}
+
+/*
+ * negotiate permessage-deflate with clients supporting it. level is a
+ * compress/flate level, messages shorter than min bytes are sent as is
+ */
+func (self *WSEntry) SetCompression(enable bool, level int, min int) *WSEntry {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		panic(fmt.Sprintf("invalid compression level %d", level))
 	}
+	w := self.wsproc()
+	w.compress = enable
+	w.upgrader.EnableCompression = enable
+	w.compressLevel = level
+	w.compressMin = min
+	return self
+}
+
+// close all clients of the hub gracefully, see Hub.Drain
+func (self *WSEntry) Drain(reason string, timeout time.Duration) int {
+	return self.Hub().Drain(reason, timeout)
+}
 
+func (self *WSEntry) Clients() []*WebsocketClient {
+	return self.Hub().Clients()
+}
+
+func (self *WSEntry) Client(id string) *WebsocketClient {
+	return self.Hub().Client(id)
+}
+
+// send to one client, false if it is not connected
+func (self *WSEntry) SendTo(id string, msg []byte) bool {
+	return self.Hub().SendTo(id, msg)
+}
+
+// read and write buffer size of connections
+const WebsocketBufferSize = 256
+
+func newWebsocketProcessor() *WebsocketProcessor {
 	p := &WebsocketProcessor{
 		DefaultProcessor: DefaultProcessor{
 			name: "websocket",
 		},
-		bufsize: 256,
-		clients: make(map[*WebsocketClient]bool),
-		lock:    sync.RWMutex{},
+		hub:    NewHub(),
+		ownHub: true,
+
+		queue:         WebsocketSendQueue,
+		compressLevel: flate.DefaultCompression,
+		compressMin:   WebsocketCompressMin,
+		pingInterval:  WebsocketPingInterval,
+		pongWait:      WebsocketPongWait,
+		writeWait:     WebsocketWriteWait,
+	}
+	p.upgrader = websocket.Upgrader{
+		ReadBufferSize:  WebsocketBufferSize,
+		WriteBufferSize: WebsocketBufferSize,
+		WriteBufferPool: websocketWritePool(WebsocketBufferSize),
+		CheckOrigin:     p.checkOrigin,
+	}
+	return p
+}
+
+/* handler methods for ws */
+func (self *NxHandler) Websocket(pattern string, ps ...NxProcessor) *WSEntry {
+	if _, ok := self.table().entries["GET"][pattern]; ok {
+		panic(fmt.Sprintf("pattern %q exists", pattern))
 	}
 
+	p := newWebsocketProcessor()
 	en := &WSEntry{
-		*NewRegexpEntry(pattern, append(ps, p)...),
+		*self.newEntry(pattern, append(ps, p)...),
 	}
-	self.getmap[pattern] = en
+	self.addEntry("GET", en)
 	return en
 }
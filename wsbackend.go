@@ -0,0 +1,87 @@
+package nxhttp
+
+import (
+	"encoding/json"
+	"log/slog"
+)
+
+/*
+ * pub/sub carrying broadcasts between nodes, so clients connected to
+ * other replicas get them too
+ */
+type BroadcastBackend interface {
+	Publish(channel string, data []byte) error
+
+	// call fn with every message published on channel, by any node,
+	// until unsubscribe is called
+	Subscribe(channel string, fn func(data []byte)) (unsubscribe func(), err error)
+}
+
+// broadcast as it travels between nodes
+type wsEnvelope struct {
+	Node string `json:"node"`
+	Room string `json:"room,omitempty"` // all clients if empty
+	Type int    `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// relay broadcasts through backend on channel, local clients get them
+// directly, the others through the subscription
+func (self *Hub) SetBroadcastBackend(backend BroadcastBackend, channel string) error {
+	self.unsubscribe()
+
+	node := newUUID()
+	unsub, err := backend.Subscribe(channel, func(data []byte) {
+		var env wsEnvelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			slog.Warn("ws broadcast backend", "channel", channel, "error", err)
+			return
+		}
+		if env.Node == node {
+			return
+		}
+		self.deliver(env.Room, wsMessage{env.Type, env.Data})
+	})
+	if err != nil {
+		return err
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.backend = backend
+	self.channel = channel
+	self.node = node
+	self.unsub = unsub
+	return nil
+}
+
+func (self *Hub) unsubscribe() {
+	self.lock.Lock()
+	unsub := self.unsub
+	self.backend, self.unsub = nil, nil
+	self.lock.Unlock()
+	if unsub != nil {
+		unsub()
+	}
+}
+
+// hand msg to the other nodes
+func (self *Hub) publish(room string, msg wsMessage) {
+	self.lock.RLock()
+	backend, channel, node := self.backend, self.channel, self.node
+	self.lock.RUnlock()
+	if backend == nil {
+		return
+	}
+
+	data, _ := json.Marshal(&wsEnvelope{Node: node, Room: room, Type: msg.typ, Data: msg.data})
+	if err := backend.Publish(channel, data); err != nil {
+		slog.Warn("ws broadcast backend", "channel", channel, "error", err)
+	}
+}
+
+// send broadcasts of the entry's hub through backend on channel, to
+// reach the clients of every node subscribed to it
+func (self *WSEntry) SetBroadcastBackend(backend BroadcastBackend, channel string) error {
+	return self.Hub().SetBroadcastBackend(backend, channel)
+}
@@ -0,0 +1,231 @@
+package nxhttp
+
+import (
+	"compress/flate"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// reconnect delay bounds of WebsocketDialer
+const (
+	WebsocketMinBackoff = time.Second
+	WebsocketMaxBackoff = 30 * time.Second
+
+	websocketBackoffFloor = 100 * time.Millisecond
+)
+
+/*
+ * outbound websocket, kept connected to url. each connection is a
+ * WebsocketClient handed to the same callbacks as served ones, so
+ * OnConnect is called again after every reconnect
+ *
+ *	d := nxhttp.NewWebsocketDialer("wss://feed.example.com/ws", nil, &nxhttp.WebsocketCallback{
+ *		OnMessage: func(cli *nxhttp.WebsocketClient, msg []byte) {...},
+ *	}).Start()
+ *	defer d.Close()
+ */
+type WebsocketDialer struct {
+	url    string
+	header http.Header
+	dialer websocket.Dialer
+	proc   *WebsocketProcessor
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	lock sync.Mutex
+	cli  *WebsocketClient // current connection, nil while down
+	stop chan struct{}
+	once sync.Once
+}
+
+// header is sent with every handshake, it may be nil
+func NewWebsocketDialer(url string, header http.Header, callbacks *WebsocketCallback) *WebsocketDialer {
+	p := newWebsocketProcessor()
+	p.callbacks = callbacks
+	return &WebsocketDialer{
+		url:    url,
+		header: header,
+		dialer: websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: 45 * time.Second,
+		},
+		proc:       p,
+		minBackoff: WebsocketMinBackoff,
+		maxBackoff: WebsocketMaxBackoff,
+		stop:       make(chan struct{}),
+	}
+}
+
+// reconnect after min, doubling up to max while connecting fails. min is
+// at least 100ms, so a failing upstream is not dialed in a tight loop
+func (self *WebsocketDialer) SetBackoff(min, max time.Duration) *WebsocketDialer {
+	if min < websocketBackoffFloor {
+		min = websocketBackoffFloor
+	}
+	if max < min {
+		max = min
+	}
+	self.minBackoff = min
+	self.maxBackoff = max
+	return self
+}
+
+// see WSEntry.SetKeepalive
+func (self *WebsocketDialer) SetKeepalive(pingInterval, pongWait, writeWait time.Duration) *WebsocketDialer {
+	self.proc.pingInterval = pingInterval
+	self.proc.pongWait = pongWait
+	self.proc.writeWait = writeWait
+	return self
+}
+
+// see WSEntry.SetSendQueue
+func (self *WebsocketDialer) SetSendQueue(size int, overflow int) *WebsocketDialer {
+	self.proc.queue = size
+	self.proc.overflow = overflow
+	return self
+}
+
+func (self *WebsocketDialer) SetReadLimit(n int64) *WebsocketDialer {
+	self.proc.readLimit = n
+	return self
+}
+
+// offer permessage-deflate, see WSEntry.SetCompression
+func (self *WebsocketDialer) SetCompression(enable bool, level int, min int) *WebsocketDialer {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		panic(fmt.Sprintf("invalid compression level %d", level))
+	}
+	self.dialer.EnableCompression = enable
+	self.proc.compress = enable
+	self.proc.compressLevel = level
+	self.proc.compressMin = min
+	return self
+}
+
+// the dialer used for handshakes, to set tls config, proxy or timeouts
+func (self *WebsocketDialer) Dialer() *websocket.Dialer {
+	return &self.dialer
+}
+
+// connect in the background and keep reconnecting until Close
+func (self *WebsocketDialer) Start() *WebsocketDialer {
+	go self.run()
+	return self
+}
+
+func (self *WebsocketDialer) run() {
+	backoff := self.minBackoff
+	for {
+		start := time.Now()
+		if cli, err := self.connect(); err != nil {
+			slog.Warn("ws dial", "url", self.url, "error", err)
+		} else {
+			select {
+			case <-cli.done:
+			case <-self.stop:
+				cli.CloseWith(websocket.CloseNormalClosure, "")
+				return
+			}
+			self.setClient(nil)
+			// a connection that lasted starts the backoff over
+			if time.Since(start) > self.maxBackoff {
+				backoff = self.minBackoff
+			}
+		}
+
+		// up to half of it again as jitter, so peers do not come back at once
+		wait := backoff
+		if backoff > 1 {
+			wait += time.Duration(rand.Int63n(int64(backoff / 2)))
+		}
+		select {
+		case <-time.After(wait):
+		case <-self.stop:
+			return
+		}
+		if backoff *= 2; backoff > self.maxBackoff {
+			backoff = self.maxBackoff
+		}
+	}
+}
+
+func (self *WebsocketDialer) connect() (*WebsocketClient, error) {
+	conn, res, err := self.dialer.Dial(self.url, self.header)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake as seen by the callbacks
+	req, _ := http.NewRequest("GET", self.url, nil)
+	if self.header != nil {
+		req.Header = self.header.Clone()
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	ctx := NewContext(nil, req)
+
+	cli := self.proc.newClient(ctx, conn, self.proc.compress && hasDeflate(res.Header))
+	self.setClient(cli)
+	cli.start()
+	return cli, nil
+}
+
+func (self *WebsocketDialer) setClient(cli *WebsocketClient) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.cli = cli
+}
+
+// current connection, nil while disconnected
+func (self *WebsocketDialer) Client() *WebsocketClient {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.cli
+}
+
+func (self *WebsocketDialer) IsConnected() bool {
+	cli := self.Client()
+	return cli != nil && cli.IsAlive()
+}
+
+// send a text message, fails with ErrWebsocketClosed while disconnected
+func (self *WebsocketDialer) Send(msg []byte) error {
+	return self.SendMessage(websocket.TextMessage, msg)
+}
+
+func (self *WebsocketDialer) SendText(text string) error {
+	return self.SendMessage(websocket.TextMessage, []byte(text))
+}
+
+func (self *WebsocketDialer) SendBinary(data []byte) error {
+	return self.SendMessage(websocket.BinaryMessage, data)
+}
+
+func (self *WebsocketDialer) SendMessage(msgType int, data []byte) error {
+	cli := self.Client()
+	if cli == nil {
+		return ErrWebsocketClosed
+	}
+	return cli.SendMessage(msgType, data)
+}
+
+func (self *WebsocketDialer) SendJSON(v interface{}) error {
+	cli := self.Client()
+	if cli == nil {
+		return ErrWebsocketClosed
+	}
+	return cli.SendJSON(v)
+}
+
+// stop reconnecting and close the connection normally
+func (self *WebsocketDialer) Close() {
+	self.once.Do(func() {
+		close(self.stop)
+	})
+}
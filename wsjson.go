@@ -0,0 +1,102 @@
+package nxhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// send v as a json text message, encoded by the handler's json codec
+func (self *WebsocketClient) SendJSON(v interface{}) error {
+	codec, opts := self.ctx.jsonCodec()
+	opts.Indent = "" // one message, no need to be pretty
+
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, v, &opts); err != nil {
+		return err
+	}
+	return self.Send(bytes.TrimRight(buf.Bytes(), "\n"))
+}
+
+// decode a message by the handler's json codec
+func (self *WebsocketClient) DecodeJSON(msg []byte, v interface{}) error {
+	codec, _ := self.ctx.jsonCodec()
+	return codec.Decode(bytes.NewReader(msg), v)
+}
+
+/*
+ * json message dispatcher keyed by the "type" field of messages
+ *
+ *	r := nxhttp.NewWebsocketRouter()
+ *	nxhttp.HandleJSON(r, "chat", func(cli *nxhttp.WebsocketClient, m *Chat) {...})
+ *	en.SetCallback(&nxhttp.WebsocketCallback{OnJSONMessage: r.Dispatch})
+ */
+type WebsocketRouter struct {
+	lock     sync.RWMutex
+	handlers map[string]func(*WebsocketClient, json.RawMessage)
+
+	// messages without a handler, ignored if nil
+	OnUnknown func(cli *WebsocketClient, typ string, msg json.RawMessage)
+
+	// messages failing to decode, they are logged if nil
+	OnInvalid func(cli *WebsocketClient, msg json.RawMessage, err error)
+}
+
+func NewWebsocketRouter() *WebsocketRouter {
+	return &WebsocketRouter{
+		handlers: make(map[string]func(*WebsocketClient, json.RawMessage)),
+	}
+}
+
+// call fn with the whole raw message for messages of type typ
+func (self *WebsocketRouter) On(typ string, fn func(*WebsocketClient, json.RawMessage)) *WebsocketRouter {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.handlers[typ]; ok {
+		panic(fmt.Sprintf("websocket message type %q exists", typ))
+	}
+	self.handlers[typ] = fn
+	return self
+}
+
+// call fn with messages of type typ decoded into a T
+func HandleJSON[T any](r *WebsocketRouter, typ string, fn func(*WebsocketClient, T)) *WebsocketRouter {
+	return r.On(typ, func(cli *WebsocketClient, msg json.RawMessage) {
+		var v T
+		if err := cli.DecodeJSON(msg, &v); err != nil {
+			r.invalid(cli, msg, err)
+			return
+		}
+		fn(cli, v)
+	})
+}
+
+func (self *WebsocketRouter) invalid(cli *WebsocketClient, msg json.RawMessage, err error) {
+	if self.OnInvalid != nil {
+		self.OnInvalid(cli, msg, err)
+	} else {
+		cli.ctx.Logger().Debug("ws invalid message", "error", err)
+	}
+}
+
+// route msg by its type, fits WebsocketCallback.OnJSONMessage
+func (self *WebsocketRouter) Dispatch(cli *WebsocketClient, msg json.RawMessage) {
+	var head struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(msg, &head); err != nil {
+		self.invalid(cli, msg, err)
+		return
+	}
+
+	self.lock.RLock()
+	fn := self.handlers[head.Type]
+	self.lock.RUnlock()
+
+	if fn != nil {
+		fn(cli, msg)
+	} else if self.OnUnknown != nil {
+		self.OnUnknown(cli, head.Type, msg)
+	}
+}
@@ -0,0 +1,34 @@
+// broadcast backend of nxhttp hubs on nats subjects, apart so nats.go is
+// only a dependency of programs using it
+//
+//	hub.SetBroadcastBackend(wsnats.NewBackend(conn), "chat")
+package wsnats
+
+import (
+	"github.com/nats-io/nats.go"
+	"github.com/pumingjohnray/nxhttp"
+)
+
+type Backend struct {
+	conn *nats.Conn
+}
+
+var _ nxhttp.BroadcastBackend = (*Backend)(nil)
+
+func NewBackend(conn *nats.Conn) *Backend {
+	return &Backend{conn: conn}
+}
+
+func (self *Backend) Publish(subject string, data []byte) error {
+	return self.conn.Publish(subject, data)
+}
+
+func (self *Backend) Subscribe(subject string, fn func(data []byte)) (func(), error) {
+	sub, err := self.conn.Subscribe(subject, func(m *nats.Msg) {
+		fn(m.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, nil
+}
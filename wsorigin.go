@@ -0,0 +1,125 @@
+package nxhttp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+ * allowed websocket origin. "https://app.example.com" matches the exact
+ * scheme, host and port, "*.example.org" any subdomain over http or
+ * https, "*" anything
+ */
+type originPattern struct {
+	any    bool
+	scheme string // empty for http and https
+	host   string // without the "*." of wildcards
+	port   string // empty for the default port of the scheme
+	sub    bool   // subdomains of host, not host itself
+}
+
+func parseOriginPattern(p string) (originPattern, error) {
+	p = strings.ToLower(strings.TrimSpace(p))
+	if p == "*" {
+		return originPattern{any: true}, nil
+	}
+
+	var o originPattern
+	if scheme, rest, ok := strings.Cut(p, "://"); ok {
+		if scheme != "http" && scheme != "https" {
+			return o, fmt.Errorf("origin %q: scheme must be http or https", p)
+		}
+		o.scheme = scheme
+		p = rest
+	}
+	if strings.HasPrefix(p, "*.") {
+		o.sub = true
+		p = p[2:]
+	}
+	o.host = p
+	if h, port, err := net.SplitHostPort(p); err == nil {
+		o.host, o.port = h, port
+	}
+	if len(o.host) == 0 || strings.ContainsAny(o.host, "*/") {
+		return o, fmt.Errorf("invalid origin %q", p)
+	}
+	if o.port == defaultPort(o.scheme) {
+		o.port = ""
+	}
+	return o, nil
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+func (self originPattern) match(u *url.URL) bool {
+	if self.any {
+		return true
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if len(self.scheme) > 0 && scheme != self.scheme {
+		return false
+	} else if scheme != "http" && scheme != "https" {
+		return false
+	}
+
+	port := u.Port()
+	if port == defaultPort(scheme) {
+		port = ""
+	}
+	if port != self.port {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if self.sub {
+		return strings.HasSuffix(host, "."+self.host)
+	}
+	return host == self.host
+}
+
+// origin checker for patterns, requests without Origin are not from
+// browsers and pass
+func allowOrigins(patterns []originPattern) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		for _, p := range patterns {
+			if p.match(u) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// accept connections from origins only, see originPattern. panics on a
+// malformed origin. OnCheckOrigin takes precedence if set
+func (self *WSEntry) AllowOrigins(origins ...string) *WSEntry {
+	patterns := make([]originPattern, 0, len(origins))
+	for _, o := range origins {
+		p, err := parseOriginPattern(o)
+		if err != nil {
+			panic(err)
+		}
+		patterns = append(patterns, p)
+	}
+	self.wsproc().allowOrigin = allowOrigins(patterns)
+	return self
+}
@@ -0,0 +1,75 @@
+package nxhttp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/*
+ * token bucket holding one second worth of tokens. a full bucket lets
+ * any one message through, so messages larger than a second's bytes are
+ * not refused forever
+ */
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	tokens float64
+	last   time.Time
+}
+
+// nil, which allows everything, if rate is not positive
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// refill by the time passed, whether n tokens may be taken
+func (self *tokenBucket) fits(n float64) bool {
+	if self == nil {
+		return true
+	}
+	now := time.Now()
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	self.last = now
+	if self.tokens > self.rate {
+		self.tokens = self.rate
+	}
+	return self.tokens >= n || self.tokens >= self.rate
+}
+
+func (self *tokenBucket) spend(n float64) {
+	if self != nil {
+		self.tokens -= n
+	}
+}
+
+// whether msg fits the client's message and byte rates. only accepted
+// messages are paid for, in both buckets
+func (self *WebsocketClient) allow(msg []byte) bool {
+	n := float64(len(msg))
+	if !self.msgRate.fits(1) || !self.byteRate.fits(n) {
+		return false
+	}
+	self.msgRate.spend(1)
+	self.byteRate.spend(n)
+	return true
+}
+
+// msg is over the rate, true if the client is to be kept
+func (self *WebsocketClient) rateLimited(msg []byte) bool {
+	atomic.AddUint64(&self.hub.limited, 1)
+	if cbs := self.proc.callbacks; cbs != nil && cbs.OnRateLimit != nil {
+		return cbs.OnRateLimit(self, msg)
+	}
+	return false
+}
+
+// limit each client to msgs messages and bytes bytes per second, 0 for
+// no limit. clients over it are closed unless OnRateLimit keeps them
+func (self *WSEntry) SetRateLimit(msgs, bytes float64) *WSEntry {
+	w := self.wsproc()
+	w.msgRate = msgs
+	w.byteRate = bytes
+	return self
+}
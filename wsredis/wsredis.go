@@ -0,0 +1,43 @@
+// broadcast backend of nxhttp hubs on redis pub/sub, apart so go-redis is
+// only a dependency of programs using it
+//
+//	hub.SetBroadcastBackend(wsredis.NewBackend(client), "chat")
+package wsredis
+
+import (
+	"context"
+
+	"github.com/pumingjohnray/nxhttp"
+	"github.com/redis/go-redis/v9"
+)
+
+type Backend struct {
+	client redis.UniversalClient
+}
+
+var _ nxhttp.BroadcastBackend = (*Backend)(nil)
+
+func NewBackend(client redis.UniversalClient) *Backend {
+	return &Backend{client: client}
+}
+
+func (self *Backend) Publish(channel string, data []byte) error {
+	return self.client.Publish(context.Background(), channel, data).Err()
+}
+
+func (self *Backend) Subscribe(channel string, fn func(data []byte)) (func(), error) {
+	ctx := context.Background()
+	ps := self.client.Subscribe(ctx, channel)
+	// wait for the subscription to be confirmed
+	if _, err := ps.Receive(ctx); err != nil {
+		ps.Close()
+		return nil, err
+	}
+
+	go func() {
+		for m := range ps.Channel() {
+			fn([]byte(m.Payload))
+		}
+	}()
+	return func() { ps.Close() }, nil
+}